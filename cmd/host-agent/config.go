@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/middleware-labs/mw-agent/pkg/agent"
+	"github.com/middleware-labs/mw-agent/pkg/redact"
+	cli "github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// configCommand returns the "config" command which groups the commands
+// operating on the otel config of the host agent.
+func configCommand(flags []cli.Flag, cfg *agent.HostConfig) *cli.Command {
+	before := altsrc.InitInputSourceWithContext(flags, altsrc.NewYamlSourceFromFlagFunc("config-file"))
+
+	return &cli.Command{
+		Name:  "config",
+		Usage: "Inspect and manage the otel config of the agent",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "history",
+				Usage:  "List the otel configs applied by the agent",
+				Flags:  flags,
+				Before: before,
+				Action: func(c *cli.Context) error {
+					return listConfigHistory(newConfigHistory(cfg))
+				},
+			},
+			{
+				Name:      "rollback",
+				Usage:     "Restore an otel config from the history",
+				ArgsUsage: "<id>",
+				Flags:     flags,
+				Before:    before,
+				Action: func(c *cli.Context) error {
+					id := c.Args().First()
+					if id == "" {
+						return fmt.Errorf("config revision id is required, see 'mw-agent config history'")
+					}
+					return rollbackConfig(newConfigHistory(cfg), id, cfg.OtelConfigFile)
+				},
+			},
+			{
+				Name:   "diff",
+				Usage:  "Show the changes between the otel config from the Middleware backend and the applied one",
+				Flags:  flags,
+				Before: before,
+				Action: func(c *cli.Context) error {
+					return diffConfig(cfg)
+				},
+			},
+			{
+				Name:  "render",
+				Usage: "Print the otel config the agent would apply, without applying it",
+				Flags: append(append([]cli.Flag{}, flags...),
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "File to write the otel config to. Defaults to stdout.",
+					},
+					&cli.StringFlag{
+						Name:  "infra-platform",
+						Usage: "Infra platform to render the config for: instance, ec2, ecsec2, ecsfargate or cycleio. Defaults to the detected one.",
+					},
+					&cli.StringFlag{
+						Name:  "config-type",
+						Usage: "Ingestion rules to render: docker or nodocker. Defaults to docker if the docker socket is available.",
+					},
+				),
+				Before: before,
+				Action: func(c *cli.Context) error {
+					return renderConfig(cfg, c.String("output"),
+						c.String("infra-platform"), c.String("config-type"))
+				},
+			},
+			{
+				Name:      "validate",
+				Usage:     "Check that an otel config can be run by this build of the agent",
+				ArgsUsage: "<file>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "component-set",
+						Usage: "Otel components to validate against: host or kube.",
+						Value: string(agent.ComponentSetHost),
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return validateConfig(c.Args().First(), agent.ComponentSet(c.String("component-set")))
+				},
+			},
+			{
+				Name:      "lint",
+				Usage:     "Report otel config settings that go against the recommended practices",
+				ArgsUsage: "<file>",
+				Action: func(c *cli.Context) error {
+					return lintConfig(c.Args().First())
+				},
+			},
+		},
+	}
+}
+
+// newHostAgent returns a host agent for the config commands. Its logs are
+// written to stderr so that they do not mix with the command output.
+func newHostAgent(cfg *agent.HostConfig, opts ...agent.HostOptions) (*agent.HostAgent, error) {
+	zapCore := zapcore.NewCore(zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()),
+		redact.WriteSyncer(zapcore.AddSync(os.Stderr)), zapcore.WarnLevel)
+
+	if err := cfg.ResolveSecrets(zap.New(zapCore)); err != nil {
+		return nil, err
+	}
+
+	if cfg.APIURLForConfigCheck == "" {
+		apiURL, err := agent.GetAPIURLForConfigCheck(cfg.Target)
+		if err != nil {
+			return nil, err
+		}
+		cfg.APIURLForConfigCheck = apiURL
+	}
+
+	return agent.NewHostAgent(*cfg, zapCore, append([]agent.HostOptions{
+		agent.WithHostAgentVersion(agentVersion),
+		agent.WithHostAgentInfraPlatform(detectInfraPlatform()),
+	}, opts...)...)
+}
+
+func newConfigHistory(cfg *agent.HostConfig) *agent.ConfigHistory {
+	return agent.NewConfigHistory(filepath.Join(cfg.StateDir, agent.ConfigHistoryDir),
+		cfg.ConfigHistorySize)
+}
+
+func listConfigHistory(history *agent.ConfigHistory) error {
+	revisions, err := history.List()
+	if err != nil {
+		return err
+	}
+
+	if len(revisions) == 0 {
+		fmt.Printf("No config history found in %s.\n", history.Dir())
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tAPPLIED AT\tSTATUS\tREASON")
+	// newest first
+	for i := len(revisions) - 1; i >= 0; i-- {
+		r := revisions[i]
+		reason := r.Reason
+		if reason == "" {
+			reason = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.ID,
+			r.AppliedAt.Local().Format(time.RFC3339), r.Status, reason)
+	}
+	return w.Flush()
+}
+
+func diffConfig(cfg *agent.HostConfig) error {
+	hostAgent, err := newHostAgent(cfg)
+	if err != nil {
+		return err
+	}
+
+	fetched, err := hostAgent.FetchOtelConfig()
+	if err != nil {
+		return err
+	}
+
+	current, err := os.ReadFile(cfg.OtelConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	changes, err := agent.DiffOtelConfigs(current, fetched)
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 {
+		fmt.Printf("No changes to %s.\n", cfg.OtelConfigFile)
+		return nil
+	}
+
+	fmt.Printf("Changes to %s:\n", cfg.OtelConfigFile)
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	return nil
+}
+
+// renderConfig writes the otel config the agent would apply to output, or
+// to stdout if output is empty. infraPlatform and configType override the
+// detected ones if set.
+func renderConfig(cfg *agent.HostConfig, output string, infraPlatform string, configType string) error {
+	var opts []agent.HostOptions
+	if infraPlatform != "" {
+		p, err := agent.ParseInfraPlatform(infraPlatform)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, agent.WithHostAgentInfraPlatform(p))
+	}
+
+	if configType != "" && configType != "docker" && configType != "nodocker" {
+		return fmt.Errorf("unknown config type %q, expected docker or nodocker", configType)
+	}
+
+	if output != "" && filepath.Clean(output) == filepath.Clean(cfg.OtelConfigFile) {
+		return fmt.Errorf("refusing to overwrite the otel config file of the agent %s", cfg.OtelConfigFile)
+	}
+
+	hostAgent, err := newHostAgent(cfg, opts...)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if configType == "" {
+		data, err = hostAgent.FetchOtelConfig()
+	} else {
+		data, err = hostAgent.RenderOtelConfig(configType)
+	}
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(output, data, 0644)
+}
+
+func validateConfig(file string, componentSet agent.ComponentSet) error {
+	if file == "" {
+		return fmt.Errorf("otel config file is required")
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	factories, err := agent.GetFactoriesForComponentSet(componentSet, detectInfraPlatform())
+	if err != nil {
+		return err
+	}
+
+	return printConfigProblems(file, agent.ValidateOtelConfig(data, factories))
+}
+
+func lintConfig(file string) error {
+	if file == "" {
+		return fmt.Errorf("otel config file is required")
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	return printConfigProblems(file, agent.LintOtelConfig(data))
+}
+
+// printConfigProblems prints problems and returns an error making the
+// command exit with a non-zero status if there are any.
+func printConfigProblems(file string, problems []agent.ConfigProblem) error {
+	if len(problems) == 0 {
+		fmt.Printf("%s: no problems found\n", file)
+		return nil
+	}
+
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", file, problem)
+	}
+	return cli.Exit(fmt.Sprintf("%d problem(s) found in %s", len(problems), file), 1)
+}
+
+func rollbackConfig(history *agent.ConfigHistory, id string, otelConfigFile string) error {
+	revision, err := history.Restore(id, otelConfigFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored config %s to %s\n", revision.ID, otelConfigFile)
+	fmt.Println("Restart the agent to apply it. If fetch-account-otel-config is enabled, " +
+		"the next config change from the Middleware backend will replace it.")
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -13,9 +14,13 @@ import (
 	"strings"
 	"sync"
 	"text/tabwriter"
+	"time"
 
 	"github.com/middleware-labs/mw-injector/pkg/otelinject"
 	"github.com/middleware-labs/mw-agent/pkg/agent"
+	"github.com/middleware-labs/mw-agent/pkg/redact"
+	"github.com/middleware-labs/mw-agent/pkg/selftelemetry"
+	"github.com/middleware-labs/mw-agent/pkg/transport"
 	"github.com/middleware-labs/synthetics-agent/pkg/worker"
 	"gopkg.in/natefinch/lumberjack.v2"
 
@@ -42,9 +47,12 @@ func zapToSlog(z *zap.Logger) *slog.Logger {
 var agentVersion = "0.0.1"
 
 type program struct {
-	logger    *zap.Logger
-	hostAgent *agent.HostAgent
-	programWG *sync.WaitGroup
+	logger        *zap.Logger
+	hostAgent     *agent.HostAgent
+	selfTelemetry *selftelemetry.Telemetry
+	programWG     *sync.WaitGroup
+	// pollersWG tracks the goroutines that stop when stopCh is closed
+	pollersWG *sync.WaitGroup
 	// stop the telemetry collection if errCh receives an error
 	// resume when errCh receives nil
 	errCh  chan error
@@ -61,35 +69,71 @@ func (p *program) Start(s service.Service) error {
 
 	p.programWG.Add(1)
 	go p.run()
-	p.programWG.Add(1)
+	p.pollersWG.Add(1)
 	go func() {
 		p.hostAgent.ReportServices(p.errCh, p.stopCh)
-		p.programWG.Done()
+		p.pollersWG.Done()
 	}()
 
 	// Start any goroutines that can control collection
-	if p.hostAgent.FetchAccountOtelConfig {
+	if p.hostAgent.OfflineMode {
+		// Build the otel config from local fragments only
+		p.pollersWG.Add(1)
+		go func() {
+			p.hostAgent.ListenForConfDirChanges(p.errCh, p.stopCh)
+			p.pollersWG.Done()
+		}()
+	} else if p.hostAgent.FetchAccountOtelConfig {
 		// Listen to the config changes provided by Middleware API
-		p.programWG.Add(1)
+		p.pollersWG.Add(1)
 		go func() {
 			p.hostAgent.ListenForConfigChanges(p.errCh, p.stopCh)
-			p.programWG.Done()
+			p.pollersWG.Done()
 		}()
 	} else {
 		p.errCh <- nil
 	}
 
+	if p.hostAgent.SelfMetricsPort != 0 {
+		p.pollersWG.Add(1)
+		go func() {
+			address := net.JoinHostPort("localhost", strconv.Itoa(int(p.hostAgent.SelfMetricsPort)))
+			p.selfTelemetry.Serve(address, p.stopCh)
+			p.pollersWG.Done()
+		}()
+	}
+
+	if p.hostAgent.StatusAddress != "" {
+		p.pollersWG.Add(1)
+		go func() {
+			p.hostAgent.ServeStatusAPI(p.errCh, p.stopCh)
+			p.pollersWG.Done()
+		}()
+	}
+
 	return nil
 }
 
 func (p *program) Stop(s service.Service) error {
-	// Stop should not block. Return with a few seconds.
+	// Stop returns within the shutdown timeout plus a few seconds.
 	p.logger.Info("stopping service", zap.Stringer("name", s))
 
-	// stop collection
+	// stop the pollers first. The run loop keeps reading errCh until
+	// they have returned so that none of them blocks on a send.
 	close(p.stopCh)
+	p.pollersWG.Wait()
 	close(p.errCh)
 	p.programWG.Wait()
+
+	// stop accepting new data and drain the exporter queues
+	p.hostAgent.Shutdown()
+
+	// push the self metrics recorded since the last export
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.selfTelemetry.Shutdown(ctx); err != nil {
+		p.logger.Warn("failed to shut down self telemetry", zap.Error(err))
+	}
 	return nil
 }
 
@@ -97,6 +141,8 @@ func (p *program) run() {
 	defer p.programWG.Done()
 
 	for err := range p.errCh {
+		p.hostAgent.RecordError(err)
+
 		// if invalid config is received from the backend, then keep collector
 		// in its current state. If it is stopped, keep it stopped until we receive
 		// a valid config. If it is already running, don't restart it.
@@ -111,13 +157,38 @@ func (p *program) run() {
 			continue
 		}
 
-		if errors.Is(err, agent.ErrConfigFetchFailure) {
-			p.logger.Error("failed to fetch or build otel config; keeping collector in its current state",
-				zap.Error(err))
+		// the Middleware backend could not be reached. The collector keeps
+		// sending telemetry with the last applied config unless the policy
+		// says otherwise.
+		if errors.Is(err, agent.ErrControlPlane) {
+			if p.hostAgent.StartsWithLastConfig(err) {
+				p.logger.Error("control plane error; starting collector with the last applied config",
+					zap.Error(err))
+				p.startCollector()
+				continue
+			}
+			if p.hostAgent.ControlPlaneErrorPolicy() == agent.ControlPlaneErrorKeepRunning {
+				p.logger.Error("control plane error; keeping collector in its current state",
+					zap.Error(err))
+				continue
+			}
+			p.logger.Error("control plane error; stopping collector", zap.Error(err))
+		}
+
+		// restart requested through the status API
+		if errors.Is(err, agent.ErrRestartCollector) {
+			p.hostAgent.StopCollector(err)
+			p.logger.Info("restarting collector", zap.Error(err))
+			p.startCollector()
 			continue
 		}
 
 		if err != nil {
+			// apply a config change without stopping the collector if possible
+			if errors.Is(err, agent.ErrRestartAgent) && p.reloadCollector() {
+				continue
+			}
+
 			// stop collection only if it's running
 			p.hostAgent.StopCollector(err)
 
@@ -129,10 +200,64 @@ func (p *program) run() {
 			p.logger.Info("restarting collector", zap.Error(err))
 		}
 		// start collection only if it's not running
-		if err := p.hostAgent.StartCollector(); err != nil {
-			p.logger.Error("failed to start collector",
-				zap.Error(err))
+		p.startCollector()
+	}
+}
+
+// startCollector starts the collector and records the applied config as
+// known good. If the collector fails to start with a newly applied config,
+// the last known good config is restored and the collector is started again.
+func (p *program) startCollector() {
+	err := p.hostAgent.StartCollector()
+	if err == nil {
+		p.hostAgent.MarkConfigGood()
+		return
+	}
+
+	p.logger.Error("failed to start collector", zap.Error(err))
+	p.rollbackConfig(err)
+}
+
+// reloadCollector reloads the config of the running collector in place.
+// It returns false if there is no running collector to reload.
+func (p *program) reloadCollector() bool {
+	err := p.hostAgent.ReloadCollector()
+	if errors.Is(err, agent.ErrCollectorNotRunning) {
+		return false
+	}
+
+	if err != nil {
+		p.logger.Error("failed to reload collector config", zap.Error(err))
+		p.rollbackConfig(err)
+		return true
+	}
+
+	p.logger.Info("reloaded collector config in place")
+	p.hostAgent.MarkConfigGood()
+	return true
+}
+
+// rollbackConfig restores the last known good config and starts the
+// collector again if the collector failed to start with a new config.
+func (p *program) rollbackConfig(err error) {
+	if !errors.Is(err, agent.ErrCollectorStartFailure) {
+		return
+	}
+
+	revision, rollbackErr := p.hostAgent.RollbackConfig(err)
+	if rollbackErr != nil {
+		if !errors.Is(rollbackErr, agent.ErrNoPendingConfig) {
+			p.logger.Error("failed to roll back to last known good config",
+				zap.Error(rollbackErr))
 		}
+		return
+	}
+
+	p.logger.Info("restarting collector with last known good config",
+		zap.String("revision", revision.ID))
+	if err := p.hostAgent.StartCollector(); err != nil {
+		p.logger.Error("failed to start collector with last known good config",
+			zap.Error(err))
 	}
 }
 
@@ -144,6 +269,12 @@ func getFlags(execPath string, cfg *agent.HostConfig) []cli.Flag {
 			Usage:       "Middleware API key for your account.",
 			Destination: &cfg.APIKey,
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "api-key-file",
+			EnvVars:     []string{"MW_API_KEY_FILE"},
+			Usage:       "File holding the Middleware API key, instead of api-key.",
+			Destination: &cfg.APIKeyFile,
+		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:        "target",
 			EnvVars:     []string{"MW_TARGET"},
@@ -308,6 +439,15 @@ func getFlags(execPath string, cfg *agent.HostConfig) []cli.Flag {
 			Value:       8888,
 		}),
 
+		altsrc.NewUintFlag(&cli.UintFlag{
+			Name:        "agent-self-metrics-port",
+			Usage:       "Port where mw-agent will expose the Prometheus metrics of its own control loop. 0 disables it.",
+			EnvVars:     []string{"MW_AGENT_SELF_METRICS_PORT"},
+			Destination: &cfg.SelfMetricsPort,
+			DefaultText: "8889",
+			Value:       8889,
+		}),
+
 		altsrc.NewBoolFlag(&cli.BoolFlag{
 			Name:        "enable-datadog-receiver",
 			Usage:       "Enable datadog receiver in agent",
@@ -335,6 +475,169 @@ func getFlags(execPath string, cfg *agent.HostConfig) []cli.Flag {
 			Value:       true,
 		}),
 
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:        "agent-features.integration-autodiscovery",
+			Usage:       "Enable or disable the scraping of the integrations discovered on the host and in its containers.",
+			EnvVars:     []string{"MW_AGENT_FEATURES_INTEGRATION_AUTODISCOVERY"},
+			Destination: &cfg.AgentFeatures.IntegrationAutodiscovery,
+			DefaultText: "false",
+			Value:       false,
+		}),
+
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "state-dir",
+			Usage:       "Directory where the agent keeps its state such as the history of applied otel configs.",
+			EnvVars:     []string{"MW_STATE_DIR"},
+			Destination: &cfg.StateDir,
+			Value:       defaultStateDir(execPath),
+			DefaultText: defaultStateDir(execPath),
+		}),
+
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:        "config-history-size",
+			Usage:       "Number of applied otel configs to keep in the state directory for rollback.",
+			EnvVars:     []string{"MW_CONFIG_HISTORY_SIZE"},
+			Destination: &cfg.ConfigHistorySize,
+			DefaultText: "10",
+			Value:       10,
+		}),
+
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name: "on-control-plane-error",
+			Usage: "What to do with the collector when the Middleware backend can not be reached. " +
+				"keep-running keeps collecting telemetry with the last applied config, stop stops the collector.",
+			EnvVars:     []string{"MW_ON_CONTROL_PLANE_ERROR"},
+			Destination: &cfg.OnControlPlaneError,
+			DefaultText: string(agent.ControlPlaneErrorKeepRunning),
+			Value:       string(agent.ControlPlaneErrorKeepRunning),
+		}),
+
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name: "offline-mode",
+			Usage: "Build the otel config from the fragments in conf-dir instead of fetching it " +
+				"from the Middleware backend. Takes precedence over fetch-account-otel-config.",
+			EnvVars:     []string{"MW_OFFLINE_MODE"},
+			Destination: &cfg.OfflineMode,
+			DefaultText: "false",
+			Value:       false,
+		}),
+
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "conf-dir",
+			Usage:       "Directory with the otel config fragments (*.yaml) merged in file name order in offline mode.",
+			EnvVars:     []string{"MW_CONF_DIR"},
+			Destination: &cfg.ConfDir,
+			Value:       defaultConfDir(execPath),
+			DefaultText: defaultConfDir(execPath),
+		}),
+
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "local-overlay",
+			Usage:       "YAML file deep-merged into the otel config received from the Middleware backend.",
+			EnvVars:     []string{"MW_LOCAL_OVERLAY"},
+			Destination: &cfg.LocalOverlay,
+		}),
+
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name: "status-address",
+			Usage: "Address of the local status API, a unix socket (unix:/path) or a loopback address " +
+				"(e.g. 127.0.0.1:8008). Set it to an empty string to disable the status API.",
+			EnvVars:     []string{"MW_STATUS_ADDRESS"},
+			Destination: &cfg.StatusAddress,
+			Value:       defaultStatusAddress(execPath),
+			DefaultText: defaultStatusAddress(execPath),
+		}),
+
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name: "shutdown-timeout",
+			Usage: "Maximum time the collector may take to drain its exporter queues when the agent " +
+				"stops or restarts the collector (e.g. 30s).",
+			EnvVars:     []string{"MW_SHUTDOWN_TIMEOUT"},
+			Destination: &cfg.ShutdownTimeout,
+			Value:       "30s",
+			DefaultText: "30s",
+		}),
+
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name: "buffer-dir",
+			Usage: "Directory where the exporters keep their sending queues so that telemetry survives network " +
+				"outages and agent restarts. Only used if buffer-max-size is set.",
+			EnvVars:     []string{"MW_BUFFER_DIR"},
+			Destination: &cfg.BufferDir,
+		}),
+
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:        "buffer-max-size",
+			Usage:       "Maximum size in MiB of the sending queues kept in buffer-dir, shared by all the exporters.",
+			EnvVars:     []string{"MW_BUFFER_MAX_SIZE"},
+			Destination: &cfg.BufferMaxSize,
+		}),
+
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "tls.ca-file",
+			Usage:       "PEM bundle of certificate authorities trusted in addition to the system ones, for the calls to Middleware and the otlp exporters.",
+			EnvVars:     []string{"MW_TLS_CA_FILE"},
+			Destination: &cfg.TLS.CAFile,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "tls.cert-file",
+			Usage:       "Client certificate for mutual TLS with Middleware. Requires tls.key-file.",
+			EnvVars:     []string{"MW_TLS_CERT_FILE"},
+			Destination: &cfg.TLS.CertFile,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "tls.key-file",
+			Usage:       "Private key of the client certificate for mutual TLS with Middleware.",
+			EnvVars:     []string{"MW_TLS_KEY_FILE"},
+			Destination: &cfg.TLS.KeyFile,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "tls.min-version",
+			Usage:       "Minimum TLS version for the connections to Middleware: 1.0, 1.1, 1.2 or 1.3.",
+			EnvVars:     []string{"MW_TLS_MIN_VERSION"},
+			Destination: &cfg.TLS.MinVersion,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "proxy.url",
+			Usage:       "HTTP(S) proxy for the calls to Middleware and the exporters, e.g. http://proxy.internal:3128. The otlp exporters are switched to otlphttp when set.",
+			EnvVars:     []string{"MW_PROXY_URL"},
+			Destination: &cfg.Proxy.URL,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "proxy.no-proxy",
+			Usage:       "Comma separated hosts, domains and CIDRs reached without the proxy, in the NO_PROXY format.",
+			EnvVars:     []string{"MW_PROXY_NO_PROXY"},
+			Destination: &cfg.Proxy.NoProxy,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "proxy.username",
+			Usage:       "Username to authenticate with the proxy. Requires proxy.password.",
+			EnvVars:     []string{"MW_PROXY_USERNAME"},
+			Destination: &cfg.Proxy.Username,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "proxy.password",
+			Usage:       "Password to authenticate with the proxy.",
+			EnvVars:     []string{"MW_PROXY_PASSWORD"},
+			Destination: &cfg.Proxy.Password,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "secrets-dir",
+			Usage:       "Directory of the secrets referred to as ${secret:NAME} in the configs, one file per secret.",
+			EnvVars:     []string{"MW_SECRETS_DIR"},
+			Destination: &cfg.SecretsDir,
+			Value:       defaultSecretsDir(execPath),
+			DefaultText: defaultSecretsDir(execPath),
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "secret-key-file",
+			Usage:       "Key file decrypting the mwenc: values of the configs. It must only be readable by the agent.",
+			EnvVars:     []string{"MW_SECRET_KEY_FILE"},
+			Destination: &cfg.SecretKeyFile,
+			Value:       defaultSecretKeyFile(execPath),
+			DefaultText: defaultSecretKeyFile(execPath),
+		}),
+
 		&cli.StringFlag{
 			Name:    "config-file",
 			EnvVars: []string{"MW_CONFIG_FILE"},
@@ -385,6 +688,61 @@ func getFlags(execPath string, cfg *agent.HostConfig) []cli.Flag {
 	}
 }
 
+func defaultStateDir(execPath string) string {
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		return filepath.Join("/var", "lib", "mw-agent")
+	case "windows":
+		return filepath.Join(filepath.Dir(execPath), "state")
+	}
+
+	return ""
+}
+
+func defaultSecretsDir(execPath string) string {
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		return filepath.Join("/etc", "mw-agent", "secrets")
+	case "windows":
+		return filepath.Join(filepath.Dir(execPath), "secrets")
+	}
+
+	return ""
+}
+
+func defaultSecretKeyFile(execPath string) string {
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		return filepath.Join("/etc", "mw-agent", "secret.key")
+	case "windows":
+		return filepath.Join(filepath.Dir(execPath), "secret.key")
+	}
+
+	return ""
+}
+
+func defaultStatusAddress(execPath string) string {
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		return agent.StatusAPIUnixPrefix + filepath.Join(defaultStateDir(execPath), "mw-agent.sock")
+	case "windows":
+		return "127.0.0.1:8008"
+	}
+
+	return ""
+}
+
+func defaultConfDir(execPath string) string {
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		return filepath.Join("/etc", "mw-agent", "conf.d")
+	case "windows":
+		return filepath.Join(filepath.Dir(execPath), "conf.d")
+	}
+
+	return ""
+}
+
 func detectInfraPlatform() agent.InfraPlatform {
 	awsEnv := os.Getenv("AWS_EXECUTION_ENV")
 	if awsEnv == "AWS_ECS_EC2" {
@@ -752,10 +1110,12 @@ func main() {
 
 					}
 
+					// mask the api key and the secrets of the configs in what
+					// the libraries of the agent log
 					zapCore = zapcore.NewCore(
 						zapcore.NewJSONEncoder(zapEncoderCfg),
-						w,
-						loggingLevel.Level(),
+						redact.WriteSyncer(w),
+						loggingLevel,
 					)
 
 					logger := zap.New(zapCore, zap.AddCaller())
@@ -764,8 +1124,23 @@ func main() {
 						_ = logger.Sync()
 					}()
 
+					if err := cfg.ResolveSecrets(logger); err != nil {
+						logger.Error("failed to resolve secrets", zap.Error(err))
+						return err
+					}
+
 					if cfg.SelfProfiling {
 						profiler := agent.NewProfiler(logger, cfg.ProfilngServerURL)
+						if cfg.Proxy.IsSet() {
+							profiler.HTTPClient, err = transport.NewHTTPClient(transport.Config{
+								TLS:   cfg.TLS,
+								Proxy: cfg.Proxy,
+							})
+							if err != nil {
+								logger.Error("failed to create profiler http client", zap.Error(err))
+								return err
+							}
+						}
 						// start profiling
 						go profiler.StartProfiling("mw-host-agent", cfg.Target, cfg.HostTags)
 					}
@@ -830,6 +1205,8 @@ func main() {
 					os.Setenv("MW_AGENT_HTTP_PORT", cfg.HTTPPort)
 					os.Setenv("MW_AGENT_FLUENT_PORT", cfg.FluentPort)
 					os.Setenv("MW_AGENT_INTERNAL_METRICS_PORT", strconv.Itoa(int(cfg.InternalMetricsPort)))
+					// referenced by the proxy_url of the exporters
+					os.Setenv(transport.ProxyUserInfoEnv, cfg.Proxy.UserInfo())
 
 					if cfg.EnableDataDogReceiver {
 						os.Setenv("MW_ENABLE_DATADOG_RECEIVER", "true")
@@ -845,12 +1222,40 @@ func main() {
 						logger.Info("host agent has invalid tags", zap.Error(err))
 						return err
 					}
+					selfTelemetryCfg := selftelemetry.Config{
+						ServiceName: "mw-host-agent",
+						Version:     agentVersion,
+						HostID:      hostname,
+						APIKey:      cfg.APIKey,
+					}
+					if !cfg.OfflineMode {
+						selfTelemetryCfg.Target = cfg.Target
+					}
+					if cfg.TLS.IsSet() {
+						selfTelemetryCfg.TLS, err = cfg.TLS.ClientConfig()
+						if err != nil {
+							return err
+						}
+					}
+					if cfg.Proxy.IsSet() {
+						selfTelemetryCfg.Proxy, err = cfg.Proxy.ProxyFunc()
+						if err != nil {
+							return err
+						}
+					}
+					selfTelemetry, err := selftelemetry.New(c.Context, selfTelemetryCfg, logger)
+					if err != nil {
+						return err
+					}
+
 					// create hostAgent
 
 					hostAgent, err := agent.NewHostAgent(
 						cfg, zapCore,
 						agent.WithHostAgentVersion(agentVersion),
 						agent.WithHostAgentInfraPlatform(infraPlatform),
+						agent.WithHostAgentLogLevel(loggingLevel),
+						agent.WithHostAgentMeter(selfTelemetry.Meter("mw-host-agent")),
 					)
 
 					if err != nil {
@@ -870,6 +1275,13 @@ func main() {
 							UnsubscribeEndpoint: cfg.SyntheticMonitoring.UnsubscribeEndpoint,
 							CaptureEndpoint:     cfg.Target + "/v1/metrics",
 						}
+						if cfg.Proxy.IsSet() {
+							proxyURL, err := cfg.Proxy.ProxyURL()
+							if err != nil {
+								return err
+							}
+							config.ProxyURL = proxyURL.String()
+						}
 
 						logger.Info("starting synthetic worker: ", zap.String("hostname", hostname))
 						syntheticWorker, err := worker.New(&config)
@@ -898,6 +1310,7 @@ func main() {
 					}
 
 					programWG := &sync.WaitGroup{}
+					pollersWG := &sync.WaitGroup{}
 					// errCh is used to control whether the agent should collect telemetry data or not.
 					// if any of the module returns error, the agent should not collect telemetry data.
 					// For example, if the agent is not able to connect to the target,
@@ -908,12 +1321,14 @@ func main() {
 					stopCh := make(chan struct{})
 
 					prg := &program{
-						logger:    logger,
-						hostAgent: hostAgent,
-						programWG: programWG,
-						errCh:     errCh,
-						stopCh:    stopCh,
-						args:      os.Args,
+						logger:        logger,
+						hostAgent:     hostAgent,
+						selfTelemetry: selfTelemetry,
+						programWG:     programWG,
+						pollersWG:     pollersWG,
+						errCh:         errCh,
+						stopCh:        stopCh,
+						args:          os.Args,
 					}
 
 					s, err := service.New(prg, svcConfig)
@@ -929,6 +1344,9 @@ func main() {
 					return nil
 				},
 			},
+			configCommand(flags, &cfg),
+			statusCommand(flags, &cfg),
+			secretCommand(flags, &cfg),
 			{
 				Name:  "version",
 				Usage: "Returns the current agent version",
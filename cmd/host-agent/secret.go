@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/middleware-labs/mw-agent/pkg/agent"
+	"github.com/middleware-labs/mw-agent/pkg/secret"
+	cli "github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+// secretCommand returns the "secret" command which manages the key file
+// and the encrypted values of the configs of the host agent.
+func secretCommand(flags []cli.Flag, cfg *agent.HostConfig) *cli.Command {
+	before := altsrc.InitInputSourceWithContext(flags, altsrc.NewYamlSourceFromFlagFunc("config-file"))
+
+	return &cli.Command{
+		Name:  "secret",
+		Usage: "Manage the secrets of the agent configs",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "generate-key",
+				Usage:  "Create the key file decrypting the mwenc: values of the configs",
+				Flags:  flags,
+				Before: before,
+				Action: func(c *cli.Context) error {
+					return generateSecretKey(cfg.SecretKeyFile)
+				},
+			},
+			{
+				Name: "encrypt",
+				Usage: "Encrypt a secret read from stdin with the key file, for use as " +
+					"${secret:mwenc:...} in the configs",
+				Flags:  flags,
+				Before: before,
+				Action: func(c *cli.Context) error {
+					return encryptSecret(cfg.SecretKeyFile)
+				},
+			},
+		},
+	}
+}
+
+func generateSecretKey(keyFile string) error {
+	key, err := secret.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	if err := secret.WriteKeyFile(keyFile, key); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created secret key file %s. Make sure it is only readable by the agent.\n", keyFile)
+	return nil
+}
+
+// encryptSecret reads the secret from stdin rather than from the
+// arguments so that it does not end up in the shell history.
+func encryptSecret(keyFile string) error {
+	key, err := secret.ReadKeyFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && plaintext == "" {
+		return fmt.Errorf("failed to read the secret from stdin: %w", err)
+	}
+
+	value, err := secret.Encrypt(strings.TrimRight(plaintext, "\r\n"), key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(value)
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/middleware-labs/mw-agent/pkg/agent"
+	cli "github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+// statusCommand returns the "status" command which reads the status of the
+// running host agent from its status API and sends it control actions.
+func statusCommand(flags []cli.Flag, cfg *agent.HostConfig) *cli.Command {
+	before := altsrc.InitInputSourceWithContext(flags, altsrc.NewYamlSourceFromFlagFunc("config-file"))
+
+	return &cli.Command{
+		Name:   "status",
+		Usage:  "Show the status of the running agent",
+		Flags:  flags,
+		Before: before,
+		Action: func(c *cli.Context) error {
+			client, err := newStatusClient(cfg)
+			if err != nil {
+				return err
+			}
+			return printAgentStatus(client)
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:   "refresh",
+				Usage:  "Check the Middleware backend for config changes now",
+				Flags:  flags,
+				Before: before,
+				Action: func(c *cli.Context) error {
+					client, err := newStatusClient(cfg)
+					if err != nil {
+						return err
+					}
+					if err := client.RefreshConfig(); err != nil {
+						return err
+					}
+					fmt.Println("Config refresh requested.")
+					return nil
+				},
+			},
+			{
+				Name:   "restart",
+				Usage:  "Restart the collector of the running agent",
+				Flags:  flags,
+				Before: before,
+				Action: func(c *cli.Context) error {
+					client, err := newStatusClient(cfg)
+					if err != nil {
+						return err
+					}
+					if err := client.RestartCollector(); err != nil {
+						return err
+					}
+					fmt.Println("Collector restart requested.")
+					return nil
+				},
+			},
+			{
+				Name:      "log-level",
+				Usage:     "Change the log level of the running agent",
+				ArgsUsage: "<debug|info|warn|error>",
+				Flags:     flags,
+				Before:    before,
+				Action: func(c *cli.Context) error {
+					level := c.Args().First()
+					if level == "" {
+						return fmt.Errorf("log level is required")
+					}
+
+					client, err := newStatusClient(cfg)
+					if err != nil {
+						return err
+					}
+					if err := client.SetLogLevel(level); err != nil {
+						return err
+					}
+					fmt.Printf("Log level changed to %s.\n", level)
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func newStatusClient(cfg *agent.HostConfig) (*agent.StatusClient, error) {
+	if cfg.StatusAddress == "" {
+		return nil, fmt.Errorf("status api is disabled, see the status-address flag")
+	}
+	return agent.NewStatusClient(cfg.StatusAddress,
+		filepath.Join(cfg.StateDir, agent.StatusAPITokenFile))
+}
+
+func printAgentStatus(client *agent.StatusClient) error {
+	status, err := client.Status()
+	if err != nil {
+		return fmt.Errorf("failed to get agent status, is the agent running? %w", err)
+	}
+
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Local().Format(time.RFC3339)
+	}
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	collector := string(status.Collector)
+	if status.Collector == agent.CollectorRunning {
+		collector += fmt.Sprintf(" (up %s, since %s)", status.Uptime, formatTime(status.StartedAt))
+	}
+
+	var features []string
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"metric-collection", status.AgentFeatures.MetricCollection},
+		{"log-collection", status.AgentFeatures.LogCollection},
+		{"synthetic-monitoring", status.AgentFeatures.SyntheticMonitoring},
+		{"service-reporting", status.AgentFeatures.ServiceReporting},
+		{"integration-autodiscovery", status.AgentFeatures.IntegrationAutodiscovery},
+	} {
+		if feature.enabled {
+			features = append(features, feature.name)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Version:\t%s\n", status.Version)
+	fmt.Fprintf(w, "Infra platform:\t%s\n", status.InfraPlatform)
+	fmt.Fprintf(w, "Collector:\t%s\n", collector)
+	fmt.Fprintf(w, "Last config fetch:\t%s\n", formatTime(status.LastConfigFetch))
+	fmt.Fprintf(w, "Last config fetch result:\t%s\n", orDash(status.LastConfigFetchResult))
+	fmt.Fprintf(w, "Config hash:\t%s\n", orDash(status.ConfigHash))
+	fmt.Fprintf(w, "Last error:\t%s\n", orDash(status.LastError))
+	fmt.Fprintf(w, "Last error at:\t%s\n", formatTime(status.LastErrorAt))
+	fmt.Fprintf(w, "Features:\t%s\n", orDash(strings.Join(features, ", ")))
+	for _, integrationError := range status.IntegrationErrors {
+		fmt.Fprintf(w, "Integration not applied:\t%s (%s)\n", integrationError.Type, integrationError.Reason)
+	}
+	return w.Flush()
+}
@@ -6,17 +6,15 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"time"
 
 	"github.com/middleware-labs/mw-agent/pkg/agent"
+	"github.com/middleware-labs/mw-agent/pkg/redact"
+	"github.com/middleware-labs/mw-agent/pkg/transport"
 	"github.com/prometheus/common/version"
 	"github.com/urfave/cli/v2"
 	"github.com/urfave/cli/v2/altsrc"
 	"go.opentelemetry.io/collector/component"
-	"go.opentelemetry.io/collector/confmap"
-
-	"go.opentelemetry.io/collector/confmap/provider/envprovider"
-	"go.opentelemetry.io/collector/confmap/provider/fileprovider"
-	"go.opentelemetry.io/collector/confmap/provider/yamlprovider"
 	"go.opentelemetry.io/collector/otelcol"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -24,6 +22,17 @@ import (
 
 var agentVersion = "0.0.1"
 
+// defaultSecretsDir and defaultSecretKeyFile are where the Kubernetes
+// secrets holding the secrets of the configs and their key are mounted.
+var (
+	defaultSecretsDir    = "/etc/mw-agent/secrets"
+	defaultSecretKeyFile = "/etc/mw-agent/secret-key/secret.key"
+)
+
+// configFileWatchInterval is how often the kube agent checks the mounted
+// otel config file for changes.
+var configFileWatchInterval = 30 * time.Second
+
 func getFlags(cfg *agent.KubeConfig) []cli.Flag {
 	return []cli.Flag{
 		altsrc.NewStringFlag(&cli.StringFlag{
@@ -32,6 +41,12 @@ func getFlags(cfg *agent.KubeConfig) []cli.Flag {
 			Usage:       "Middleware API key for your account.",
 			Destination: &cfg.APIKey,
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "api-key-file",
+			EnvVars:     []string{"MW_API_KEY_FILE"},
+			Usage:       "File holding the Middleware API key, instead of api-key.",
+			Destination: &cfg.APIKeyFile,
+		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:        "target",
 			EnvVars:     []string{"MW_TARGET", "TARGET"},
@@ -190,6 +205,70 @@ func getFlags(cfg *agent.KubeConfig) []cli.Flag {
 			Value:       "mw-kube-agent",
 			DefaultText: "mw-kube-agent",
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "tls.ca-file",
+			Usage:       "PEM bundle of certificate authorities trusted in addition to the system ones, for the calls to Middleware and the otlp exporters.",
+			EnvVars:     []string{"MW_TLS_CA_FILE"},
+			Destination: &cfg.TLS.CAFile,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "tls.cert-file",
+			Usage:       "Client certificate for mutual TLS with Middleware. Requires tls.key-file.",
+			EnvVars:     []string{"MW_TLS_CERT_FILE"},
+			Destination: &cfg.TLS.CertFile,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "tls.key-file",
+			Usage:       "Private key of the client certificate for mutual TLS with Middleware.",
+			EnvVars:     []string{"MW_TLS_KEY_FILE"},
+			Destination: &cfg.TLS.KeyFile,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "tls.min-version",
+			Usage:       "Minimum TLS version for the connections to Middleware: 1.0, 1.1, 1.2 or 1.3.",
+			EnvVars:     []string{"MW_TLS_MIN_VERSION"},
+			Destination: &cfg.TLS.MinVersion,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "proxy.url",
+			Usage:       "HTTP(S) proxy for the calls to Middleware and the exporters, e.g. http://proxy.internal:3128. The otlp exporters are switched to otlphttp when set.",
+			EnvVars:     []string{"MW_PROXY_URL"},
+			Destination: &cfg.Proxy.URL,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "proxy.no-proxy",
+			Usage:       "Comma separated hosts, domains and CIDRs reached without the proxy, in the NO_PROXY format.",
+			EnvVars:     []string{"MW_PROXY_NO_PROXY"},
+			Destination: &cfg.Proxy.NoProxy,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "proxy.username",
+			Usage:       "Username to authenticate with the proxy. Requires proxy.password.",
+			EnvVars:     []string{"MW_PROXY_USERNAME"},
+			Destination: &cfg.Proxy.Username,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "proxy.password",
+			Usage:       "Password to authenticate with the proxy.",
+			EnvVars:     []string{"MW_PROXY_PASSWORD"},
+			Destination: &cfg.Proxy.Password,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "secrets-dir",
+			Usage:       "Directory of the secrets referred to as ${secret:NAME} in the configs, one file per secret.",
+			EnvVars:     []string{"MW_SECRETS_DIR"},
+			Destination: &cfg.SecretsDir,
+			Value:       defaultSecretsDir,
+			DefaultText: defaultSecretsDir,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "secret-key-file",
+			Usage:       "Key file decrypting the mwenc: values of the configs. It must only be readable by the agent.",
+			EnvVars:     []string{"MW_SECRET_KEY_FILE"},
+			Destination: &cfg.SecretKeyFile,
+			Value:       defaultSecretKeyFile,
+			DefaultText: defaultSecretKeyFile,
+		}),
 	}
 }
 
@@ -209,9 +288,14 @@ func main() {
 		CallerKey:    "caller",
 		EncodeCaller: zapcore.ShortCallerEncoder,
 	}
-	zapCfg := zap.NewProductionConfig()
-	zapCfg.EncoderConfig = zapEncoderCfg
-	logger, _ := zapCfg.Build()
+	// mask the api key and the secrets of the configs in what the
+	// libraries of the agent log
+	zapCore := zapcore.NewCore(
+		zapcore.NewJSONEncoder(zapEncoderCfg),
+		redact.WriteSyncer(zapcore.Lock(os.Stderr)),
+		zap.InfoLevel,
+	)
+	logger := zap.New(zapCore, zap.AddCaller())
 	defer func() {
 		_ = logger.Sync()
 	}()
@@ -225,6 +309,11 @@ func main() {
 				Usage: "Start Middleware Kubernetes agent",
 				Flags: flags,
 				Action: func(c *cli.Context) error {
+					if err := cfg.ResolveSecrets(logger); err != nil {
+						logger.Error("failed to resolve secrets", zap.Error(err))
+						return err
+					}
+
 					if cfg.SelfProfiling {
 						profiler := agent.NewProfiler(logger, cfg.ProfilngServerURL)
 						// start profiling
@@ -251,6 +340,8 @@ func main() {
 					os.Setenv("MW_AGENT_HTTP_PORT", cfg.HTTPPort)
 					os.Setenv("MW_AGENT_FLUENT_PORT", cfg.FluentPort)
 					os.Setenv("MW_AGENT_INTERNAL_METRICS_PORT", strconv.Itoa(int(cfg.InternalMetricsPort)))
+					// referenced by the proxy_url of the exporters
+					os.Setenv(transport.ProxyUserInfoEnv, cfg.Proxy.UserInfo())
 
 					// Set MW_DOCKER_ENDPOINT env variable to be used by otel collector
 					os.Setenv("MW_DOCKER_ENDPOINT", cfg.DockerEndpoint)
@@ -258,24 +349,21 @@ func main() {
 					logger.Info("starting host agent with config",
 						zap.Stringer("config", cfg))
 
-					configProviderSetting := otelcol.ConfigProviderSettings{
-						ResolverSettings: confmap.ResolverSettings{
-							ProviderFactories: []confmap.ProviderFactory{
-								fileprovider.NewFactory(),
-								yamlprovider.NewFactory(),
-								envprovider.NewFactory(),
-							},
-							ConverterFactories: []confmap.ConverterFactory{
-								// expandconverter.NewFactory(),
-								//overwritepropertiesconverter.New(getSetFlag()),
-							},
-							URIs: []string{cfg.OtelConfigFile},
-						},
-					}
+					// The otel config is mounted from a configmap. Reload the
+					// collector in place when the configmap content changes
+					// instead of waiting for a rollout restart.
+					reloadProvider := agent.NewReloadProvider()
+					go reloadProvider.WatchFile(ctx, cfg.OtelConfigFile,
+						configFileWatchInterval, logger)
+
+					configProviderSetting := agent.NewConfigProviderSettings(
+						agent.ReloadProviderScheme+":"+cfg.OtelConfigFile, reloadProvider,
+						cfg.SecretResolver().NewProviderFactory())
 
 					settings := otelcol.CollectorSettings{
 						DisableGracefulShutdown: true,
-						LoggingOptions:          []zap.Option{},
+						// mask the secrets of the configs in the logs of the collector
+						LoggingOptions: []zap.Option{zap.WrapCore(redact.Core)},
 						BuildInfo: component.BuildInfo{
 							Command:     "otelcontribcol",
 							Description: "OpenTelemetry Collector Contrib",
@@ -297,6 +385,10 @@ func main() {
 				Usage: "Watch for configuration updates and restart the agent when a change is detected",
 				Flags: flags,
 				Action: func(c *cli.Context) error {
+					if err := cfg.ResolveSecrets(logger); err != nil {
+						logger.Error("failed to resolve secrets", zap.Error(err))
+						return err
+					}
 
 					if cfg.APIURLForConfigCheck == "" {
 						var err error
@@ -320,6 +412,15 @@ func main() {
 						mwNamespace = "mw-agent-ns"
 					}
 
+					httpClient, err := transport.NewHTTPClient(transport.Config{
+						TLS:    cfg.TLS,
+						Proxy:  cfg.Proxy,
+						APIKey: cfg.APIKey,
+					})
+					if err != nil {
+						return err
+					}
+
 					kubeAgentMonitor := agent.NewKubeAgentMonitor(cfg,
 						agent.WithKubeAgentMonitorClusterName(os.Getenv("MW_KUBE_CLUSTER_NAME")),
 						agent.WithKubeAgentMonitorAgentNamespace(mwNamespace),
@@ -328,9 +429,10 @@ func main() {
 						agent.WithKubeAgentMonitorDaemonsetConfigMap("mw-daemonset-otel-config"),
 						agent.WithKubeAgentMonitorDeploymentConfigMap("mw-deployment-otel-config"),
 						agent.WithKubeAgentMonitorVersion(agentVersion),
+						agent.WithKubeAgentMonitorHTTPClient(httpClient),
 					)
 
-					err := kubeAgentMonitor.SetClientSet()
+					err = kubeAgentMonitor.SetClientSet()
 					if err != nil {
 						logger.Error("collector server run finished with error", zap.Error(err))
 						return err
@@ -361,6 +463,15 @@ func main() {
 						mwNamespace = "mw-agent-ns"
 					}
 
+					httpClient, err := transport.NewHTTPClient(transport.Config{
+						TLS:    cfg.TLS,
+						Proxy:  cfg.Proxy,
+						APIKey: cfg.APIKey,
+					})
+					if err != nil {
+						return err
+					}
+
 					kubeAgentMonitor := agent.NewKubeAgentMonitor(cfg,
 						agent.WithKubeAgentMonitorClusterName(os.Getenv("MW_KUBE_CLUSTER_NAME")),
 						agent.WithKubeAgentMonitorAgentNamespace(mwNamespace),
@@ -369,9 +480,10 @@ func main() {
 						agent.WithKubeAgentMonitorDaemonsetConfigMap("mw-daemonset-otel-config"),
 						agent.WithKubeAgentMonitorDeploymentConfigMap("mw-deployment-otel-config"),
 						agent.WithKubeAgentMonitorVersion(agentVersion),
+						agent.WithKubeAgentMonitorHTTPClient(httpClient),
 					)
 
-					err := kubeAgentMonitor.SetClientSet()
+					err = kubeAgentMonitor.SetClientSet()
 					if err != nil {
 						logger.Error("collector server run finished with error", zap.Error(err))
 						return err
@@ -2,11 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	configupdater "github.com/middleware-labs/mw-agent/pkg/configupdater"
+	"github.com/middleware-labs/mw-agent/pkg/redact"
+	"github.com/middleware-labs/mw-agent/pkg/selftelemetry"
 	cli "github.com/urfave/cli/v2"
 	"github.com/urfave/cli/v2/altsrc"
 	"k8s.io/client-go/kubernetes"
@@ -18,6 +25,13 @@ import (
 
 var agentVersion = "0.0.1"
 
+// defaultSecretsDir and defaultSecretKeyFile are where the Kubernetes
+// secrets holding the secrets of the configs and their key are mounted.
+var (
+	defaultSecretsDir    = "/etc/mw-agent/secrets"
+	defaultSecretKeyFile = "/etc/mw-agent/secret-key/secret.key"
+)
+
 func getFlags(cfg *configupdater.BaseConfig) []cli.Flag {
 	return []cli.Flag{
 		altsrc.NewStringFlag(&cli.StringFlag{
@@ -26,6 +40,12 @@ func getFlags(cfg *configupdater.BaseConfig) []cli.Flag {
 			Usage:       "Middleware API key for your account.",
 			Destination: &cfg.APIKey,
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "api-key-file",
+			EnvVars:     []string{"MW_API_KEY_FILE"},
+			Usage:       "File holding the Middleware API key, instead of api-key.",
+			Destination: &cfg.APIKeyFile,
+		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:        "target",
 			EnvVars:     []string{"MW_TARGET", "TARGET"},
@@ -100,6 +120,87 @@ func getFlags(cfg *configupdater.BaseConfig) []cli.Flag {
 			DefaultText: "false",
 			Value:       false,
 		}),
+		altsrc.NewUintFlag(&cli.UintFlag{
+			Name:        "self-metrics-port",
+			Usage:       "Port on localhost where the updater will expose the Prometheus metrics of its own control loop. 0 disables it.",
+			EnvVars:     []string{"MW_SELF_METRICS_PORT"},
+			Destination: &cfg.SelfMetricsPort,
+			DefaultText: "8889",
+			Value:       8889,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name: "daemonset-offsets-dir",
+			Usage: "Directory on the nodes where the daemonset keeps the offsets of its log receivers. " +
+				"It is mounted in the daemonset as a hostPath. Set it to an empty string to disable it.",
+			EnvVars:     []string{"MW_DAEMONSET_OFFSETS_DIR"},
+			Destination: &cfg.OffsetsDir,
+			DefaultText: "/var/lib/mw-agent/offsets",
+			Value:       "/var/lib/mw-agent/offsets",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "tls.ca-file",
+			Usage:       "PEM bundle of certificate authorities trusted in addition to the system ones for the calls to Middleware and, from the same path in the agent pods, the otlp exporters.",
+			EnvVars:     []string{"MW_TLS_CA_FILE"},
+			Destination: &cfg.TLS.CAFile,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "tls.cert-file",
+			Usage:       "Client certificate for mutual TLS with Middleware. Requires tls.key-file.",
+			EnvVars:     []string{"MW_TLS_CERT_FILE"},
+			Destination: &cfg.TLS.CertFile,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "tls.key-file",
+			Usage:       "Private key of the client certificate for mutual TLS with Middleware.",
+			EnvVars:     []string{"MW_TLS_KEY_FILE"},
+			Destination: &cfg.TLS.KeyFile,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "tls.min-version",
+			Usage:       "Minimum TLS version for the connections to Middleware: 1.0, 1.1, 1.2 or 1.3.",
+			EnvVars:     []string{"MW_TLS_MIN_VERSION"},
+			Destination: &cfg.TLS.MinVersion,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "proxy.url",
+			Usage:       "HTTP(S) proxy for the calls to Middleware and the exporters, e.g. http://proxy.internal:3128. The otlp exporters are switched to otlphttp when set.",
+			EnvVars:     []string{"MW_PROXY_URL"},
+			Destination: &cfg.Proxy.URL,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "proxy.no-proxy",
+			Usage:       "Comma separated hosts, domains and CIDRs reached without the proxy, in the NO_PROXY format.",
+			EnvVars:     []string{"MW_PROXY_NO_PROXY"},
+			Destination: &cfg.Proxy.NoProxy,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "proxy.username",
+			Usage:       "Username to authenticate with the proxy. Requires proxy.password.",
+			EnvVars:     []string{"MW_PROXY_USERNAME"},
+			Destination: &cfg.Proxy.Username,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "proxy.password",
+			Usage:       "Password to authenticate with the proxy.",
+			EnvVars:     []string{"MW_PROXY_PASSWORD"},
+			Destination: &cfg.Proxy.Password,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "secrets-dir",
+			Usage:       "Directory of the secrets referred to as ${secret:NAME} in the configs, one file per secret.",
+			EnvVars:     []string{"MW_SECRETS_DIR"},
+			Destination: &cfg.SecretsDir,
+			Value:       defaultSecretsDir,
+			DefaultText: defaultSecretsDir,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:        "secret-key-file",
+			Usage:       "Key file decrypting the mwenc: values of the configs. It must only be readable by the agent.",
+			EnvVars:     []string{"MW_SECRET_KEY_FILE"},
+			Destination: &cfg.SecretKeyFile,
+			Value:       defaultSecretKeyFile,
+			DefaultText: defaultSecretKeyFile,
+		}),
 	}
 }
 
@@ -118,9 +219,14 @@ func main() {
 		CallerKey:    "caller",
 		EncodeCaller: zapcore.ShortCallerEncoder,
 	}
-	zapCfg := zap.NewProductionConfig()
-	zapCfg.EncoderConfig = zapEncoderCfg
-	logger, _ := zapCfg.Build()
+	// mask the api key and the secrets of the configs in what the
+	// libraries of the agent log
+	zapCore := zapcore.NewCore(
+		zapcore.NewJSONEncoder(zapEncoderCfg),
+		redact.WriteSyncer(zapcore.Lock(os.Stderr)),
+		zap.InfoLevel,
+	)
+	logger := zap.New(zapCore, zap.AddCaller())
 	defer func() {
 		_ = logger.Sync()
 	}()
@@ -137,6 +243,11 @@ func main() {
 					ctx, cancel := context.WithCancel(c.Context)
 					defer cancel()
 
+					if err := cfg.ResolveSecrets(logger); err != nil {
+						logger.Error("failed to resolve secrets", zap.Error(err))
+						return err
+					}
+
 					if cfg.APIURLForConfigCheck == "" {
 						var err error
 						cfg.APIURLForConfigCheck, err = configupdater.GetAPIURLForConfigCheck(cfg.Target)
@@ -151,7 +262,7 @@ func main() {
 							zap.String("api-url-for-config-check", cfg.APIURLForConfigCheck))
 					}
 
-					logger.Info("creating kube agent config updater", zap.Any("config", cfg))
+					logger.Info("creating kube agent config updater", zap.Stringer("config", cfg))
 					config, err := rest.InClusterConfig()
 					if err != nil {
 						return err
@@ -162,8 +273,44 @@ func main() {
 						return err
 					}
 
+					var tlsConfig *tls.Config
+					if cfg.TLS.IsSet() {
+						tlsConfig, err = cfg.TLS.ClientConfig()
+						if err != nil {
+							return err
+						}
+					}
+					var proxyFunc func(*url.URL) (*url.URL, error)
+					if cfg.Proxy.IsSet() {
+						proxyFunc, err = cfg.Proxy.ProxyFunc()
+						if err != nil {
+							return err
+						}
+					}
+
+					selfTelemetry, err := selftelemetry.New(ctx, selftelemetry.Config{
+						ServiceName: "mw-kube-agent-config-updater",
+						Version:     agentVersion,
+						HostID:      cfg.ClusterName,
+						Target:      cfg.Target,
+						APIKey:      cfg.APIKey,
+						TLS:         tlsConfig,
+						Proxy:       proxyFunc,
+					}, logger)
+					if err != nil {
+						return err
+					}
+					defer func() {
+						shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+						defer cancel()
+						if err := selfTelemetry.Shutdown(shutdownCtx); err != nil {
+							logger.Warn("failed to shut down self telemetry", zap.Error(err))
+						}
+					}()
+
 					kubeAgentUpdater, err := configupdater.NewKubeAgent(cfg, agentVersion,
-						clientset, logger)
+						clientset, logger,
+						configupdater.WithKubeAgentMeter(selfTelemetry.Meter("mw-kube-agent-config-updater")))
 					if err != nil {
 						logger.Fatal("failed to create kube agent config", zap.Error(err))
 						return err
@@ -179,6 +326,15 @@ func main() {
 					// stopCh is used to stop the go routine that can send errors to errCh
 					stopCh := make(chan struct{})
 
+					if cfg.SelfMetricsPort != 0 {
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							address := net.JoinHostPort("localhost", strconv.Itoa(int(cfg.SelfMetricsPort)))
+							selfTelemetry.Serve(address, stopCh)
+						}()
+					}
+
 					wg.Add(1)
 					go func() {
 						defer wg.Done()
@@ -0,0 +1,263 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/middleware-labs/mw-agent/pkg/otelconfig"
+	"github.com/middleware-labs/mw-injector/pkg/otelinject"
+	"go.uber.org/zap"
+)
+
+// AutodiscoveryReceiverID is the receiver_creator of the otel config
+// starting a receiver for every integration observed on the host or in its
+// containers.
+const AutodiscoveryReceiverID = "receiver_creator/mw_autodiscovery"
+
+const (
+	hostObserverID   = "host_observer"
+	dockerObserverID = "docker_observer"
+)
+
+// discoveryRule is the receiver started by the receiver_creator for an
+// integration type when an endpoint listening on one of its ports is
+// observed.
+type discoveryRule struct {
+	receiver string
+	ports    []int
+	// config is the config of the receiver. Its endpoint is set to the
+	// observed endpoint unless config sets it, e.g. "http://`endpoint`".
+	config map[string]interface{}
+}
+
+// discoveryRules are the rules of the integration types scraped when they
+// are discovered, with their default ports. The integrations whose
+// receiver can't scrape without credentials, e.g. PostgreSQL and MySQL,
+// are left to the integration configs.
+var discoveryRules = map[IntegrationType]discoveryRule{
+	MongoDB: {receiver: "mongodb", ports: []int{27017}},
+	Redis:   {receiver: "redis", ports: []int{6379}},
+	Elasticsearch: {
+		receiver: "elasticsearch",
+		ports:    []int{9200},
+		config:   map[string]interface{}{"endpoint": "http://`endpoint`"},
+	},
+}
+
+// discoverIntegrationsFn returns the integrations running on the host.
+var discoverIntegrationsFn = func(logger *zap.Logger) ([]otelinject.IntegrationEntry, error) {
+	return otelinject.DiscoverIntegrations(otelinject.DiscoverIntegrationsOpts{
+		Logger: zapToSlog(logger),
+	})
+}
+
+// updateConfigForAutodiscovery adds a receiver_creator to the metrics
+// pipeline of config, watching the host observer and, if the docker socket
+// is available, the docker observer. It starts a receiver for every
+// endpoint listening on the port of an integration type of
+// discoveryRules, so that the integrations started after the config was
+// applied are scraped too. The ports of the integrations detected on the
+// host are added to the default ones, and the ports of the host endpoints
+// scraped by the receivers of config, e.g. the applied integrations, are
+// left out so that an integration is not scraped twice.
+func (c *HostAgent) updateConfigForAutodiscovery(config map[string]interface{}) (map[string]interface{}, error) {
+	receiversData, ok := config[Receivers].(map[string]interface{})
+	if !ok {
+		return nil, ErrParseReceivers
+	}
+
+	serviceData, ok := config[Service].(map[string]interface{})
+	if !ok {
+		return nil, ErrParseService
+	}
+
+	pipelinesData, ok := serviceData[Pipelines].(map[string]interface{})
+	if !ok {
+		return nil, ErrParsePipelines
+	}
+
+	if _, ok := pipelinesData[Metrics].(map[string]interface{}); !ok {
+		return nil, ErrParseMetrics
+	}
+
+	ports := map[string][]int{}
+	configs := map[string]map[string]interface{}{}
+	for _, rule := range discoveryRules {
+		ports[rule.receiver] = appendPorts(ports[rule.receiver], rule.ports...)
+		if rule.config != nil {
+			configs[rule.receiver] = rule.config
+		}
+	}
+
+	integrations, err := discoverIntegrationsFn(c.logger)
+	if err != nil {
+		// the default ports are still watched
+		c.logger.Warn("failed to discover integrations", zap.Error(err))
+	}
+	for _, integration := range integrations {
+		integrationType, err := ParseIntegrationType(integration.IntegrationType)
+		if err != nil {
+			continue
+		}
+		rule, ok := discoveryRules[integrationType]
+		if !ok {
+			continue
+		}
+
+		c.logger.Info("discovered integration",
+			zap.String("type", integration.IntegrationType),
+			zap.String("service", integration.ServiceName),
+			zap.Ints("ports", integration.Ports))
+		ports[rule.receiver] = appendPorts(ports[rule.receiver], integration.Ports...)
+	}
+
+	for receiver, coveredPorts := range scrapedHostPorts(receiversData) {
+		if _, ok := ports[receiver]; !ok {
+			continue
+		}
+		c.logger.Info("leaving integration ports to the configured receivers",
+			zap.String("receiver", receiver), zap.Ints("ports", coveredPorts))
+		ports[receiver] = removePorts(ports[receiver], coveredPorts...)
+	}
+
+	observers := []interface{}{hostObserverID}
+	if err := otelconfig.AddExtension(config, hostObserverID, map[string]interface{}{}); err != nil {
+		return nil, err
+	}
+	if c.getConfigType() == "docker" {
+		observers = append(observers, dockerObserverID)
+		err := otelconfig.AddExtension(config, dockerObserverID, map[string]interface{}{
+			"endpoint": c.DockerEndpoint,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	templates := map[string]interface{}{}
+	for receiver, receiverPorts := range ports {
+		if len(receiverPorts) == 0 {
+			continue
+		}
+		template := map[string]interface{}{
+			"rule": discoveryRuleExpr(receiverPorts),
+		}
+		if receiverConfig, ok := configs[receiver]; ok {
+			template["config"] = copyMap(receiverConfig)
+		}
+		templates[receiver] = template
+	}
+
+	receiversData[AutodiscoveryReceiverID] = map[string]interface{}{
+		"watch_observers": observers,
+		"receivers":       templates,
+	}
+
+	if err := addPipelineReceiver(pipelinesData, Metrics, AutodiscoveryReceiverID); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// discoveryRuleExpr returns the receiver_creator rule matching the TCP
+// endpoints listening on ports. The host ports published by docker are
+// left to the docker observer, and the IPv6 listeners of the host to their
+// IPv4 twin, so that an integration is scraped once.
+func discoveryRuleExpr(ports []int) string {
+	portList := make([]string, len(ports))
+	for i, port := range ports {
+		portList[i] = fmt.Sprint(port)
+	}
+	inPorts := "port in [" + strings.Join(portList, ", ") + "]"
+
+	return fmt.Sprintf(`type == "port" && transport == "TCP" && !is_ipv6 && `+
+		`process_name != "docker-proxy" && %s || type == "container" && %s`, inPorts, inPorts)
+}
+
+// scrapedHostPorts returns the ports of the endpoints of the host scraped
+// by the receivers of receiversData, by receiver type.
+func scrapedHostPorts(receiversData map[string]interface{}) map[string][]int {
+	scraped := map[string][]int{}
+	for id, receiver := range receiversData {
+		receiverType, _, _ := strings.Cut(id, "/")
+		receiverData, ok := receiver.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, endpoint := range receiverEndpoints(receiverData) {
+			ep, err := parseEndpoint(endpoint)
+			if err != nil || ep.Port == 0 || !isLocalHost(ep.Host) {
+				continue
+			}
+			scraped[receiverType] = appendPorts(scraped[receiverType], ep.Port)
+		}
+	}
+	return scraped
+}
+
+// receiverEndpoints returns the endpoints of a receiver config, in its
+// endpoint setting or, for the mongodb receiver, in its hosts.
+func receiverEndpoints(receiverData map[string]interface{}) []string {
+	var endpoints []string
+	if endpoint, ok := receiverData["endpoint"].(string); ok {
+		endpoints = append(endpoints, endpoint)
+	}
+	hosts, _ := receiverData["hosts"].([]interface{})
+	for _, host := range hosts {
+		hostData, _ := host.(map[string]interface{})
+		if endpoint, ok := hostData["endpoint"].(string); ok {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// isLocalHost reports whether host, a host name or an IP address, is the
+// host the agent runs on.
+func isLocalHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback() || ip.IsUnspecified()
+	}
+	hostname, _ := os.Hostname()
+	return strings.EqualFold(host, "localhost") || strings.EqualFold(host, hostname)
+}
+
+// removePorts returns ports without the ports of remove.
+func removePorts(ports []int, remove ...int) []int {
+	var kept []int
+	for _, port := range ports {
+		if !slices.Contains(remove, port) {
+			kept = append(kept, port)
+		}
+	}
+	return kept
+}
+
+// appendPorts appends the ports which are not in ports yet to it, and
+// keeps ports sorted.
+func appendPorts(ports []int, add ...int) []int {
+	for _, port := range add {
+		i := sort.SearchInts(ports, port)
+		if i < len(ports) && ports[i] == port {
+			continue
+		}
+		ports = append(ports, 0)
+		copy(ports[i+1:], ports[i:])
+		ports[i] = port
+	}
+	return ports
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
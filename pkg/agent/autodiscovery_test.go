@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/middleware-labs/mw-injector/pkg/otelinject"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestUpdateConfigForAutodiscovery(t *testing.T) {
+	defer func(fn func(*zap.Logger) ([]otelinject.IntegrationEntry, error)) {
+		discoverIntegrationsFn = fn
+	}(discoverIntegrationsFn)
+	discoverIntegrationsFn = func(*zap.Logger) ([]otelinject.IntegrationEntry, error) {
+		return []otelinject.IntegrationEntry{
+			{IntegrationType: "mongodb", ServiceName: "mongod", Ports: []int{27018, 27017}},
+			{IntegrationType: "redis", ServiceName: "redis", Ports: []int{6380}},
+			{IntegrationType: "postgresql", ServiceName: "postgres", Ports: []int{5432}},
+			{IntegrationType: "cassandra", ServiceName: "cassandra", Ports: []int{9042}},
+		}, nil
+	}
+
+	defer func(fn func(string) bool) { isSocketFn = fn }(isSocketFn)
+	isSocketFn = func(string) bool { return true }
+
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{
+			BaseConfig: BaseConfig{DockerEndpoint: "unix:///var/run/docker.sock"},
+		},
+		logger: zap.NewNop(),
+	}
+
+	config := map[string]interface{}{
+		"receivers": map[string]interface{}{
+			"hostmetrics": map[string]interface{}{},
+			// applied integrations
+			"redis/cache": map[string]interface{}{"endpoint": "localhost:6380"},
+			"mongodb/orders": map[string]interface{}{
+				"hosts": []interface{}{map[string]interface{}{"endpoint": "db.internal:27018"}},
+			},
+		},
+		"service": map[string]interface{}{
+			"extensions": []interface{}{"health_check"},
+			"pipelines": map[string]interface{}{
+				"metrics": map[string]interface{}{
+					"receivers": []interface{}{"hostmetrics"},
+				},
+			},
+		},
+	}
+
+	config, err := hostAgent.updateConfigForAutodiscovery(config)
+	assert.NoError(t, err)
+
+	receiverCreator := config["receivers"].(map[string]interface{})[AutodiscoveryReceiverID].(map[string]interface{})
+	assert.Equal(t, []interface{}{"host_observer", "docker_observer"}, receiverCreator["watch_observers"])
+
+	templates := receiverCreator["receivers"].(map[string]interface{})
+	assert.Len(t, templates, 3)
+	// the integrations requiring credentials are not discovered
+	assert.NotContains(t, templates, "postgresql")
+	assert.NotContains(t, templates, "mysql")
+	// a remote endpoint does not cover the local port
+	assert.Contains(t, templates["mongodb"].(map[string]interface{})["rule"], "port in [27017, 27018]")
+	// the local endpoint of the applied integration is left to it
+	assert.Contains(t, templates["redis"].(map[string]interface{})["rule"], "port in [6379]")
+	assert.Equal(t, map[string]interface{}{"endpoint": "http://`endpoint`"},
+		templates["elasticsearch"].(map[string]interface{})["config"])
+
+	extensions := config["extensions"].(map[string]interface{})
+	assert.Equal(t, "unix:///var/run/docker.sock",
+		extensions["docker_observer"].(map[string]interface{})["endpoint"])
+
+	service := config["service"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"health_check", "host_observer", "docker_observer"}, service["extensions"])
+
+	// applying the transform again does not add the receiver twice
+	config, err = hostAgent.updateConfigForAutodiscovery(config)
+	assert.NoError(t, err)
+	metrics := service["pipelines"].(map[string]interface{})["metrics"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"hostmetrics", AutodiscoveryReceiverID}, metrics["receivers"])
+}
+
+func TestUpdateConfigForAutodiscoveryWithoutDocker(t *testing.T) {
+	defer func(fn func(*zap.Logger) ([]otelinject.IntegrationEntry, error)) {
+		discoverIntegrationsFn = fn
+	}(discoverIntegrationsFn)
+	discoverIntegrationsFn = func(*zap.Logger) ([]otelinject.IntegrationEntry, error) {
+		return nil, errors.New("permission denied")
+	}
+
+	defer func(fn func(string) bool) { isSocketFn = fn }(isSocketFn)
+	isSocketFn = func(string) bool { return false }
+
+	hostAgent := &HostAgent{logger: zap.NewNop()}
+	config := map[string]interface{}{
+		"receivers": map[string]interface{}{},
+		"service": map[string]interface{}{
+			"pipelines": map[string]interface{}{
+				"metrics": map[string]interface{}{"receivers": []string{"awsecscontainermetrics"}},
+			},
+		},
+	}
+
+	// the default ports are watched when the discovery fails
+	config, err := hostAgent.updateConfigForAutodiscovery(config)
+	assert.NoError(t, err)
+
+	receiverCreator := config["receivers"].(map[string]interface{})[AutodiscoveryReceiverID].(map[string]interface{})
+	assert.Equal(t, []interface{}{"host_observer"}, receiverCreator["watch_observers"])
+	templates := receiverCreator["receivers"].(map[string]interface{})
+	assert.Contains(t, templates["redis"].(map[string]interface{})["rule"], "port in [6379]")
+	assert.NotContains(t, config["extensions"], "docker_observer")
+
+	_, err = hostAgent.updateConfigForAutodiscovery(map[string]interface{}{})
+	assert.ErrorIs(t, err, ErrParseReceivers)
+}
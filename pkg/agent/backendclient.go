@@ -0,0 +1,343 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+var ErrCircuitOpen = errors.New("backend circuit breaker is open")
+
+// CircuitState is the state of the BackendClient circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets all calls through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails all calls without reaching the backend.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe call through after the circuit
+	// was open. Its result closes or opens the circuit again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BackendClientState is a snapshot of the state of a BackendClient.
+type BackendClientState struct {
+	Circuit             CircuitState
+	ConsecutiveFailures int
+	Requests            int64
+	Failures            int64
+	LastError           string
+	LastFailure         time.Time
+}
+
+// BackendClient is the HTTP client for the control-plane calls to the
+// Middleware backend (restart status, ingestion rules, config groups and
+// agent tracking). Every call gets a timeout, consecutive failures open a
+// circuit breaker and NextDelay spreads retries with exponential backoff
+// and jitter so that a fleet of agents does not poll in lockstep.
+type BackendClient struct {
+	do               func(req *http.Request) (*http.Response, error)
+	timeout          time.Duration
+	maxBackoff       time.Duration
+	failureThreshold int
+	openDuration     time.Duration
+	logger           *zap.Logger
+	meter            metric.Meter
+	randInt63n       func(n int64) int64
+
+	mu       sync.Mutex
+	state    BackendClientState
+	openedAt time.Time
+	probing  bool
+}
+
+// BackendClientOptions takes in various options for BackendClient
+type BackendClientOptions func(b *BackendClient)
+
+// WithBackendClientTimeout sets the timeout of a single backend call.
+func WithBackendClientTimeout(d time.Duration) BackendClientOptions {
+	return func(b *BackendClient) {
+		b.timeout = d
+	}
+}
+
+// WithBackendClientMaxBackoff sets the upper bound of the delay returned
+// by NextDelay after failures.
+func WithBackendClientMaxBackoff(d time.Duration) BackendClientOptions {
+	return func(b *BackendClient) {
+		b.maxBackoff = d
+	}
+}
+
+// WithBackendClientCircuitBreaker sets the number of consecutive failures
+// that open the circuit and how long it stays open.
+func WithBackendClientCircuitBreaker(failureThreshold int,
+	openDuration time.Duration) BackendClientOptions {
+	return func(b *BackendClient) {
+		b.failureThreshold = failureThreshold
+		b.openDuration = openDuration
+	}
+}
+
+// WithBackendClientHTTPDoFunc sets the function used to send requests.
+func WithBackendClientHTTPDoFunc(do func(req *http.Request) (*http.Response, error)) BackendClientOptions {
+	return func(b *BackendClient) {
+		b.do = do
+	}
+}
+
+// WithBackendClientMeter reports the state of the client as self-metrics
+// through meter.
+func WithBackendClientMeter(meter metric.Meter) BackendClientOptions {
+	return func(b *BackendClient) {
+		b.meter = meter
+	}
+}
+
+// NewBackendClient returns a new BackendClient with given options.
+func NewBackendClient(logger *zap.Logger, opts ...BackendClientOptions) *BackendClient {
+	b := &BackendClient{
+		do:               http.DefaultClient.Do,
+		timeout:          10 * time.Second,
+		maxBackoff:       10 * time.Minute,
+		failureThreshold: 5,
+		openDuration:     2 * time.Minute,
+		logger:           logger,
+		randInt63n:       rand.Int63n,
+	}
+
+	for _, apply := range opts {
+		apply(b)
+	}
+
+	if b.meter != nil {
+		if err := b.registerMetrics(); err != nil {
+			b.logger.Warn("failed to register backend client metrics", zap.Error(err))
+		}
+	}
+
+	return b
+}
+
+// Do sends req to the backend. The call is bounded by the client timeout
+// and fails with ErrCircuitOpen while the circuit breaker is open. Network
+// errors, 5xx and 429 responses count as failures.
+func (b *BackendClient) Do(req *http.Request) (*http.Response, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+
+	resp, err := b.send(req)
+	if err != nil {
+		b.record(err)
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError ||
+		resp.StatusCode == http.StatusTooManyRequests {
+		b.record(fmt.Errorf("%s %s returned status %d", req.Method, req.URL.Path, resp.StatusCode))
+	} else {
+		b.record(nil)
+	}
+	return resp, nil
+}
+
+// DoWithoutBreaker sends req to the backend like Do, but neither checks
+// nor updates the circuit breaker. It is used for the agent tracking
+// calls, which report rollbacks and shutdowns and must get through while
+// the circuit is open.
+func (b *BackendClient) DoWithoutBreaker(req *http.Request) (*http.Response, error) {
+	return b.send(req)
+}
+
+// send sends req bounded by the client timeout.
+func (b *BackendClient) send(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), b.timeout)
+	resp, err := b.do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// the timeout also covers reading the body, release it on Close
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (b *BackendClient) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state.Circuit {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.openDuration {
+			return ErrCircuitOpen
+		}
+		b.setCircuit(CircuitHalfOpen)
+		b.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *BackendClient) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state.Requests++
+	b.probing = false
+
+	if err == nil {
+		b.state.ConsecutiveFailures = 0
+		if b.state.Circuit != CircuitClosed {
+			b.setCircuit(CircuitClosed)
+		}
+		return
+	}
+
+	b.state.Failures++
+	b.state.ConsecutiveFailures++
+	b.state.LastError = err.Error()
+	b.state.LastFailure = time.Now()
+
+	if b.state.Circuit == CircuitHalfOpen ||
+		(b.state.Circuit == CircuitClosed && b.state.ConsecutiveFailures >= b.failureThreshold) {
+		b.openedAt = time.Now()
+		b.setCircuit(CircuitOpen)
+	}
+}
+
+// setCircuit must be called with b.mu held.
+func (b *BackendClient) setCircuit(circuit CircuitState) {
+	b.logger.Info("backend circuit breaker state changed",
+		zap.Stringer("from", b.state.Circuit),
+		zap.Stringer("to", circuit),
+		zap.Int("consecutive_failures", b.state.ConsecutiveFailures),
+		zap.String("last_error", b.state.LastError))
+	b.state.Circuit = circuit
+}
+
+// State returns a snapshot of the client state.
+func (b *BackendClient) State() BackendClientState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// NextDelay returns how long to wait before the next call of a loop that
+// polls the backend every interval. Without failures it is interval.
+// After failures it is interval plus a jitter growing exponentially up to
+// the max backoff, so that a failing backend is never polled more often
+// than a healthy one, and it never ends before an open circuit allows a
+// probe call.
+func (b *BackendClient) NextDelay(interval time.Duration) time.Duration {
+	b.mu.Lock()
+	failures := b.state.ConsecutiveFailures
+	var untilProbe time.Duration
+	if b.state.Circuit == CircuitOpen {
+		untilProbe = b.openDuration - time.Since(b.openedAt)
+	}
+	b.mu.Unlock()
+
+	if failures == 0 {
+		return interval
+	}
+
+	maxBackoff := b.maxBackoff
+	if maxBackoff < interval {
+		maxBackoff = interval
+	}
+
+	backoff := maxBackoff
+	if failures < 32 && interval<<failures > 0 && interval<<failures < maxBackoff {
+		backoff = interval << failures
+	}
+
+	delay := interval
+	if backoff > interval {
+		delay += time.Duration(b.randInt63n(int64(backoff - interval)))
+	}
+	if delay < untilProbe {
+		delay = untilProbe
+	}
+	return delay
+}
+
+// StartOffset returns a random delay in [0, interval) used to spread the
+// first poll of the agents that start at the same time.
+func (b *BackendClient) StartOffset(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	return time.Duration(b.randInt63n(int64(interval)))
+}
+
+func (b *BackendClient) registerMetrics() error {
+	circuit, err := b.meter.Int64ObservableGauge("mw_agent.backend.circuit_state",
+		metric.WithDescription("State of the backend circuit breaker (0: closed, 1: open, 2: half-open)"))
+	if err != nil {
+		return err
+	}
+	consecutiveFailures, err := b.meter.Int64ObservableGauge("mw_agent.backend.consecutive_failures",
+		metric.WithDescription("Number of consecutive failed backend calls"))
+	if err != nil {
+		return err
+	}
+	requests, err := b.meter.Int64ObservableCounter("mw_agent.backend.requests",
+		metric.WithDescription("Number of backend calls"))
+	if err != nil {
+		return err
+	}
+	failures, err := b.meter.Int64ObservableCounter("mw_agent.backend.failures",
+		metric.WithDescription("Number of failed backend calls"))
+	if err != nil {
+		return err
+	}
+
+	_, err = b.meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		state := b.State()
+		o.ObserveInt64(circuit, int64(state.Circuit))
+		o.ObserveInt64(consecutiveFailures, int64(state.ConsecutiveFailures))
+		o.ObserveInt64(requests, state.Requests)
+		o.ObserveInt64(failures, state.Failures)
+		return nil
+	}, circuit, consecutiveFailures, requests, failures)
+	return err
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
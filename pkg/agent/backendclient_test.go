@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBackendClientCircuitBreaker(t *testing.T) {
+	status := http.StatusInternalServerError
+	calls := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+	}))
+	defer mockServer.Close()
+
+	client := NewBackendClient(zap.NewNop(),
+		WithBackendClientCircuitBreaker(2, 50*time.Millisecond))
+
+	get := func() error {
+		req, err := http.NewRequest(http.MethodGet, mockServer.URL, nil)
+		assert.NoError(t, err)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	assert.NoError(t, get())
+	assert.NoError(t, get())
+	assert.Equal(t, CircuitOpen, client.State().Circuit)
+
+	// calls fail fast while the circuit is open
+	assert.True(t, errors.Is(get(), ErrCircuitOpen))
+	assert.Equal(t, 2, calls)
+
+	// after the open duration a probe call closes the circuit again
+	time.Sleep(60 * time.Millisecond)
+	status = http.StatusOK
+	assert.NoError(t, get())
+
+	state := client.State()
+	assert.Equal(t, CircuitClosed, state.Circuit)
+	assert.Equal(t, 0, state.ConsecutiveFailures)
+	assert.Equal(t, int64(3), state.Requests)
+	assert.Equal(t, int64(2), state.Failures)
+}
+
+func TestBackendClientNextDelay(t *testing.T) {
+	client := NewBackendClient(zap.NewNop(),
+		WithBackendClientMaxBackoff(time.Minute),
+		WithBackendClientCircuitBreaker(100, time.Minute))
+	// always pick the upper bound of the jitter range
+	client.randInt63n = func(n int64) int64 { return n - 1 }
+
+	interval := 10 * time.Second
+	assert.Equal(t, interval, client.NextDelay(interval))
+
+	client.record(errors.New("test error"))
+	assert.Equal(t, 20*time.Second-1, client.NextDelay(interval))
+
+	client.record(errors.New("test error"))
+	assert.Equal(t, 40*time.Second-1, client.NextDelay(interval))
+
+	for i := 0; i < 40; i++ {
+		client.record(errors.New("test error"))
+	}
+	assert.Equal(t, time.Minute-1, client.NextDelay(interval))
+
+	// the lower bound of the jitter range is interval
+	client.randInt63n = func(n int64) int64 { return 0 }
+	assert.Equal(t, interval, client.NextDelay(interval))
+
+	client.record(nil)
+	assert.Equal(t, interval, client.NextDelay(interval))
+}
+
+func TestBackendClientDoWithoutBreaker(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	client := NewBackendClient(zap.NewNop(),
+		WithBackendClientCircuitBreaker(1, time.Minute))
+	client.record(errors.New("test error"))
+	assert.Equal(t, CircuitOpen, client.State().Circuit)
+
+	// the tracking calls get through the open circuit and leave it open
+	req, err := http.NewRequest(http.MethodPost, mockServer.URL, nil)
+	assert.NoError(t, err)
+	resp, err := client.DoWithoutBreaker(req)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, CircuitOpen, client.State().Circuit)
+	assert.Equal(t, int64(1), client.State().Requests)
+}
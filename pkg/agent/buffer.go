@@ -0,0 +1,208 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/middleware-labs/mw-agent/pkg/otelconfig"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// BufferStorageID is the id of the file_storage extension backing the
+// persistent sending queues of the exporters.
+const BufferStorageID = "file_storage/mw_buffer"
+
+// enqueueFailedMetricPrefix is the prefix of the collector metrics
+// counting the telemetry an exporter dropped because its queue was full.
+const enqueueFailedMetricPrefix = "otelcol_exporter_enqueue_failed_"
+
+// otlpExporterTypes are the exporter types whose sending queues are kept on
+// disk, including the names deprecated by the collector.
+var otlpExporterTypes = map[string]bool{
+	"otlp":      true,
+	"otlp_grpc": true,
+	"otlphttp":  true,
+	"otlp_http": true,
+}
+
+// isOTLPExporter reports whether the exporter with the given id, e.g.
+// otlphttp/mw, is an OTLP exporter.
+func isOTLPExporter(id string) bool {
+	exporterType, _, _ := strings.Cut(id, "/")
+	return otlpExporterTypes[exporterType]
+}
+
+func (c *HostAgent) bufferEnabled() bool {
+	return c.BufferDir != "" && c.BufferMaxSize > 0
+}
+
+// updateConfigForBuffer adds the file_storage extension to config and uses
+// it as the sending queue storage of every OTLP exporter. The queues share
+// BufferMaxSize, each exporter gets an equal part of it in bytes.
+func (c *HostAgent) updateConfigForBuffer(config map[string]interface{}) (map[string]interface{}, error) {
+	exportersData, ok := config[Exporters].(map[string]interface{})
+	if !ok {
+		return nil, ErrParseExporters
+	}
+
+	var exporterIDs []string
+	for id := range exportersData {
+		if isOTLPExporter(id) {
+			exporterIDs = append(exporterIDs, id)
+		}
+	}
+	if len(exporterIDs) == 0 {
+		return config, nil
+	}
+	sort.Strings(exporterIDs)
+
+	queueSize := int64(c.BufferMaxSize) * 1024 * 1024 / int64(len(exporterIDs))
+	for _, id := range exporterIDs {
+		exporterData, ok := exportersData[id].(map[string]interface{})
+		if !ok {
+			exporterData = map[string]interface{}{}
+		}
+
+		sendingQueue, ok := exporterData["sending_queue"].(map[string]interface{})
+		if !ok {
+			sendingQueue = map[string]interface{}{}
+		}
+		sendingQueue["enabled"] = true
+		sendingQueue["storage"] = BufferStorageID
+		sendingQueue["sizer"] = "bytes"
+		sendingQueue["queue_size"] = queueSize
+		// not supported by persistent queues
+		delete(sendingQueue, "wait_for_result")
+
+		exporterData["sending_queue"] = sendingQueue
+		exportersData[id] = exporterData
+	}
+
+	err := otelconfig.AddExtension(config, BufferStorageID, map[string]interface{}{
+		"directory":        c.BufferDir,
+		"create_directory": true,
+		"compaction": map[string]interface{}{
+			"directory":  c.BufferDir,
+			"on_start":   true,
+			"on_rebound": true,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// registerBufferMetrics records the disk usage of BufferDir and the
+// telemetry dropped by the OTLP exporters through meter.
+func (c *HostAgent) registerBufferMetrics(meter metric.Meter) error {
+	_, err := meter.Int64ObservableGauge("mw_agent.buffer.disk_usage",
+		metric.WithDescription("Disk space used by the persistent exporter queues"),
+		metric.WithUnit("By"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			// the directory only exists once the collector ran
+			if size, err := dirSize(c.BufferDir); err == nil {
+				o.Observe(size)
+			}
+			return nil
+		}))
+	if err != nil {
+		return err
+	}
+
+	if c.InternalMetricsPort == 0 {
+		return nil
+	}
+
+	metricsURL := "http://" + net.JoinHostPort("localhost",
+		strconv.Itoa(int(c.InternalMetricsPort))) + "/metrics"
+	_, err = meter.Float64ObservableCounter("mw_agent.buffer.dropped",
+		metric.WithDescription("Telemetry items dropped by the OTLP exporters because their queue was full, by exporter, since the collector started"),
+		metric.WithFloat64Callback(func(ctx context.Context, o metric.Float64Observer) error {
+			dropped, err := scrapeEnqueueFailures(ctx, metricsURL)
+			if err != nil {
+				// the collector is not running
+				return nil
+			}
+			for exporter, value := range dropped {
+				o.Observe(value, metric.WithAttributes(attribute.String("exporter", exporter)))
+			}
+			return nil
+		}))
+	return err
+}
+
+// dirSize returns the total size of the files in dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// scrapeEnqueueFailures reads the internal metrics of the collector served
+// at metricsURL and returns the number of items each OTLP exporter dropped
+// because its queue was full.
+func scrapeEnqueueFailures(ctx context.Context, metricsURL string) (map[string]float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metricsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("collector metrics returned non-200 status: %d", resp.StatusCode)
+	}
+
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse collector metrics: %w", err)
+	}
+
+	dropped := map[string]float64{}
+	for name, family := range families {
+		if !strings.HasPrefix(name, enqueueFailedMetricPrefix) {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "exporter" && isOTLPExporter(label.GetValue()) {
+					dropped[label.GetValue()] += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return dropped, nil
+}
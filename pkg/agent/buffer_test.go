@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateConfigForBuffer(t *testing.T) {
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{
+			BufferDir:     "/var/lib/mw-agent/buffer",
+			BufferMaxSize: 100,
+		},
+	}
+
+	config := map[string]interface{}{
+		"exporters": map[string]interface{}{
+			"otlp": map[string]interface{}{
+				"endpoint": "${env:MW_TARGET}",
+				"sending_queue": map[string]interface{}{
+					"num_consumers":   4,
+					"wait_for_result": true,
+				},
+			},
+			"otlphttp/mw": map[string]interface{}{"endpoint": "https://myaccount.middleware.io"},
+			"debug":       map[string]interface{}{},
+		},
+		"service": map[string]interface{}{
+			"extensions": []interface{}{"health_check"},
+		},
+	}
+
+	config, err := hostAgent.updateConfigForBuffer(config)
+	assert.NoError(t, err)
+
+	exporters := config["exporters"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{
+		"enabled":       true,
+		"storage":       BufferStorageID,
+		"sizer":         "bytes",
+		"queue_size":    int64(50 * 1024 * 1024),
+		"num_consumers": 4,
+	}, exporters["otlp"].(map[string]interface{})["sending_queue"])
+	assert.Equal(t, BufferStorageID,
+		exporters["otlphttp/mw"].(map[string]interface{})["sending_queue"].(map[string]interface{})["storage"])
+	assert.NotContains(t, exporters["debug"], "sending_queue")
+
+	extensions := config["extensions"].(map[string]interface{})
+	assert.Equal(t, "/var/lib/mw-agent/buffer",
+		extensions[BufferStorageID].(map[string]interface{})["directory"])
+	assert.Equal(t, []interface{}{"health_check", BufferStorageID},
+		config["service"].(map[string]interface{})["extensions"])
+
+	// applying the transform again does not add the extension twice
+	config, err = hostAgent.updateConfigForBuffer(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"health_check", BufferStorageID},
+		config["service"].(map[string]interface{})["extensions"])
+}
+
+func TestScrapeEnqueueFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE otelcol_exporter_enqueue_failed_log_records_total counter
+otelcol_exporter_enqueue_failed_log_records_total{exporter="otlp"} 3
+otelcol_exporter_enqueue_failed_log_records_total{exporter="debug"} 7
+# TYPE otelcol_exporter_enqueue_failed_metric_points_total counter
+otelcol_exporter_enqueue_failed_metric_points_total{exporter="otlp"} 2
+# TYPE otelcol_exporter_sent_log_records_total counter
+otelcol_exporter_sent_log_records_total{exporter="otlp"} 100
+`)
+	}))
+	defer server.Close()
+
+	dropped, err := scrapeEnqueueFailures(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"otlp": 5}, dropped)
+}
@@ -0,0 +1,241 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var ErrNoConfFragments = errors.New("no otel config fragments found")
+
+// confFragmentPatterns are the file patterns read from the conf.d directory.
+var confFragmentPatterns = []string{"*.yaml", "*.yml"}
+
+// confFragments returns the otel config fragments in dir sorted by file
+// name, which is the order they are merged in.
+func confFragments(dir string) ([]string, error) {
+	var files []string
+	for _, pattern := range confFragmentPatterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// LoadConfDir reads the otel config fragments in dir and deep-merges them
+// in file name order, e.g. 00-base.yaml before 10-logs.yaml. Maps are
+// merged key by key, any other value (including lists) of a later fragment
+// replaces the value of an earlier one.
+func LoadConfDir(dir string) (map[string]interface{}, error) {
+	files, err := confFragments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w in %s", ErrNoConfFragments, dir)
+	}
+
+	config := map[string]interface{}{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read otel config fragment %s: %w", file, err)
+		}
+
+		var fragment map[interface{}]interface{}
+		if err := yaml.Unmarshal(convertTabsToSpaces(data, 2), &fragment); err != nil {
+			return nil, fmt.Errorf("failed to parse otel config fragment %s: %w", file, err)
+		}
+
+		fragmentConfig, ok := normalizeYAML(fragment).(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("otel config fragment %s is not a map", file)
+		}
+		deepMerge(config, fragmentConfig)
+	}
+
+	return config, nil
+}
+
+// normalizeYAML converts the map[interface{}]interface{} values produced
+// by yaml.v2 into map[string]interface{} as produced by encoding/json, the
+// format the config transforms work on.
+func normalizeYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = normalizeYAML(val)
+		}
+		return m
+	case map[string]interface{}:
+		for k, val := range v {
+			v[k] = normalizeYAML(val)
+		}
+		return v
+	case []interface{}:
+		for i, val := range v {
+			v[i] = normalizeYAML(val)
+		}
+		return v
+	}
+	return v
+}
+
+// deepMerge merges src into dst. Maps are merged recursively, any other
+// value of src replaces the value in dst.
+func deepMerge(dst, src map[string]interface{}) {
+	for k, srcVal := range src {
+		srcMap, srcOk := srcVal.(map[string]interface{})
+		dstMap, dstOk := dst[k].(map[string]interface{})
+		if srcOk && dstOk {
+			deepMerge(dstMap, srcMap)
+			continue
+		}
+		dst[k] = srcVal
+	}
+}
+
+// confDirHash returns a hash of the names and contents of the fragments in
+// dir used to detect changes.
+func confDirHash(dir string) ([sha256.Size]byte, error) {
+	files, err := confFragments(dir)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	h := sha256.New()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return [sha256.Size]byte{}, err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.Base(file), len(data))
+		h.Write(data)
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// buildOfflineOtelConfig builds the otel config from the fragments in
+// ConfDir and applies the host transforms to it.
+func (c *HostAgent) buildOfflineOtelConfig() ([]byte, error) {
+	config, err := LoadConfDir(c.ConfDir)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err = c.applyHostTransforms(config)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal otel config: %w", err)
+	}
+	return data, nil
+}
+
+// updateConfigFileFromConfDir writes the otel config built from ConfDir to
+// OtelConfigFile. It returns ErrConfigUnchanged if the built config is the
+// same as the current one, and ErrInvalidConfig if the fragments can not be
+// merged into a valid config.
+func (c *HostAgent) updateConfigFileFromConfDir() error {
+	data, err := c.buildOfflineOtelConfig()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	if current, err := os.ReadFile(c.OtelConfigFile); err == nil && bytes.Equal(current, data) {
+		return ErrConfigUnchanged
+	}
+
+	if err := c.validateOtelConfig(data); err != nil {
+		if errors.Is(err, ErrInvalidConfig) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	if err := os.WriteFile(c.OtelConfigFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write new configuration data to file %s: %w", c.OtelConfigFile, err)
+	}
+
+	c.recordAppliedConfig(data)
+
+	return nil
+}
+
+// ListenForConfDirChanges builds the otel config from the fragments in
+// ConfDir without contacting the Middleware backend. It checks the
+// fragments every config check interval, if the interval is not 0, and
+// sends ErrRestartAgent to errCh when the config built from them changed.
+func (c *HostAgent) ListenForConfDirChanges(errCh chan<- error,
+	stopCh <-chan struct{}) error {
+	c.logger.Info("building otel config from local fragments",
+		zap.String("conf-dir", c.ConfDir))
+
+	err := c.updateConfigFileFromConfDir()
+	if errors.Is(err, ErrConfigUnchanged) {
+		err = nil
+	}
+	errCh <- err
+
+	// a config check interval of 0 disables the config checks
+	if c.configCheckDuration <= 0 {
+		<-stopCh
+		return nil
+	}
+
+	lastHash, _ := confDirHash(c.ConfDir)
+
+	ticker := time.NewTicker(c.configCheckDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		case <-ticker.C:
+			hash, err := confDirHash(c.ConfDir)
+			if err != nil {
+				c.logger.Warn("failed to read otel config fragments",
+					zap.String("conf-dir", c.ConfDir), zap.Error(err))
+				continue
+			}
+
+			if hash == lastHash {
+				continue
+			}
+			lastHash = hash
+
+			c.logger.Info("otel config fragments changed",
+				zap.String("conf-dir", c.ConfDir))
+
+			err = c.updateConfigFileFromConfDir()
+			if errors.Is(err, ErrConfigUnchanged) {
+				continue
+			}
+			if err == nil {
+				err = ErrRestartAgent
+			}
+			errCh <- err
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestLoadConfDir(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := LoadConfDir(dir)
+	assert.True(t, errors.Is(err, ErrNoConfFragments))
+
+	fragments := map[string]string{
+		"00-base.yaml": `
+receivers:
+  otlp:
+    protocols:
+      grpc:
+        endpoint: 0.0.0.0:9319
+processors:
+  batch: {}
+service:
+  pipelines:
+    metrics:
+      receivers: [otlp]
+      processors: [batch]
+      exporters: [otlphttp]
+`,
+		"10-override.yml": `
+receivers:
+  otlp:
+    protocols:
+      grpc:
+        endpoint: localhost:9319
+service:
+  pipelines:
+    metrics:
+      processors: [memory_limiter, batch]
+`,
+		"README.md": "not a fragment",
+	}
+	for name, content := range fragments {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	config, err := LoadConfDir(dir)
+	assert.NoError(t, err)
+
+	grpc := config["receivers"].(map[string]interface{})["otlp"].(map[string]interface{})["protocols"].(map[string]interface{})["grpc"].(map[string]interface{})
+	assert.Equal(t, "localhost:9319", grpc["endpoint"])
+
+	metrics := config["service"].(map[string]interface{})["pipelines"].(map[string]interface{})["metrics"].(map[string]interface{})
+	// lists are replaced, maps are merged
+	assert.Equal(t, []interface{}{"memory_limiter", "batch"}, metrics["processors"])
+	assert.Equal(t, []interface{}{"otlp"}, metrics["receivers"])
+
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{
+			BaseConfig: BaseConfig{
+				AgentFeatures: AgentFeatures{
+					MetricCollection: true,
+					LogCollection:    true,
+				},
+			},
+			HostTags: "env:prod",
+			ConfDir:  dir,
+		},
+		logger: zap.NewNop(),
+	}
+
+	data, err := hostAgent.buildOfflineOtelConfig()
+	assert.NoError(t, err)
+
+	var built map[string]interface{}
+	assert.NoError(t, yaml.Unmarshal(data, &built))
+	assert.Contains(t, built["processors"], "resource/host_tags")
+}
+
+func TestListenForConfDirChangesZeroInterval(t *testing.T) {
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{
+			ConfDir: t.TempDir(),
+		},
+		logger: zap.NewNop(),
+	}
+
+	errCh := make(chan error, 1)
+	stopCh := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- hostAgent.ListenForConfDirChanges(errCh, stopCh)
+	}()
+
+	// the config is built once, the directory has no fragments
+	assert.True(t, errors.Is(<-errCh, ErrInvalidConfig))
+
+	close(stopCh)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenForConfDirChanges did not return")
+	}
+}
@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConfigChangeAction is the kind of a ConfigChange.
+type ConfigChangeAction string
+
+const (
+	ConfigChangeAdded    ConfigChangeAction = "added"
+	ConfigChangeRemoved  ConfigChangeAction = "removed"
+	ConfigChangeModified ConfigChangeAction = "modified"
+)
+
+// configDiffSections are the component sections compared by
+// DiffOtelConfigs, in the order the changes are reported.
+var configDiffSections = []string{"extensions", "receivers", "processors", "exporters", "connectors"}
+
+// pipelineRoles are the component lists of a pipeline.
+var pipelineRoles = []string{"receivers", "processors", "exporters"}
+
+// ConfigChange is a change of a component or pipeline between two otel
+// configs.
+type ConfigChange struct {
+	// Section is receivers, processors, exporters, extensions, connectors
+	// or pipelines.
+	Section string
+	// Name is the component ID or the pipeline name.
+	Name   string
+	Action ConfigChangeAction
+	// Details lists the components added to (+) or removed from (-) a
+	// modified pipeline.
+	Details []string
+}
+
+// String implements the stringer interface for ConfigChange.
+func (c ConfigChange) String() string {
+	symbol := "~"
+	switch c.Action {
+	case ConfigChangeAdded:
+		symbol = "+"
+	case ConfigChangeRemoved:
+		symbol = "-"
+	}
+
+	s := fmt.Sprintf("%s %s::%s", symbol, c.Section, c.Name)
+	if len(c.Details) > 0 {
+		s += " (" + strings.Join(c.Details, ", ") + ")"
+	}
+	return s
+}
+
+// DiffOtelConfigs returns the components and pipelines added, removed or
+// modified from oldConfig to newConfig, both rendered otel configs.
+func DiffOtelConfigs(oldConfig, newConfig []byte) ([]ConfigChange, error) {
+	oldMap, err := parseRenderedConfig(oldConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse old config: %w", err)
+	}
+
+	newMap, err := parseRenderedConfig(newConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse new config: %w", err)
+	}
+
+	var changes []ConfigChange
+	for _, section := range configDiffSections {
+		changes = append(changes, diffComponents(section,
+			configSection(oldMap, section), configSection(newMap, section))...)
+	}
+
+	oldService := configSection(oldMap, "service")
+	newService := configSection(newMap, "service")
+	changes = append(changes, diffPipelines(configSection(oldService, "pipelines"),
+		configSection(newService, "pipelines"))...)
+
+	return changes, nil
+}
+
+func parseRenderedConfig(data []byte) (map[string]interface{}, error) {
+	var config map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	m, _ := normalizeYAML(config).(map[string]interface{})
+	return m, nil
+}
+
+func configSection(config map[string]interface{}, key string) map[string]interface{} {
+	section, _ := config[key].(map[string]interface{})
+	return section
+}
+
+func diffComponents(section string, oldComponents, newComponents map[string]interface{}) []ConfigChange {
+	var changes []ConfigChange
+	for _, name := range unionKeys(oldComponents, newComponents) {
+		oldComponent, inOld := oldComponents[name]
+		newComponent, inNew := newComponents[name]
+
+		switch {
+		case !inOld:
+			changes = append(changes, ConfigChange{Section: section, Name: name, Action: ConfigChangeAdded})
+		case !inNew:
+			changes = append(changes, ConfigChange{Section: section, Name: name, Action: ConfigChangeRemoved})
+		case !reflect.DeepEqual(oldComponent, newComponent):
+			changes = append(changes, ConfigChange{Section: section, Name: name, Action: ConfigChangeModified})
+		}
+	}
+	return changes
+}
+
+func diffPipelines(oldPipelines, newPipelines map[string]interface{}) []ConfigChange {
+	var changes []ConfigChange
+	for _, name := range unionKeys(oldPipelines, newPipelines) {
+		oldPipeline, inOld := oldPipelines[name].(map[string]interface{})
+		newPipeline, inNew := newPipelines[name].(map[string]interface{})
+
+		switch {
+		case !inOld:
+			changes = append(changes, ConfigChange{Section: "pipelines", Name: name, Action: ConfigChangeAdded})
+		case !inNew:
+			changes = append(changes, ConfigChange{Section: "pipelines", Name: name, Action: ConfigChangeRemoved})
+		default:
+			var details []string
+			for _, role := range pipelineRoles {
+				oldMembers := stringList(oldPipeline[role])
+				newMembers := stringList(newPipeline[role])
+				membershipChanged := false
+				for _, member := range newMembers {
+					if !containsString(oldMembers, member) {
+						details = append(details, fmt.Sprintf("+%s %s", role, member))
+						membershipChanged = true
+					}
+				}
+				for _, member := range oldMembers {
+					if !containsString(newMembers, member) {
+						details = append(details, fmt.Sprintf("-%s %s", role, member))
+						membershipChanged = true
+					}
+				}
+				// the order of processors matters
+				if !membershipChanged && !reflect.DeepEqual(oldMembers, newMembers) {
+					details = append(details, fmt.Sprintf("%s reordered", role))
+				}
+			}
+
+			if len(details) > 0 {
+				changes = append(changes, ConfigChange{Section: "pipelines", Name: name,
+					Action: ConfigChangeModified, Details: details})
+			}
+		}
+	}
+	return changes
+}
+
+func unionKeys(a, b map[string]interface{}) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func stringList(v interface{}) []string {
+	items, _ := v.([]interface{})
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		list = append(list, fmt.Sprint(item))
+	}
+	return list
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// logConfigChanges logs the changes from oldConfig to newConfig, one entry
+// per component or pipeline.
+func (c *HostAgent) logConfigChanges(oldConfig, newConfig []byte) {
+	changes, err := DiffOtelConfigs(oldConfig, newConfig)
+	if err != nil {
+		c.logger.Warn("failed to diff otel configs", zap.Error(err))
+		return
+	}
+
+	c.logger.Info("applying otel config changes", zap.Int("changes", len(changes)))
+	for _, change := range changes {
+		c.logger.Info("otel config change",
+			zap.String("section", change.Section),
+			zap.String("name", change.Name),
+			zap.String("action", string(change.Action)),
+			zap.Strings("details", change.Details))
+	}
+}
+
+// FetchOtelConfig fetches the otel config for this host from the Middleware
+// backend and renders it the same way the agent does before applying it,
+// without validating or writing it.
+func (c *HostAgent) FetchOtelConfig() ([]byte, error) {
+	return c.RenderOtelConfig(c.getConfigType())
+}
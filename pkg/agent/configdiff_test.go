@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffOtelConfigs(t *testing.T) {
+	oldConfig := []byte(`
+receivers:
+  hostmetrics:
+    collection_interval: 10s
+  docker_stats: {}
+processors:
+  batch: {}
+  memory_limiter: {}
+exporters:
+  otlp: {}
+service:
+  pipelines:
+    metrics:
+      receivers: [hostmetrics, docker_stats]
+      processors: [memory_limiter, batch]
+      exporters: [otlp]
+    traces:
+      receivers: [otlp]
+      exporters: [otlp]
+`)
+
+	newConfig := []byte(`
+receivers:
+  hostmetrics:
+    collection_interval: 30s
+  filelog: {}
+processors:
+  batch: {}
+  memory_limiter: {}
+exporters:
+  otlp: {}
+service:
+  pipelines:
+    metrics:
+      receivers: [hostmetrics]
+      processors: [batch, memory_limiter]
+      exporters: [otlp]
+    logs:
+      receivers: [filelog]
+      exporters: [otlp]
+`)
+
+	changes, err := DiffOtelConfigs(oldConfig, newConfig)
+	assert.NoError(t, err)
+
+	var lines []string
+	for _, change := range changes {
+		lines = append(lines, change.String())
+	}
+
+	assert.Equal(t, []string{
+		"- receivers::docker_stats",
+		"+ receivers::filelog",
+		"~ receivers::hostmetrics",
+		"+ pipelines::logs",
+		"~ pipelines::metrics (-receivers docker_stats, processors reordered)",
+		"- pipelines::traces",
+	}, lines)
+
+	changes, err = DiffOtelConfigs(oldConfig, oldConfig)
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+}
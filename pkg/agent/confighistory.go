@@ -0,0 +1,389 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ConfigHistoryDir is the directory inside the agent state directory
+// where applied otel configs are kept.
+const ConfigHistoryDir = "config-history"
+
+const configHistoryIndexFile = "index.json"
+
+var (
+	ErrConfigRevisionNotFound = errors.New("config revision not found")
+	ErrNoKnownGoodConfig      = errors.New("no known good config in history")
+	ErrNoPendingConfig        = errors.New("no pending config in history")
+)
+
+// ConfigRevisionStatus tells whether an applied config is known to work.
+type ConfigRevisionStatus string
+
+const (
+	// ConfigRevisionPending is a config that was written to disk but the
+	// collector has not been started with it yet.
+	ConfigRevisionPending ConfigRevisionStatus = "pending"
+	// ConfigRevisionGood is a config the collector started successfully with.
+	ConfigRevisionGood ConfigRevisionStatus = "good"
+	// ConfigRevisionBad is a config the collector failed to start with.
+	ConfigRevisionBad ConfigRevisionStatus = "bad"
+)
+
+// ConfigRevision describes one applied otel config.
+type ConfigRevision struct {
+	ID        string               `json:"id"`
+	Hash      string               `json:"hash"`
+	AppliedAt time.Time            `json:"applied_at"`
+	Status    ConfigRevisionStatus `json:"status"`
+	Reason    string               `json:"reason,omitempty"`
+}
+
+// ConfigHistory is a versioned on-disk store of the otel configs applied
+// by the agent. Every revision is kept as a separate YAML file next to
+// an index file that records its status.
+type ConfigHistory struct {
+	dir        string
+	maxEntries int
+	mu         sync.Mutex
+}
+
+// NewConfigHistory returns a config history stored in dir that keeps at
+// most maxEntries revisions. A non-positive maxEntries keeps 10 revisions.
+func NewConfigHistory(dir string, maxEntries int) *ConfigHistory {
+	if maxEntries <= 0 {
+		maxEntries = 10
+	}
+	return &ConfigHistory{
+		dir:        dir,
+		maxEntries: maxEntries,
+	}
+}
+
+// Dir returns the directory where the history is stored.
+func (h *ConfigHistory) Dir() string {
+	return h.dir
+}
+
+func (h *ConfigHistory) revisionPath(id string) string {
+	return filepath.Join(h.dir, id+".yaml")
+}
+
+func (h *ConfigHistory) load() ([]ConfigRevision, error) {
+	data, err := os.ReadFile(filepath.Join(h.dir, configHistoryIndexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []ConfigRevision{}, nil
+		}
+		return nil, fmt.Errorf("failed to read config history index: %w", err)
+	}
+
+	var revisions []ConfigRevision
+	if err := json.Unmarshal(data, &revisions); err != nil {
+		return nil, fmt.Errorf("failed to parse config history index: %w", err)
+	}
+	return revisions, nil
+}
+
+func (h *ConfigHistory) save(revisions []ConfigRevision) error {
+	data, err := json.MarshalIndent(revisions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config history index: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(h.dir, configHistoryIndexFile), data, 0600)
+}
+
+// Record stores data as the newest revision with pending status. If the
+// newest revision already has the same content, it is returned as is,
+// unless the collector failed to start with it: the content is then
+// recorded again as a new pending revision, so that it can be marked good
+// or rolled back once more.
+func (h *ConfigHistory) Record(data []byte) (ConfigRevision, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := os.MkdirAll(h.dir, 0700); err != nil {
+		return ConfigRevision{}, fmt.Errorf("failed to create config history directory %s: %w", h.dir, err)
+	}
+
+	revisions, err := h.load()
+	if err != nil {
+		return ConfigRevision{}, err
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if n := len(revisions); n > 0 && revisions[n-1].Hash == hash &&
+		revisions[n-1].Status != ConfigRevisionBad {
+		return revisions[n-1], nil
+	}
+
+	now := time.Now().UTC()
+	revision := ConfigRevision{
+		ID:        now.Format("20060102T150405.000Z") + "-" + hash[:8],
+		Hash:      hash,
+		AppliedAt: now,
+		Status:    ConfigRevisionPending,
+	}
+	// the same content recorded again within a millisecond
+	for i := 2; containsRevision(revisions, revision.ID); i++ {
+		revision.ID = fmt.Sprintf("%s-%s-%d", now.Format("20060102T150405.000Z"), hash[:8], i)
+	}
+
+	if err := writeFileAtomic(h.revisionPath(revision.ID), data, 0600); err != nil {
+		return ConfigRevision{}, fmt.Errorf("failed to write config revision %s: %w", revision.ID, err)
+	}
+
+	revisions = h.prune(append(revisions, revision))
+	if err := h.save(revisions); err != nil {
+		return ConfigRevision{}, err
+	}
+	return revision, nil
+}
+
+func containsRevision(revisions []ConfigRevision, id string) bool {
+	for _, r := range revisions {
+		if r.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// prune drops the oldest revisions beyond maxEntries. The newest good
+// revision is always kept so that a rollback target survives a series
+// of bad configs.
+func (h *ConfigHistory) prune(revisions []ConfigRevision) []ConfigRevision {
+	if len(revisions) <= h.maxEntries {
+		return revisions
+	}
+
+	lastGood := -1
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if revisions[i].Status == ConfigRevisionGood {
+			lastGood = i
+			break
+		}
+	}
+
+	drop := len(revisions) - h.maxEntries
+	kept := make([]ConfigRevision, 0, h.maxEntries+1)
+	for i, r := range revisions {
+		if i < drop && i != lastGood {
+			os.Remove(h.revisionPath(r.ID))
+			continue
+		}
+		kept = append(kept, r)
+	}
+	return kept
+}
+
+// SetStatus updates the status of the revision with the given id.
+func (h *ConfigHistory) SetStatus(id string, status ConfigRevisionStatus, reason string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	revisions, err := h.load()
+	if err != nil {
+		return err
+	}
+
+	for i := range revisions {
+		if revisions[i].ID == id {
+			revisions[i].Status = status
+			revisions[i].Reason = reason
+			return h.save(revisions)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrConfigRevisionNotFound, id)
+}
+
+// List returns all revisions, oldest first.
+func (h *ConfigHistory) List() ([]ConfigRevision, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.load()
+}
+
+// Latest returns the newest revision.
+func (h *ConfigHistory) Latest() (ConfigRevision, error) {
+	revisions, err := h.List()
+	if err != nil {
+		return ConfigRevision{}, err
+	}
+	if len(revisions) == 0 {
+		return ConfigRevision{}, ErrConfigRevisionNotFound
+	}
+	return revisions[len(revisions)-1], nil
+}
+
+// LastKnownGood returns the newest revision the collector started with.
+func (h *ConfigHistory) LastKnownGood() (ConfigRevision, error) {
+	revisions, err := h.List()
+	if err != nil {
+		return ConfigRevision{}, err
+	}
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if revisions[i].Status == ConfigRevisionGood {
+			return revisions[i], nil
+		}
+	}
+	return ConfigRevision{}, ErrNoKnownGoodConfig
+}
+
+// Get returns the revision with the given id and its content.
+func (h *ConfigHistory) Get(id string) (ConfigRevision, []byte, error) {
+	revisions, err := h.List()
+	if err != nil {
+		return ConfigRevision{}, nil, err
+	}
+	for _, r := range revisions {
+		if r.ID == id {
+			data, err := os.ReadFile(h.revisionPath(id))
+			if err != nil {
+				return ConfigRevision{}, nil, fmt.Errorf("failed to read config revision %s: %w", id, err)
+			}
+			return r, data, nil
+		}
+	}
+	return ConfigRevision{}, nil, fmt.Errorf("%w: %s", ErrConfigRevisionNotFound, id)
+}
+
+// Restore writes the content of the revision with the given id to path.
+func (h *ConfigHistory) Restore(id string, path string) (ConfigRevision, error) {
+	revision, data, err := h.Get(id)
+	if err != nil {
+		return ConfigRevision{}, err
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return ConfigRevision{}, fmt.Errorf("failed to restore config revision %s to %s: %w", id, path, err)
+	}
+	return revision, nil
+}
+
+// recordAppliedConfig stores the config written to OtelConfigFile in the
+// config history. Failures are logged since the history is best effort.
+func (c *HostAgent) recordAppliedConfig(data []byte) {
+	if c.configHistory == nil {
+		return
+	}
+
+	revision, err := c.configHistory.Record(data)
+	if err != nil {
+		c.logger.Error("failed to record applied config in history", zap.Error(err))
+		return
+	}
+	c.logger.Info("recorded applied config", zap.String("revision", revision.ID),
+		zap.String("status", string(revision.Status)))
+}
+
+// MarkConfigGood marks the newest config revision as known good. It should
+// be called once the collector has started successfully.
+func (c *HostAgent) MarkConfigGood() {
+	if c.configHistory == nil {
+		return
+	}
+
+	revision, err := c.configHistory.Latest()
+	if err != nil {
+		if !errors.Is(err, ErrConfigRevisionNotFound) {
+			c.logger.Error("failed to read config history", zap.Error(err))
+		}
+		return
+	}
+
+	if revision.Status != ConfigRevisionPending {
+		return
+	}
+
+	if err := c.configHistory.SetStatus(revision.ID, ConfigRevisionGood, ""); err != nil {
+		c.logger.Error("failed to mark config as known good", zap.Error(err))
+		return
+	}
+	c.logger.Info("marked config as known good", zap.String("revision", revision.ID))
+}
+
+// RollbackConfig marks the newest pending config revision as bad and
+// restores the last known good config to OtelConfigFile. The rollback is
+// reported to the Middleware backend through the agent tracking API.
+func (c *HostAgent) RollbackConfig(cause error) (ConfigRevision, error) {
+	if c.configHistory == nil {
+		return ConfigRevision{}, ErrNoPendingConfig
+	}
+
+	latest, err := c.configHistory.Latest()
+	if err != nil {
+		if errors.Is(err, ErrConfigRevisionNotFound) {
+			return ConfigRevision{}, ErrNoPendingConfig
+		}
+		return ConfigRevision{}, err
+	}
+
+	if latest.Status != ConfigRevisionPending {
+		return ConfigRevision{}, ErrNoPendingConfig
+	}
+
+	// the pending revision stays pending if there is nothing to roll back
+	// to or the restore fails
+	good, err := c.configHistory.LastKnownGood()
+	if err != nil {
+		return ConfigRevision{}, err
+	}
+
+	if _, err := c.configHistory.Restore(good.ID, c.OtelConfigFile); err != nil {
+		return ConfigRevision{}, err
+	}
+
+	if err := c.configHistory.SetStatus(latest.ID, ConfigRevisionBad, cause.Error()); err != nil {
+		return ConfigRevision{}, err
+	}
+	// the applied document is the one of the rolled back config, the next
+	// config check must not be answered as unchanged from it.
+	c.setAppliedDocument(backendDocument{})
+
+	c.logger.Warn("rolled back to last known good config",
+		zap.String("bad_revision", latest.ID),
+		zap.String("restored_revision", good.ID),
+		zap.Error(cause))
+
+	trackErr := c.updateAgentTrackStatus(trackStatusRollback,
+		fmt.Errorf("rolled back config %s to %s: %w", latest.ID, good.ID, cause))
+	if trackErr != nil {
+		c.logger.Error("failed to update agent track status", zap.Error(trackErr))
+	}
+
+	return good, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory
+// and renames it over path so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
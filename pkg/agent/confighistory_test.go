@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestConfigHistoryRecord(t *testing.T) {
+	history := NewConfigHistory(t.TempDir(), 3)
+
+	first, err := history.Record([]byte("receivers: {}"))
+	assert.NoError(t, err)
+	assert.Equal(t, ConfigRevisionPending, first.Status)
+
+	// recording the same content again does not create a new revision
+	same, err := history.Record([]byte("receivers: {}"))
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, same.ID)
+
+	assert.NoError(t, history.SetStatus(first.ID, ConfigRevisionGood, ""))
+
+	for _, data := range []string{"a: 1", "a: 2", "a: 3", "a: 4"} {
+		_, err := history.Record([]byte(data))
+		assert.NoError(t, err)
+	}
+
+	revisions, err := history.List()
+	assert.NoError(t, err)
+	// the last known good revision survives pruning
+	assert.Len(t, revisions, 4)
+	assert.Equal(t, first.ID, revisions[0].ID)
+
+	good, err := history.LastKnownGood()
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, good.ID)
+
+	_, data, err := history.Get(first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "receivers: {}", string(data))
+
+	_, _, err = history.Get("missing")
+	assert.True(t, errors.Is(err, ErrConfigRevisionNotFound))
+
+	// content the collector failed to start with is recorded again
+	latest, err := history.Latest()
+	assert.NoError(t, err)
+	assert.NoError(t, history.SetStatus(latest.ID, ConfigRevisionBad, "port in use"))
+	resent, err := history.Record([]byte("a: 4"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, latest.ID, resent.ID)
+	assert.Equal(t, ConfigRevisionPending, resent.Status)
+}
+
+func TestConfigHistoryLastKnownGoodEmpty(t *testing.T) {
+	history := NewConfigHistory(t.TempDir(), 0)
+
+	_, err := history.LastKnownGood()
+	assert.True(t, errors.Is(err, ErrNoKnownGoodConfig))
+
+	_, err = history.Latest()
+	assert.True(t, errors.Is(err, ErrConfigRevisionNotFound))
+}
+
+func TestRollbackConfig(t *testing.T) {
+	var payload TrackingPayload
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	dir := t.TempDir()
+	otelConfigFile := filepath.Join(dir, "otel-config.yaml")
+
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{
+			BaseConfig: BaseConfig{
+				APIKey:               "testAPIKey",
+				APIURLForConfigCheck: mockServer.URL,
+				OtelConfigFile:       otelConfigFile,
+			},
+		},
+		logger:          zap.NewNop(),
+		backendClient:   NewBackendClient(zap.NewNop()),
+		configHistory:   NewConfigHistory(filepath.Join(dir, ConfigHistoryDir), 10),
+		appliedDocument: backendDocument{ETag: `"v2"`, Hash: "f00d"},
+	}
+
+	// nothing to roll back to without a pending config
+	_, err := hostAgent.RollbackConfig(errors.New("test reason"))
+	assert.True(t, errors.Is(err, ErrNoPendingConfig))
+
+	// a pending config is not marked bad without a known good config
+	hostAgent.recordAppliedConfig([]byte("first: true"))
+	_, err = hostAgent.RollbackConfig(errors.New("test reason"))
+	assert.True(t, errors.Is(err, ErrNoKnownGoodConfig))
+	latest, err := hostAgent.configHistory.Latest()
+	assert.NoError(t, err)
+	assert.Equal(t, ConfigRevisionPending, latest.Status)
+
+	hostAgent.recordAppliedConfig([]byte("good: true"))
+	hostAgent.MarkConfigGood()
+
+	assert.NoError(t, os.WriteFile(otelConfigFile, []byte("good: false"), 0644))
+	hostAgent.recordAppliedConfig([]byte("good: false"))
+
+	revision, err := hostAgent.RollbackConfig(errors.New("port in use"))
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(otelConfigFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "good: true", string(data))
+
+	latest, err = hostAgent.configHistory.Latest()
+	assert.NoError(t, err)
+	assert.Equal(t, ConfigRevisionBad, latest.Status)
+	assert.Equal(t, "port in use", latest.Reason)
+
+	good, err := hostAgent.configHistory.LastKnownGood()
+	assert.NoError(t, err)
+	assert.Equal(t, good.ID, revision.ID)
+	assert.Empty(t, hostAgent.appliedDocument)
+
+	// the backend sends the rolled back config again
+	hostAgent.recordAppliedConfig([]byte("good: false"))
+	_, err = hostAgent.RollbackConfig(errors.New("port in use"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, trackStatusRollback, payload.Status)
+	assert.Contains(t, payload.Metadata.Reason, "port in use")
+}
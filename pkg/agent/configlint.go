@@ -0,0 +1,389 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/middleware-labs/mw-agent/pkg/secret"
+	"go.opentelemetry.io/collector/otelcol"
+	"go.uber.org/zap"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// ComponentSet selects the otel components an otel config is validated
+// against.
+type ComponentSet string
+
+const (
+	ComponentSetHost ComponentSet = "host"
+	ComponentSetKube ComponentSet = "kube"
+)
+
+// ConfigProblemSeverity tells whether a ConfigProblem makes the config
+// unusable.
+type ConfigProblemSeverity string
+
+const (
+	ConfigProblemError   ConfigProblemSeverity = "error"
+	ConfigProblemWarning ConfigProblemSeverity = "warning"
+)
+
+// ConfigProblem is an error or a lint warning found in an otel config.
+type ConfigProblem struct {
+	Severity ConfigProblemSeverity
+	// Line is the 1-based line of the problem, 0 if it is not known.
+	Line int
+	// Path is the confmap path of the value, e.g. service::pipelines::logs.
+	Path    string
+	Message string
+}
+
+// String implements the stringer interface for ConfigProblem.
+func (p ConfigProblem) String() string {
+	s := string(p.Severity)
+	if p.Line > 0 {
+		s += fmt.Sprintf(": line %d", p.Line)
+	}
+	if p.Path != "" {
+		s += ": " + p.Path
+	}
+	return s + ": " + p.Message
+}
+
+var (
+	// componentSections are the top level sections defining components.
+	componentSections = []string{"receivers", "processors", "exporters", "extensions", "connectors"}
+	pipelineTypes     = []string{"traces", "metrics", "logs", "profiles"}
+	quotedIDRegex     = regexp.MustCompile(`"([^"]+)"`)
+)
+
+// GetFactoriesForComponentSet returns the otel factories of the host agent
+// running on infraPlatform or of the kube agent.
+func GetFactoriesForComponentSet(set ComponentSet, infraPlatform InfraPlatform) (otelcol.Factories, error) {
+	switch set {
+	case ComponentSetHost:
+		hostAgent := &HostAgent{
+			HostConfig: HostConfig{
+				BaseConfig: BaseConfig{InfraPlatform: infraPlatform},
+			},
+			logger: zap.NewNop(),
+		}
+		return hostAgent.getFactories()
+	case ComponentSetKube:
+		return NewKubeAgent(KubeConfig{}).GetFactories(context.Background())
+	}
+	return otelcol.Factories{}, fmt.Errorf("unknown component set %q, expected %s or %s",
+		set, ComponentSetHost, ComponentSetKube)
+}
+
+// configLines maps the confmap paths of an otel config to their lines.
+type configLines map[string]int
+
+func parseConfigLines(data []byte) (configLines, error) {
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	lines := configLines{}
+	var walk func(node *yamlv3.Node, path string)
+	walk = func(node *yamlv3.Node, path string) {
+		switch node.Kind {
+		case yamlv3.DocumentNode:
+			for _, n := range node.Content {
+				walk(n, path)
+			}
+		case yamlv3.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				keyPath := joinConfPath(path, node.Content[i].Value)
+				lines[keyPath] = node.Content[i].Line
+				walk(node.Content[i+1], keyPath)
+			}
+		case yamlv3.SequenceNode:
+			for i, n := range node.Content {
+				itemPath := joinConfPath(path, strconv.Itoa(i))
+				lines[itemPath] = n.Line
+				walk(n, itemPath)
+			}
+		}
+	}
+	walk(&root, "")
+	return lines, nil
+}
+
+// line returns the line of path or of its closest parent.
+func (l configLines) line(path string) int {
+	for path != "" {
+		if line, ok := l[path]; ok {
+			return line
+		}
+		i := strings.LastIndex(path, "::")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
+
+// ValidateOtelConfig checks that data is an otel config that the collector
+// can run with factories. It reports unknown component types, references
+// to undefined components and schema errors.
+func ValidateOtelConfig(data []byte, factories otelcol.Factories) []ConfigProblem {
+	lines, err := parseConfigLines(data)
+	if err != nil {
+		return []ConfigProblem{{Severity: ConfigProblemError, Message: err.Error()}}
+	}
+
+	config, err := parseRenderedConfig(data)
+	if err != nil {
+		return []ConfigProblem{{Severity: ConfigProblemError, Message: err.Error()}}
+	}
+
+	problems := checkComponentTypes(config, lines, factories)
+	problems = append(problems, checkPipelineReferences(config, lines)...)
+	if len(problems) > 0 {
+		return problems
+	}
+
+	// the structure is sound, let the collector validate the settings of
+	// every component
+	if err := validateWithFactories(data, factories); err != nil {
+		problem := ConfigProblem{Severity: ConfigProblemError, Message: err.Error()}
+		for _, match := range quotedIDRegex.FindAllStringSubmatch(err.Error(), -1) {
+			for _, section := range componentSections {
+				path := joinConfPath(section, match[1])
+				if line, ok := lines[path]; ok {
+					problem.Path, problem.Line = path, line
+				}
+			}
+		}
+		problems = append(problems, problem)
+	}
+
+	return problems
+}
+
+func validateWithFactories(data []byte, factories otelcol.Factories) error {
+	// the secrets the config refers to are not needed to validate it
+	configProvider, err := otelcol.NewConfigProvider(NewConfigProviderSettings("yaml:"+string(data), nil,
+		secret.NewPlaceholderProviderFactory()))
+	if err != nil {
+		return err
+	}
+
+	cfg, err := configProvider.Get(context.Background(), factories)
+	if err != nil {
+		return err
+	}
+	return cfg.Validate()
+}
+
+func checkComponentTypes(config map[string]interface{}, lines configLines,
+	factories otelcol.Factories) []ConfigProblem {
+	known := map[string]map[string]bool{
+		"receivers":  {},
+		"processors": {},
+		"exporters":  {},
+		"extensions": {},
+		"connectors": {},
+	}
+	for t := range factories.Receivers {
+		known["receivers"][t.String()] = true
+	}
+	for t := range factories.Processors {
+		known["processors"][t.String()] = true
+	}
+	for t := range factories.Exporters {
+		known["exporters"][t.String()] = true
+	}
+	for t := range factories.Extensions {
+		known["extensions"][t.String()] = true
+	}
+	for t := range factories.Connectors {
+		known["connectors"][t.String()] = true
+	}
+
+	var problems []ConfigProblem
+	for _, section := range componentSections {
+		for _, id := range sortedKeys(configSection(config, section)) {
+			componentType, _, _ := strings.Cut(id, "/")
+			if known[section][componentType] {
+				continue
+			}
+			path := joinConfPath(section, id)
+			problems = append(problems, ConfigProblem{
+				Severity: ConfigProblemError,
+				Line:     lines.line(path),
+				Path:     path,
+				Message:  fmt.Sprintf("unknown %s type %q", strings.TrimSuffix(section, "s"), componentType),
+			})
+		}
+	}
+	return problems
+}
+
+func checkPipelineReferences(config map[string]interface{}, lines configLines) []ConfigProblem {
+	var problems []ConfigProblem
+
+	service := configSection(config, "service")
+	connectors := configSection(config, "connectors")
+
+	extensions := configSection(config, "extensions")
+	for i, id := range stringList(service["extensions"]) {
+		if _, ok := extensions[id]; !ok {
+			path := joinConfPath("service::extensions", strconv.Itoa(i))
+			problems = append(problems, ConfigProblem{
+				Severity: ConfigProblemError,
+				Line:     lines.line(path),
+				Path:     path,
+				Message:  fmt.Sprintf("extension %q is not defined", id),
+			})
+		}
+	}
+
+	pipelines := configSection(service, "pipelines")
+	for _, name := range sortedKeys(pipelines) {
+		pipelinePath := joinConfPath("service::pipelines", name)
+		pipelineType, _, _ := strings.Cut(name, "/")
+		if !containsString(pipelineTypes, pipelineType) {
+			problems = append(problems, ConfigProblem{
+				Severity: ConfigProblemError,
+				Line:     lines.line(pipelinePath),
+				Path:     pipelinePath,
+				Message:  fmt.Sprintf("unknown pipeline type %q", pipelineType),
+			})
+		}
+
+		pipeline, _ := pipelines[name].(map[string]interface{})
+		for _, role := range pipelineRoles {
+			defined := configSection(config, role)
+			for i, id := range stringList(pipeline[role]) {
+				if _, ok := defined[id]; ok {
+					continue
+				}
+				// connectors are used as exporters of one pipeline and
+				// receivers of another
+				if _, ok := connectors[id]; ok && role != "processors" {
+					continue
+				}
+				path := joinConfPath(joinConfPath(pipelinePath, role), strconv.Itoa(i))
+				problems = append(problems, ConfigProblem{
+					Severity: ConfigProblemError,
+					Line:     lines.line(path),
+					Path:     path,
+					Message:  fmt.Sprintf("%s %q is not defined", strings.TrimSuffix(role, "s"), id),
+				})
+			}
+		}
+	}
+	return problems
+}
+
+// LintOtelConfig reports otel config settings that work but go against
+// the recommended practices:
+//   - memory_limiter is not the first processor of a pipeline,
+//   - batch is not the last processor of a pipeline, i.e. just before its
+//     exporters,
+//   - a receiver listens on all interfaces (0.0.0.0),
+//   - the debug exporter uses detailed verbosity.
+func LintOtelConfig(data []byte) []ConfigProblem {
+	lines, err := parseConfigLines(data)
+	if err != nil {
+		return []ConfigProblem{{Severity: ConfigProblemError, Message: err.Error()}}
+	}
+
+	config, err := parseRenderedConfig(data)
+	if err != nil {
+		return []ConfigProblem{{Severity: ConfigProblemError, Message: err.Error()}}
+	}
+
+	var problems []ConfigProblem
+	warn := func(path, message string) {
+		problems = append(problems, ConfigProblem{
+			Severity: ConfigProblemWarning,
+			Line:     lines.line(path),
+			Path:     path,
+			Message:  message,
+		})
+	}
+
+	pipelines := configSection(configSection(config, "service"), "pipelines")
+	for _, name := range sortedKeys(pipelines) {
+		pipeline, _ := pipelines[name].(map[string]interface{})
+		processorsPath := joinConfPath(joinConfPath("service::pipelines", name), "processors")
+		processors := stringList(pipeline["processors"])
+
+		batchIndex := -1
+		for i, id := range processors {
+			componentType, _, _ := strings.Cut(id, "/")
+			switch componentType {
+			case "memory_limiter":
+				if i != 0 {
+					warn(joinConfPath(processorsPath, strconv.Itoa(i)),
+						"memory_limiter should be the first processor of the pipeline")
+				}
+			case "batch":
+				batchIndex = i
+			}
+		}
+		switch {
+		case batchIndex == -1 && len(stringList(pipeline["exporters"])) > 0:
+			warn(joinConfPath("service::pipelines", name),
+				"pipeline has no batch processor before its exporters")
+		case batchIndex != -1 && batchIndex != len(processors)-1:
+			warn(joinConfPath(processorsPath, strconv.Itoa(batchIndex)),
+				"batch should be the last processor of the pipeline")
+		}
+	}
+
+	receivers := configSection(config, "receivers")
+	for _, id := range sortedKeys(receivers) {
+		walkConfigValues(receivers[id], joinConfPath("receivers", id), func(path string, v interface{}) {
+			if s, ok := v.(string); ok && strings.HasPrefix(s, "0.0.0.0") {
+				warn(path, fmt.Sprintf("receiver listens on all interfaces (%s), "+
+					"bind it to localhost unless it must be reachable from other hosts", s))
+			}
+		})
+	}
+
+	exporters := configSection(config, "exporters")
+	for _, id := range sortedKeys(exporters) {
+		componentType, _, _ := strings.Cut(id, "/")
+		exporter, _ := exporters[id].(map[string]interface{})
+		if componentType == "debug" && exporter["verbosity"] == "detailed" {
+			warn(joinConfPath(joinConfPath("exporters", id), "verbosity"),
+				"debug exporter with detailed verbosity logs every item, use basic or normal")
+		}
+	}
+
+	return problems
+}
+
+func walkConfigValues(v interface{}, path string, fn func(path string, v interface{})) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedKeys(v) {
+			walkConfigValues(v[k], joinConfPath(path, k), fn)
+		}
+	case []interface{}:
+		for i, item := range v {
+			walkConfigValues(item, joinConfPath(path, strconv.Itoa(i)), fn)
+		}
+	default:
+		fn(path, v)
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
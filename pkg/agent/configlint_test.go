@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/exporter"
+	"go.opentelemetry.io/collector/otelcol"
+	"go.opentelemetry.io/collector/processor"
+	"go.opentelemetry.io/collector/receiver"
+)
+
+func TestValidateOtelConfig(t *testing.T) {
+	factories := otelcol.Factories{
+		Receivers: map[component.Type]receiver.Factory{
+			component.MustNewType("otlp"): nil,
+		},
+		Processors: map[component.Type]processor.Factory{
+			component.MustNewType("batch"): nil,
+		},
+		Exporters: map[component.Type]exporter.Factory{
+			component.MustNewType("otlp"): nil,
+		},
+	}
+
+	problems := ValidateOtelConfig([]byte(`receivers:
+  otlp: {}
+  hostmetrics/disk: {}
+processors:
+  batch: {}
+exporters:
+  otlp: {}
+service:
+  extensions: [health_check]
+  pipelines:
+    metrics:
+      receivers: [otlp, hostmetrics/disk]
+      processors: [batch, memory_limiter]
+      exporters: [otlp]
+    spans:
+      receivers: [otlp]
+      exporters: [otlp]
+`), factories)
+
+	var lines []string
+	for _, problem := range problems {
+		lines = append(lines, problem.String())
+	}
+
+	assert.Equal(t, []string{
+		`error: line 3: receivers::hostmetrics/disk: unknown receiver type "hostmetrics"`,
+		`error: line 9: service::extensions::0: extension "health_check" is not defined`,
+		`error: line 13: service::pipelines::metrics::processors::1: processor "memory_limiter" is not defined`,
+		`error: line 15: service::pipelines::spans: unknown pipeline type "spans"`,
+	}, lines)
+
+	problems = ValidateOtelConfig([]byte("receivers: [otlp"), factories)
+	assert.Len(t, problems, 1)
+	assert.Equal(t, ConfigProblemError, problems[0].Severity)
+}
+
+func TestLintOtelConfig(t *testing.T) {
+	problems := LintOtelConfig([]byte(`receivers:
+  otlp:
+    protocols:
+      grpc:
+        endpoint: 0.0.0.0:4317
+      http:
+        endpoint: localhost:4318
+processors:
+  batch: {}
+  memory_limiter: {}
+exporters:
+  debug:
+    verbosity: detailed
+  otlp: {}
+service:
+  pipelines:
+    metrics:
+      receivers: [otlp]
+      processors: [batch, memory_limiter]
+      exporters: [otlp]
+    logs:
+      receivers: [otlp]
+      processors: [memory_limiter]
+      exporters: [debug]
+`))
+
+	var lines []string
+	for _, problem := range problems {
+		lines = append(lines, problem.String())
+	}
+
+	assert.Equal(t, []string{
+		"warning: line 21: service::pipelines::logs: pipeline has no batch processor before its exporters",
+		"warning: line 19: service::pipelines::metrics::processors::1: memory_limiter should be the first processor of the pipeline",
+		"warning: line 19: service::pipelines::metrics::processors::0: batch should be the last processor of the pipeline",
+		"warning: line 5: receivers::otlp::protocols::grpc::endpoint: receiver listens on all interfaces (0.0.0.0:4317), " +
+			"bind it to localhost unless it must be reachable from other hosts",
+		"warning: line 13: exporters::debug::verbosity: debug exporter with detailed verbosity logs every item, use basic or normal",
+	}, lines)
+}
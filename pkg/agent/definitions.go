@@ -12,6 +12,9 @@ import (
 	"time"
 
 	"github.com/grafana/pyroscope-go"
+	"github.com/middleware-labs/mw-agent/pkg/redact"
+	"github.com/middleware-labs/mw-agent/pkg/secret"
+	"github.com/middleware-labs/mw-agent/pkg/transport"
 	"go.opentelemetry.io/collector/otelcol"
 	"go.uber.org/zap"
 )
@@ -28,10 +31,13 @@ type Agent interface {
 const (
 	Receivers              = "receivers"
 	Processors             = "processors"
+	Exporters              = "exporters"
+	Extensions             = "extensions"
 	AWSECSContainerMetrics = "awsecscontainermetrics"
 	Service                = "service"
 	Pipelines              = "pipelines"
 	Metrics                = "metrics"
+	Logs                   = "logs"
 )
 
 var (
@@ -74,12 +80,27 @@ func (p InfraPlatform) String() string {
 	return "unknown"
 }
 
+// ParseInfraPlatform returns the InfraPlatform named s, as returned by
+// InfraPlatform.String.
+func ParseInfraPlatform(s string) (InfraPlatform, error) {
+	for _, p := range []InfraPlatform{InfraPlatformInstance, InfraPlatformKubernetes,
+		InfraPlatformECSEC2, InfraPlatformECSFargate, InfraPlatformCycleIO, InfraPlatformEC2} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return InfraPlatformInstance, fmt.Errorf("unknown infra platform %q", s)
+}
+
 type AgentFeatures struct {
 	MetricCollection    bool
 	LogCollection       bool
 	SyntheticMonitoring bool
 	OpsAIAutoFix        bool
 	ServiceReporting    bool
+	// IntegrationAutodiscovery scrapes the integrations discovered on the
+	// host without an integration config.
+	IntegrationAutodiscovery bool
 }
 
 // BaseConfig stores general configuration for all agent types
@@ -93,7 +114,9 @@ type OpsAI struct {
 }
 
 type BaseConfig struct {
-	APIKey                    string
+	APIKey string
+	// APIKeyFile is a file holding the API key, exclusive with APIKey.
+	APIKeyFile                string
 	Target                    string
 	DaemonsetName             string
 	DeploymentName            string
@@ -116,12 +139,71 @@ type BaseConfig struct {
 	EnableDataDogReceiver bool
 	EnableInjector        bool
 	ServiceReportInterval string
+	// SelfMetricsPort is the port the self metrics of the agent are served
+	// on. 0 disables serving them.
+	SelfMetricsPort uint
+	// TLS applies to the control-plane calls and to the otlp and otlphttp
+	// exporters of the rendered otel config.
+	TLS transport.TLSConfig
+	// Proxy applies to the control-plane calls, the synthetics worker, the
+	// profiler and the otlp and otlphttp exporters of the rendered otel
+	// config.
+	Proxy transport.ProxyConfig
+	// SecretsDir holds the secrets referred to as ${secret:NAME} by the
+	// agent config, the otel config and the integration YAML files.
+	SecretsDir string
+	// SecretKeyFile holds the key decrypting the encrypted values of the
+	// configs.
+	SecretKeyFile string
+}
+
+// SecretResolver returns the resolver of the secret references of the
+// configs of the agent.
+func (c BaseConfig) SecretResolver() secret.Resolver {
+	return secret.Resolver{
+		Dir:     c.SecretsDir,
+		KeyFile: c.SecretKeyFile,
+	}
+}
+
+// ResolveSecrets reads the API key from APIKeyFile and replaces the secret
+// references of the API key and of the proxy settings with the secrets
+// they refer to. The API key is masked in the logs from then on. logger is
+// warned about the secrets too short to be masked.
+func (c *BaseConfig) ResolveSecrets(logger *zap.Logger) error {
+	resolver := c.SecretResolver()
+	resolver.Logger = logger
+
+	if c.APIKeyFile != "" {
+		if c.APIKey != "" {
+			return fmt.Errorf("%w: api-key and api-key-file are mutually exclusive", secret.ErrInvalidSecret)
+		}
+
+		apiKey, err := resolver.File(c.APIKeyFile)
+		if err != nil {
+			return fmt.Errorf("api-key-file: %w", err)
+		}
+		c.APIKey = apiKey
+	}
+
+	err := resolver.ResolveFields(
+		secret.Field{Name: "api-key", Value: &c.APIKey},
+		secret.Field{Name: "proxy.url", Value: &c.Proxy.URL},
+		secret.Field{Name: "proxy.username", Value: &c.Proxy.Username},
+		secret.Field{Name: "proxy.password", Value: &c.Proxy.Password},
+	)
+	if err != nil {
+		return err
+	}
+
+	redact.Add(c.APIKey)
+	return nil
 }
 
 // String() implements stringer interface for BaseConfig
 func (c BaseConfig) String() string {
 	var s string
-	s += fmt.Sprintf("api-key: %s, ", c.APIKey)
+	s += fmt.Sprintf("api-key: %s, ", redact.Secret(c.APIKey))
 	s += fmt.Sprintf("target: %s, ", c.Target)
 	s += fmt.Sprintf("enable-synthetic-monitoring: %t, ", c.EnableSyntheticMonitoring)
 	s += fmt.Sprintf("config-check-interval: %s, ", c.ConfigCheckInterval)
@@ -130,17 +212,46 @@ func (c BaseConfig) String() string {
 	s += fmt.Sprintf("infra-platform: %s, ", c.InfraPlatform)
 	s += fmt.Sprintf("agent-features: %#v, ", c.AgentFeatures)
 	s += fmt.Sprintf("fluent-port: %#v, ", c.FluentPort)
-	return s
+	s += fmt.Sprintf("tls: {%s}, ", c.TLS)
+	s += fmt.Sprintf("proxy: {%s}, ", c.Proxy)
+	s += fmt.Sprintf("api-key-file: %s, ", c.APIKeyFile)
+	s += fmt.Sprintf("secrets-dir: %s, ", c.SecretsDir)
+	s += fmt.Sprintf("secret-key-file: %s, ", c.SecretKeyFile)
+	return redact.String(s)
 }
 
 // HostConfig stores configuration for all the host agent
 type HostConfig struct {
 	BaseConfig
 
-	HostTags     string
-	Logfile      string
-	LogfileSize  int
-	LoggingLevel string
+	HostTags          string
+	Logfile           string
+	LogfileSize       int
+	LoggingLevel      string
+	StateDir          string
+	ConfigHistorySize int
+	// OnControlPlaneError is the ControlPlaneErrorPolicy, keep-running or
+	// stop.
+	OnControlPlaneError string
+	// OfflineMode builds the otel config from the fragments in ConfDir
+	// instead of fetching it from the Middleware backend.
+	OfflineMode bool
+	ConfDir     string
+	// LocalOverlay is a YAML file deep-merged into the otel config from
+	// the Middleware backend.
+	LocalOverlay string
+	// StatusAddress is where the status API is served, a unix socket
+	// (unix:/path) or a loopback address. Empty disables the status API.
+	StatusAddress string
+	// ShutdownTimeout bounds how long the collector may take to drain its
+	// exporter queues when it is stopped, e.g. 30s.
+	ShutdownTimeout string
+	// BufferDir is the directory of the persistent exporter queues. The
+	// queues are kept in memory unless BufferDir and BufferMaxSize are set.
+	BufferDir string
+	// BufferMaxSize is the maximum size of the persistent exporter queues
+	// in MiB, shared by all the exporters.
+	BufferMaxSize int
 }
 
 // String() implements stringer interface for HostConfig
@@ -148,8 +259,18 @@ func (h HostConfig) String() string {
 	s := h.BaseConfig.String()
 	s += fmt.Sprintf("host-tags: %s, ", h.HostTags)
 	s += fmt.Sprintf("logfile: %s, ", h.Logfile)
-	s += fmt.Sprintf("logfile-size: %d", h.LogfileSize)
-	return s
+	s += fmt.Sprintf("logfile-size: %d, ", h.LogfileSize)
+	s += fmt.Sprintf("state-dir: %s, ", h.StateDir)
+	s += fmt.Sprintf("config-history-size: %d, ", h.ConfigHistorySize)
+	s += fmt.Sprintf("on-control-plane-error: %s, ", h.OnControlPlaneError)
+	s += fmt.Sprintf("offline-mode: %t, ", h.OfflineMode)
+	s += fmt.Sprintf("conf-dir: %s, ", h.ConfDir)
+	s += fmt.Sprintf("local-overlay: %s, ", h.LocalOverlay)
+	s += fmt.Sprintf("status-address: %s, ", h.StatusAddress)
+	s += fmt.Sprintf("shutdown-timeout: %s, ", h.ShutdownTimeout)
+	s += fmt.Sprintf("buffer-dir: %s, ", h.BufferDir)
+	s += fmt.Sprintf("buffer-max-size: %d", h.BufferMaxSize)
+	return redact.String(s)
 }
 
 // KubeConfig stores configuration for all the host agent
@@ -214,6 +335,14 @@ func WithKubeAgentMonitorDeploymentConfigMap(v string) KubeAgentMonitorOptions {
 	}
 }
 
+// WithKubeAgentMonitorHTTPClient sets the client of the calls to the
+// Middleware backend
+func WithKubeAgentMonitorHTTPClient(client *http.Client) KubeAgentMonitorOptions {
+	return func(k *KubeAgentMonitor) {
+		k.httpClient = client
+	}
+}
+
 // String() implements stringer interface for KubeConfig
 func (k KubeConfig) String() string {
 	s := k.BaseConfig.String()
@@ -367,6 +496,9 @@ func HasValidTags(tags string) error {
 type Profiler struct {
 	Logger        *zap.Logger
 	ServerAddress string
+	// HTTPClient uploads the profiles when set, e.g. to go through the
+	// proxy and TLS settings of the agent.
+	HTTPClient *http.Client
 }
 
 func NewProfiler(logger *zap.Logger, serverAddress string) *Profiler {
@@ -410,6 +542,10 @@ func (p *Profiler) StartProfiling(appName string, target string, tags string) {
 		config.Tags = map[string]string{tags: tags}
 	}
 
+	if p.HTTPClient != nil {
+		config.HTTPClient = p.HTTPClient
+	}
+
 	_, err = pyroscope.Start(config)
 
 	if err != nil {
@@ -1,9 +1,14 @@
 package agent
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/middleware-labs/mw-agent/pkg/secret"
+	"github.com/middleware-labs/mw-agent/pkg/transport"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 func TestGetAPIURLForConfigCheck(t *testing.T) {
@@ -149,3 +154,42 @@ func TestWithKubeAgentMonitorDeploymentConfigMap(t *testing.T) {
 		t.Errorf("Expected deployment configmap name %s, got %s", expected, kubeAgentMonitor.DeploymentConfigMap)
 	}
 }
+
+func TestParseInfraPlatform(t *testing.T) {
+	for _, p := range []InfraPlatform{InfraPlatformInstance, InfraPlatformKubernetes,
+		InfraPlatformECSEC2, InfraPlatformECSFargate, InfraPlatformCycleIO, InfraPlatformEC2} {
+		parsed, err := ParseInfraPlatform(p.String())
+		assert.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+
+	_, err := ParseInfraPlatform("mainframe")
+	assert.Error(t, err)
+}
+
+func TestResolveSecrets(t *testing.T) {
+	dir := t.TempDir()
+	apiKeyFile := filepath.Join(dir, "api-key")
+	assert.NoError(t, os.WriteFile(apiKeyFile, []byte("9a8b7c6d5e4f3a2b1c0d\n"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "proxy-password"), []byte("pr0xy-pass"), 0600))
+
+	cfg := BaseConfig{
+		APIKeyFile: apiKeyFile,
+		SecretsDir: dir,
+		Proxy: transport.ProxyConfig{
+			URL:      "http://proxy.internal:3128",
+			Username: "agent",
+			Password: "${secret:proxy-password}",
+		},
+	}
+	assert.NoError(t, cfg.ResolveSecrets(zap.NewNop()))
+	assert.Equal(t, "9a8b7c6d5e4f3a2b1c0d", cfg.APIKey)
+	assert.Equal(t, "pr0xy-pass", cfg.Proxy.Password)
+
+	s := HostConfig{BaseConfig: cfg, HostTags: "password:pr0xy-pass"}.String()
+	assert.NotContains(t, s, "9a8b7c6d5e4f3a2b1c0d")
+	assert.NotContains(t, s, "pr0xy-pass")
+
+	// api-key and api-key-file are exclusive
+	assert.ErrorIs(t, cfg.ResolveSecrets(zap.NewNop()), secret.ErrInvalidSecret)
+}
@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidEndpoint = errors.New("invalid integration endpoint")
+)
+
+// hostnameRegex matches the host names of RFC 1123, with underscores in
+// their labels as in the names of docker compose services, e.g. my_db.
+var hostnameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?` +
+	`(\.[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?)*\.?$`)
+
+// Schemes of the integration endpoints. An endpoint without a scheme is a
+// TCP endpoint, e.g. db.internal:5432.
+const (
+	endpointSchemeTCP   = "tcp"
+	endpointSchemeTLS   = "tls"
+	endpointSchemeHTTP  = "http"
+	endpointSchemeHTTPS = "https"
+	endpointSchemeUnix  = "unix"
+)
+
+// integrationEndpoint is the endpoint of an integration instance, parsed by
+// parseEndpoint.
+type integrationEndpoint struct {
+	// Scheme is the scheme of the endpoint, empty if it has none.
+	Scheme string
+	// Host is a host name or an IP address, without the brackets of the
+	// IPv6 addresses.
+	Host string
+	Port int
+	// Path is the path of the URL endpoints, or the path of the unix
+	// socket.
+	Path string
+}
+
+// parseEndpoint parses and validates the endpoint of an integration
+// instance:
+//   - host:port, where host is a host name, an IPv4 address or an IPv6
+//     address in brackets, e.g. db.internal:5432 or [::1]:6379,
+//   - tcp://host:port, or tls://host:port for TLS,
+//   - http://host[:port][/path] or https://host[:port][/path],
+//   - unix:///path/to/socket or unix:/path/to/socket.
+func parseEndpoint(endpoint string) (integrationEndpoint, error) {
+	if endpoint == "" {
+		return integrationEndpoint{}, fmt.Errorf("%w: empty endpoint", ErrInvalidEndpoint)
+	}
+
+	if !strings.Contains(endpoint, "://") && !strings.HasPrefix(endpoint, endpointSchemeUnix+":") {
+		host, port, err := parseHostPort(endpoint, false)
+		if err != nil {
+			return integrationEndpoint{}, fmt.Errorf("%w: %s: %v", ErrInvalidEndpoint, endpoint, err)
+		}
+		return integrationEndpoint{Host: host, Port: port}, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return integrationEndpoint{}, fmt.Errorf("%w: %v", ErrInvalidEndpoint, err)
+	}
+
+	ep := integrationEndpoint{Scheme: strings.ToLower(u.Scheme)}
+	switch ep.Scheme {
+	case endpointSchemeUnix:
+		ep.Path = u.Path
+		if ep.Path == "" {
+			ep.Path = u.Opaque
+		}
+		if u.Host != "" || !strings.HasPrefix(ep.Path, "/") {
+			return integrationEndpoint{}, fmt.Errorf("%w: %s: expected unix:///path/to/socket",
+				ErrInvalidEndpoint, endpoint)
+		}
+		return ep, nil
+	case endpointSchemeTCP, endpointSchemeTLS:
+		if u.Path != "" && u.Path != "/" {
+			return integrationEndpoint{}, fmt.Errorf("%w: %s: unexpected path", ErrInvalidEndpoint, endpoint)
+		}
+		ep.Host, ep.Port, err = parseHostPort(u.Host, false)
+	case endpointSchemeHTTP, endpointSchemeHTTPS:
+		ep.Path = u.RequestURI()
+		if ep.Path == "/" {
+			ep.Path = ""
+		}
+		ep.Host, ep.Port, err = parseHostPort(u.Host, true)
+	default:
+		return integrationEndpoint{}, fmt.Errorf("%w: %s: unsupported scheme %q", ErrInvalidEndpoint, endpoint, u.Scheme)
+	}
+	if err != nil {
+		return integrationEndpoint{}, fmt.Errorf("%w: %s: %v", ErrInvalidEndpoint, endpoint, err)
+	}
+	return ep, nil
+}
+
+// parseHostPort parses host:port. The port is optional if portOptional is
+// set, and is then 0 if missing.
+func parseHostPort(hostPort string, portOptional bool) (string, int, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		if !portOptional {
+			return "", 0, err
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(hostPort, "["), "]")
+		port = ""
+	}
+
+	if ip := net.ParseIP(host); ip == nil && !hostnameRegex.MatchString(host) {
+		return "", 0, fmt.Errorf("invalid host %q", host)
+	}
+
+	if port == "" {
+		if !portOptional {
+			return "", 0, errors.New("missing port")
+		}
+		return host, 0, nil
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", port)
+	}
+	return host, portNumber, nil
+}
+
+// TLS returns true if the endpoint is to be reached over TLS.
+func (ep integrationEndpoint) TLS() bool {
+	return ep.Scheme == endpointSchemeTLS || ep.Scheme == endpointSchemeHTTPS
+}
+
+// IsUnix returns true if the endpoint is a unix socket.
+func (ep integrationEndpoint) IsUnix() bool {
+	return ep.Scheme == endpointSchemeUnix
+}
+
+// Address returns the host:port of the endpoint, with the IPv6 addresses in
+// brackets.
+func (ep integrationEndpoint) Address() string {
+	if ep.Port == 0 {
+		if strings.Contains(ep.Host, ":") {
+			return "[" + ep.Host + "]"
+		}
+		return ep.Host
+	}
+	return net.JoinHostPort(ep.Host, strconv.Itoa(ep.Port))
+}
+
+// URL returns the http or https URL of the endpoint, with defaultPath as
+// path if the endpoint has none.
+func (ep integrationEndpoint) URL(defaultPath string) string {
+	scheme := endpointSchemeHTTP
+	if ep.TLS() {
+		scheme = endpointSchemeHTTPS
+	}
+
+	path := ep.Path
+	if path == "" {
+		path = defaultPath
+	}
+	return scheme + "://" + ep.Address() + path
+}
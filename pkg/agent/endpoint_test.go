@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		expected integrationEndpoint
+	}{
+		{"127.0.0.1:5432", integrationEndpoint{Host: "127.0.0.1", Port: 5432}},
+		{"localhost:6379", integrationEndpoint{Host: "localhost", Port: 6379}},
+		{"db.internal:5432", integrationEndpoint{Host: "db.internal", Port: 5432}},
+		{"my_db:5432", integrationEndpoint{Host: "my_db", Port: 5432}},
+		{"tcp://_pg.db_internal:5432", integrationEndpoint{Scheme: "tcp", Host: "_pg.db_internal", Port: 5432}},
+		{"[::1]:6379", integrationEndpoint{Host: "::1", Port: 6379}},
+		{"tls://redis-1.cache.internal:6380", integrationEndpoint{Scheme: "tls", Host: "redis-1.cache.internal", Port: 6380}},
+		{"tcp://[fd00::5]:3306", integrationEndpoint{Scheme: "tcp", Host: "fd00::5", Port: 3306}},
+		{"https://es.internal", integrationEndpoint{Scheme: "https", Host: "es.internal"}},
+		{"http://127.0.0.1:8080/nginx_status", integrationEndpoint{Scheme: "http", Host: "127.0.0.1", Port: 8080, Path: "/nginx_status"}},
+		{"unix:///var/run/redis/redis.sock", integrationEndpoint{Scheme: "unix", Path: "/var/run/redis/redis.sock"}},
+		{"unix:/var/run/mysqld/mysqld.sock", integrationEndpoint{Scheme: "unix", Path: "/var/run/mysqld/mysqld.sock"}},
+	}
+	for _, test := range tests {
+		ep, err := parseEndpoint(test.endpoint)
+		assert.NoError(t, err, test.endpoint)
+		assert.Equal(t, test.expected, ep)
+	}
+
+	for _, endpoint := range []string{
+		"",
+		"clickhouse",
+		"127.0.0.1",
+		"127.0.0.1:0",
+		"127.0.0.1:65536",
+		"::1:6379",
+		"db internal:5432",
+		"-db.internal:5432",
+		"ftp://db.internal:21",
+		"tcp://db.internal:5432/orders",
+		"unix:relative.sock",
+		"unix://host/var/run/redis.sock",
+	} {
+		_, err := parseEndpoint(endpoint)
+		assert.ErrorIs(t, err, ErrInvalidEndpoint, endpoint)
+	}
+}
+
+func TestIntegrationEndpointURL(t *testing.T) {
+	ep, err := parseEndpoint("[::1]:9200")
+	assert.NoError(t, err)
+	assert.Equal(t, "[::1]:9200", ep.Address())
+	assert.Equal(t, "http://[::1]:9200", ep.URL(""))
+
+	ep, err = parseEndpoint("tls://rabbitmq.internal:15671")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://rabbitmq.internal:15671/api", ep.URL("/api"))
+
+	ep, err = parseEndpoint("https://apache.internal/status?auto")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://apache.internal/status?auto", ep.URL("/server-status?auto"))
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrControlPlane matches errors talking to the Middleware backend,
+	// e.g. checking for config changes or fetching the otel config. They
+	// do not affect the telemetry the collector is already sending.
+	ErrControlPlane = errors.New("control plane error")
+	// ErrDataPlane matches errors of the collector itself, e.g. when it
+	// fails to start its pipelines.
+	ErrDataPlane = errors.New("data plane error")
+
+	ErrInvalidControlPlaneErrorPolicy = errors.New("invalid on-control-plane-error policy")
+)
+
+// ControlPlaneError wraps an error talking to the Middleware backend so
+// that it matches ErrControlPlane.
+type ControlPlaneError struct {
+	Err error
+}
+
+func (e *ControlPlaneError) Error() string { return e.Err.Error() }
+
+func (e *ControlPlaneError) Unwrap() error { return e.Err }
+
+// Is reports whether target is ErrControlPlane.
+func (e *ControlPlaneError) Is(target error) bool { return target == ErrControlPlane }
+
+// DataPlaneError wraps an error of the collector so that it matches
+// ErrDataPlane.
+type DataPlaneError struct {
+	Err error
+}
+
+func (e *DataPlaneError) Error() string { return e.Err.Error() }
+
+func (e *DataPlaneError) Unwrap() error { return e.Err }
+
+// Is reports whether target is ErrDataPlane.
+func (e *DataPlaneError) Is(target error) bool { return target == ErrDataPlane }
+
+func newControlPlaneError(err error) error {
+	if err == nil || errors.Is(err, ErrControlPlane) {
+		return err
+	}
+	return &ControlPlaneError{Err: err}
+}
+
+func newDataPlaneError(err error) error {
+	if err == nil || errors.Is(err, ErrDataPlane) {
+		return err
+	}
+	return &DataPlaneError{Err: err}
+}
+
+// ControlPlaneErrorPolicy tells the agent what to do with the collector
+// when the Middleware backend can not be reached.
+type ControlPlaneErrorPolicy string
+
+const (
+	// ControlPlaneErrorKeepRunning keeps the collector running with the
+	// last applied config.
+	ControlPlaneErrorKeepRunning ControlPlaneErrorPolicy = "keep-running"
+	// ControlPlaneErrorStop stops the collector until the backend can be
+	// reached again.
+	ControlPlaneErrorStop ControlPlaneErrorPolicy = "stop"
+)
+
+// ControlPlaneErrorPolicy returns the policy applied when the Middleware
+// backend can not be reached.
+func (c *HostAgent) ControlPlaneErrorPolicy() ControlPlaneErrorPolicy {
+	return c.controlPlanePolicy
+}
+
+// ParseControlPlaneErrorPolicy parses s into a ControlPlaneErrorPolicy. An
+// empty string defaults to ControlPlaneErrorKeepRunning.
+func ParseControlPlaneErrorPolicy(s string) (ControlPlaneErrorPolicy, error) {
+	switch ControlPlaneErrorPolicy(s) {
+	case "", ControlPlaneErrorKeepRunning:
+		return ControlPlaneErrorKeepRunning, nil
+	case ControlPlaneErrorStop:
+		return ControlPlaneErrorStop, nil
+	}
+	return "", fmt.Errorf("%w %q, expected %s or %s", ErrInvalidControlPlaneErrorPolicy, s,
+		ControlPlaneErrorKeepRunning, ControlPlaneErrorStop)
+}
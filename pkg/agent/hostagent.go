@@ -2,7 +2,10 @@ package agent
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,20 +14,22 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/middleware-labs/mw-agent/pkg/otelconfig"
+	"github.com/middleware-labs/mw-agent/pkg/redact"
+	"github.com/middleware-labs/mw-agent/pkg/secret"
+	"github.com/middleware-labs/mw-agent/pkg/transport"
 	"github.com/middleware-labs/mw-injector/pkg/otelinject"
 	"go.opentelemetry.io/collector/component"
-	"go.opentelemetry.io/collector/confmap"
-	"go.opentelemetry.io/collector/confmap/provider/envprovider"
-	"go.opentelemetry.io/collector/confmap/provider/fileprovider"
-	"go.opentelemetry.io/collector/confmap/provider/yamlprovider"
 	"go.opentelemetry.io/collector/featuregate"
 	"go.opentelemetry.io/collector/otelcol"
+	"go.opentelemetry.io/otel/metric"
 	"go.uber.org/zap"
 	"go.uber.org/zap/exp/zapslog"
 	"go.uber.org/zap/zapcore"
@@ -39,21 +44,66 @@ var (
 	// (network, parsing, provider errors) as opposed to ErrInvalidConfig, which
 	// is a config that was successfully built but fails schema validation.
 	ErrConfigFetchFailure = errors.New("failed to fetch or build otel config")
+	// ErrCollectorStartFailure is returned when the collector exits or
+	// fails while it is starting its pipelines.
+	ErrCollectorStartFailure = errors.New("collector failed to start")
+	// ErrConfigUnchanged is returned when the otel config from the backend
+	// is the same as the config the agent is already running with.
+	ErrConfigUnchanged = errors.New("otel config unchanged")
+	// ErrCollectorStillRunning is returned by StartCollector when the
+	// previous collector did not exit after it was stopped.
+	ErrCollectorStillRunning = errors.New("previous collector is still running")
 )
 
+// collectorStartTimeout bounds how long StartCollector waits for the
+// collector to report that its pipelines are running.
+var collectorStartTimeout = 30 * time.Second
+
+// defaultShutdownTimeout is used if HostConfig.ShutdownTimeout is empty.
+const defaultShutdownTimeout = 30 * time.Second
+
 // HostAgent implements Agent interface for Hosts (e.g Linux)
 type HostAgent struct {
 	HostConfig
 	configCheckDuration time.Duration
+	shutdownTimeout     time.Duration
 	collectorFactories  otelcol.Factories
 	collectorSettings   otelcol.CollectorSettings
-	collector           *otelcol.Collector
-	collectorWG         *sync.WaitGroup
-	zapCore             zapcore.Core
-	logger              *zap.Logger
-	httpGetFunc         func(url string) (resp *http.Response, err error)
-	Version             string
-	applyConfigOnce     sync.Once
+	// collector, collectorExited and collectorStopping are guarded by
+	// collectorMu, the run goroutine of the collector clears collector when
+	// it crashes.
+	collector   *otelcol.Collector
+	collectorMu sync.Mutex
+	// collectorExited is closed when the Run function of collector returns.
+	collectorExited chan struct{}
+	collectorDone   chan error
+	// collectorStopping is set when collector was stopped but did not exit
+	// within shutdownTimeout.
+	collectorStopping  bool
+	reloadProvider     *ReloadProvider
+	zapCore            zapcore.Core
+	logger             *zap.Logger
+	backendClient      *BackendClient
+	Version            string
+	applyConfigOnce    sync.Once
+	configHistory      *ConfigHistory
+	controlPlanePolicy ControlPlaneErrorPolicy
+	// appliedDocument is the ingestion rules response the applied otel
+	// config was built from, guarded by appliedDocumentMu.
+	appliedDocument   backendDocument
+	appliedDocumentMu sync.Mutex
+	// appliedOverlayHash is the hash of the local overlay merged into the
+	// applied otel config.
+	appliedOverlayHash string
+	// refreshCh triggers a config check in ListenForConfigChanges.
+	refreshCh     chan struct{}
+	logLevel      *zap.AtomicLevel
+	statusMu      sync.Mutex
+	runtimeStatus runtimeStatus
+	meter         metric.Meter
+	metrics       *hostAgentMetrics
+	// collectorStarts counts the successful StartCollector calls.
+	collectorStarts int
 }
 
 // HostOptions takes in various options for HostAgent
@@ -73,6 +123,21 @@ func WithHostAgentZapCore(zapCore zapcore.Core) HostOptions {
 	}
 }
 
+// WithHostAgentMeter records the self metrics of the agent through meter.
+func WithHostAgentMeter(meter metric.Meter) HostOptions {
+	return func(h *HostAgent) {
+		h.meter = meter
+	}
+}
+
+// WithHostAgentLogLevel sets the level of the agent logs, making it
+// adjustable through SetLogLevel.
+func WithHostAgentLogLevel(level zap.AtomicLevel) HostOptions {
+	return func(h *HostAgent) {
+		h.logLevel = &level
+	}
+}
+
 // WithHostAgentIsECSEC2 sets whether the agent is running on
 // AWS ECS with EC2 infrastructure
 func WithHostAgentInfraPlatform(p InfraPlatform) HostOptions {
@@ -86,7 +151,6 @@ func NewHostAgent(cfg HostConfig, zapCore zapcore.Core,
 	opts ...HostOptions) (*HostAgent, error) {
 	var agent HostAgent
 	agent.HostConfig = cfg
-	agent.httpGetFunc = http.Get
 
 	for _, apply := range opts {
 		apply(&agent)
@@ -112,6 +176,31 @@ func NewHostAgent(cfg HostConfig, zapCore zapcore.Core,
 
 	agent.logger = zap.New(zapCore, zap.AddCaller())
 
+	httpClient, err := transport.NewHTTPClient(transport.Config{
+		TLS:    cfg.TLS,
+		Proxy:  cfg.Proxy,
+		APIKey: cfg.APIKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	backendClientOpts := []BackendClientOptions{WithBackendClientHTTPDoFunc(httpClient.Do)}
+	if agent.meter != nil {
+		agent.metrics, err = newHostAgentMetrics(agent.meter)
+		if err != nil {
+			return nil, err
+		}
+		backendClientOpts = append(backendClientOpts, WithBackendClientMeter(agent.meter))
+
+		if agent.bufferEnabled() {
+			if err := agent.registerBufferMetrics(agent.meter); err != nil {
+				return nil, err
+			}
+		}
+	}
+	agent.backendClient = NewBackendClient(agent.logger, backendClientOpts...)
+
 	configCheckDuration, err := time.ParseDuration(cfg.ConfigCheckInterval)
 	if err != nil {
 		return nil, err
@@ -119,13 +208,37 @@ func NewHostAgent(cfg HostConfig, zapCore zapcore.Core,
 
 	agent.configCheckDuration = configCheckDuration
 
+	agent.shutdownTimeout = defaultShutdownTimeout
+	if cfg.ShutdownTimeout != "" {
+		agent.shutdownTimeout, err = time.ParseDuration(cfg.ShutdownTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shutdown timeout %q: %w", cfg.ShutdownTimeout, err)
+		}
+	}
+
+	agent.controlPlanePolicy, err = ParseControlPlaneErrorPolicy(cfg.OnControlPlaneError)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.StateDir != "" {
+		agent.configHistory = NewConfigHistory(filepath.Join(cfg.StateDir, ConfigHistoryDir),
+			cfg.ConfigHistorySize)
+	}
+
 	collectorFactories, err := agent.getFactories()
 	if err != nil {
 		return nil, err
 	}
 
 	agent.collectorFactories = collectorFactories
+	agent.reloadProvider = NewReloadProvider()
+	agent.refreshCh = make(chan struct{}, 1)
 	agent.collectorSettings = otelcol.CollectorSettings{
+		// the agent handles SIGINT and SIGTERM itself: it stops its pollers
+		// before the collector drains its queues in Shutdown. The collector
+		// handling them too would shut it down before the pollers, which
+		// could then start it again.
 		DisableGracefulShutdown: true,
 		LoggingOptions: func() []zap.Option {
 			// if logfile is specified, then write logs to the file using zapFileCore
@@ -136,7 +249,8 @@ func NewHostAgent(cfg HostConfig, zapCore zapcore.Core,
 					}),
 				}
 			}
-			return []zap.Option{}
+			// mask the secrets of the configs in the logs of the collector
+			return []zap.Option{zap.WrapCore(redact.Core)}
 		}(),
 
 		BuildInfo: component.BuildInfo{
@@ -148,18 +262,20 @@ func NewHostAgent(cfg HostConfig, zapCore zapcore.Core,
 		Factories: func() (otelcol.Factories, error) {
 			return agent.getFactories()
 		},
-		ConfigProviderSettings: agent.getConfigProviderSettings(agent.OtelConfigFile),
+		ConfigProviderSettings: agent.getConfigProviderSettings(
+			ReloadProviderScheme + ":" + agent.OtelConfigFile),
 	}
-	agent.collectorWG = &sync.WaitGroup{}
 
 	return &agent, nil
 }
 
 var (
 	ErrKeyNotFound     = fmt.Errorf("'%s' key not found", Receivers)
-	ErrParseReceivers  = fmt.Errorf("failed to parse %s in otel config file", Receivers)
+	ErrParseReceivers  = otelconfig.ErrParseReceivers
 	ErrParseProcessors = fmt.Errorf("failed to parse %s in otel config file", Processors)
-	ErrParseService    = fmt.Errorf("failed to parse %s in otel config file", Service)
+	ErrParseExporters  = fmt.Errorf("failed to parse %s in otel config file", Exporters)
+	ErrParseExtensions = otelconfig.ErrParseExtensions
+	ErrParseService    = otelconfig.ErrParseService
 	ErrParsePipelines  = fmt.Errorf("failed to parse %s in otel config file", Pipelines)
 	ErrParseMetrics    = fmt.Errorf("failed to parse %s in otel config file", Metrics)
 )
@@ -171,7 +287,7 @@ type configType struct {
 	DaemonSet  map[string]interface{} `json:"daemonset"`
 }
 
-// IntegrationType represents the type of the database.
+// IntegrationType represents the type of the integration, e.g. a database.
 type IntegrationType int
 
 const (
@@ -183,26 +299,62 @@ const (
 	Cassandra
 	Elasticsearch
 	Clickhouse
+	OracleDB
+	SQLServer
+	RabbitMQ
+	Nginx
+	Apache
+	Zookeeper
+	Kafka
+	JMX
 )
 
 type integrationConfiguration struct {
 	// In future this struct can be extended to further accomodate new integrations.
 	Path     string `json:"path"`
 	Endpoint string `json:"endpoint"`
+	// Name tells the instances of an integration type apart, e.g. the
+	// receivers of the postgresql instance named orders are named
+	// postgresql/orders.
+	Name string `json:"name"`
+	// ResourceAttributes are added to the telemetry of the receivers of the
+	// instance.
+	ResourceAttributes map[string]string `json:"resource_attributes"`
+	// Username, Password and Database are set in the receiver scraping
+	// Endpoint. Password must be a secret reference, e.g.
+	// ${secret:postgresql-password}, since the rendered config is not
+	// kept secret.
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Database string `json:"database"`
+	// JarPath is the OpenTelemetry JMX metrics gatherer jar run by the jmx
+	// receiver of the JMX and Cassandra instances.
+	JarPath string `json:"jar_path"`
 }
 
 type apiResponseForYAML struct {
-	Status              bool                     `json:"status"`
-	Config              configType               `json:"config"`
-	PgdbConfig          integrationConfiguration `json:"pgdb_config"`
-	MongodbConfig       integrationConfiguration `json:"mongodb_config"`
-	MysqlConfig         integrationConfiguration `json:"mysql_config"`
-	MariaDBConfig       integrationConfiguration `json:"mariadb_config"`
-	RedisConfig         integrationConfiguration `json:"redis_config"`
-	ElasticsearchConfig integrationConfiguration `json:"elasticsearch_config"`
-	CassandraConfig     integrationConfiguration `json:"cassandra_config"`
-	ClickhouseConfig    integrationConfiguration `json:"clickhouse_config"`
-	Message             string                   `json:"message"`
+	Status              bool                      `json:"status"`
+	Config              configType                `json:"config"`
+	PgdbConfig          integrationConfigurations `json:"pgdb_config"`
+	MongodbConfig       integrationConfigurations `json:"mongodb_config"`
+	MysqlConfig         integrationConfigurations `json:"mysql_config"`
+	MariaDBConfig       integrationConfigurations `json:"mariadb_config"`
+	RedisConfig         integrationConfigurations `json:"redis_config"`
+	ElasticsearchConfig integrationConfigurations `json:"elasticsearch_config"`
+	CassandraConfig     integrationConfigurations `json:"cassandra_config"`
+	ClickhouseConfig    integrationConfigurations `json:"clickhouse_config"`
+	OracleDBConfig      integrationConfigurations `json:"oracledb_config"`
+	SQLServerConfig     integrationConfigurations `json:"sqlserver_config"`
+	RabbitMQConfig      integrationConfigurations `json:"rabbitmq_config"`
+	NginxConfig         integrationConfigurations `json:"nginx_config"`
+	ApacheConfig        integrationConfigurations `json:"apache_config"`
+	ZookeeperConfig     integrationConfigurations `json:"zookeeper_config"`
+	KafkaConfig         integrationConfigurations `json:"kafka_config"`
+	JMXConfig           integrationConfigurations `json:"jmx_config"`
+	Message             string                    `json:"message"`
+	// Unchanged is set by the backend when the config_hash sent by the
+	// agent matches the current config.
+	Unchanged bool `json:"unchanged"`
 }
 
 type rollout struct {
@@ -254,22 +406,44 @@ func (d IntegrationType) String() string {
 		return "elasticsearch"
 	case Clickhouse:
 		return "clickhouse"
+	case OracleDB:
+		return "oracledb"
+	case SQLServer:
+		return "sqlserver"
+	case RabbitMQ:
+		return "rabbitmq"
+	case Nginx:
+		return "nginx"
+	case Apache:
+		return "apache"
+	case Zookeeper:
+		return "zookeeper"
+	case Kafka:
+		return "kafka"
+	case JMX:
+		return "jmx"
 	}
 	return "unknown"
 }
 
-func (c *HostAgent) getConfigProviderSettings(uri string) otelcol.ConfigProviderSettings {
-	return otelcol.ConfigProviderSettings{
-		ResolverSettings: confmap.ResolverSettings{
-			ProviderFactories: []confmap.ProviderFactory{
-				fileprovider.NewFactory(),
-				yamlprovider.NewFactory(),
-				envprovider.NewFactory(),
-			},
-			URIs: []string{uri},
-		},
+// ParseIntegrationType returns the IntegrationType named s, as returned by
+// IntegrationType.String.
+func ParseIntegrationType(s string) (IntegrationType, error) {
+	for _, d := range []IntegrationType{PostgreSQL, MongoDB, MySQL, MariaDB,
+		Redis, Cassandra, Elasticsearch, Clickhouse, OracleDB, SQLServer,
+		RabbitMQ, Nginx, Apache, Zookeeper, Kafka, JMX} {
+		if d.String() == s {
+			return d, nil
+		}
 	}
+	return PostgreSQL, fmt.Errorf("unknown integration type %q", s)
 }
+
+func (c *HostAgent) getConfigProviderSettings(uri string) otelcol.ConfigProviderSettings {
+	return NewConfigProviderSettings(uri, c.reloadProvider, c.NewMWProviderFactory(),
+		c.SecretResolver().NewProviderFactory())
+}
+
 func convertTabsToSpaces(input []byte, tabWidth int) []byte {
 	// Find the tab character in the input
 	tabChar := byte('\t')
@@ -327,56 +501,145 @@ func (c *HostAgent) updateConfigWithRestrictions(config map[string]interface{})
 	return config, nil
 }
 
-func (c *HostAgent) updateConfig(config map[string]interface{}, cnf integrationConfiguration) (map[string]interface{}, error) {
+// updateConfig deep merges the receivers of the integration instance cnf
+// into config: the receivers of its file, or the receiver scraping its
+// endpoint. The receivers of a named instance are named after it, e.g.
+// postgresql/orders, and must not be in config yet. The receivers which
+// are not in config yet are added to its metrics or logs pipeline, or to a
+// pipeline of their own if the instance has resource attributes. config is
+// left unchanged if an error is returned.
+func (c *HostAgent) updateConfig(config map[string]interface{}, integrationType IntegrationType,
+	cnf integrationConfiguration) (map[string]interface{}, error) {
+
+	source := cnf.Path
+	var integrationReceivers map[string]interface{}
+	if cnf.Path != "" {
+		var err error
+		integrationReceivers, err = c.loadIntegrationFile(cnf.Path)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		id, receiver, err := endpointReceiver(integrationType, cnf)
+		if err != nil {
+			return nil, err
+		}
+		// the secrets are resolved by the collector, fail early if it can't
+		if err := c.SecretResolver().CheckReferences(receiver); err != nil {
+			return nil, fmt.Errorf("%s: %w", cnf.Endpoint, err)
+		}
+		source = cnf.Endpoint
+		integrationReceivers = map[string]interface{}{id: receiver}
+	}
 
-	if c.isIPPortFormat(cnf.Endpoint) {
-		return config, nil
+	receiverData, ok := config[Receivers].(map[string]interface{})
+	if !ok {
+		return nil, ErrKeyNotFound
 	}
-	// Read the YAML file
-	yamlData, err := os.ReadFile(cnf.Path)
-	if err != nil {
-		return map[string]interface{}{}, err
+
+	if cnf.Name != "" {
+		named := make(map[string]interface{}, len(integrationReceivers))
+		for id, receiver := range integrationReceivers {
+			// the endpoint receivers are already named after the instance
+			if cnf.Path != "" && !strings.Contains(id, "/") {
+				id += "/" + cnf.Name
+			}
+			_, exists := receiverData[id]
+			_, duplicate := named[id]
+			if exists || duplicate {
+				return nil, fmt.Errorf("%w: %s: receiver %s already exists", ErrInvalidIntegration, source, id)
+			}
+			named[id] = receiver
+		}
+		integrationReceivers = named
 	}
 
-	// Unmarshal the YAML data into a temporary map[string]interface{}
-	updatedYamlData := convertTabsToSpaces(yamlData, 2)
-	tempMap := make(map[string]interface{})
-	err = yaml.Unmarshal(updatedYamlData, &tempMap)
-	if err != nil {
-		return map[string]interface{}{}, err
+	ids := make([]string, 0, len(integrationReceivers))
+	for id := range integrationReceivers {
+		ids = append(ids, id)
 	}
+	sort.Strings(ids)
 
-	// Add the temporary map to the existing "receiver" key
-	receiverData, ok := config["receivers"].(map[string]interface{})
-	if !ok {
-		return map[string]interface{}{}, ErrKeyNotFound
-	}
-
-	for key, value := range tempMap {
-		mapValue, mapValueOk := value.(map[interface{}]interface{})
-		if mapValueOk {
-			oldValue, oldValueOk := receiverData[key]
-			if oldValueOk {
-				oldMapValue, oldMapValueOk := oldValue.(map[string]interface{})
-				if oldMapValueOk {
-					for k, v := range mapValue {
-						strKey, keyOk := k.(string)
-						if keyOk {
-							oldMapValue[strKey] = v
-						} else {
-							c.logger.Info("invalid key type", zap.Any("key type", k))
-						}
-					}
-					receiverData[key] = oldMapValue
-				}
+	merged := make(map[string]interface{}, len(ids))
+	var added []string
+	for _, id := range ids {
+		existing, exists := receiverData[id]
+		receiver, err := mergeReceiver(existing, integrationReceivers[id])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s: %v", ErrInvalidIntegration, source, id, err)
+		}
+		merged[id] = receiver
+		if !exists {
+			added = append(added, id)
+		}
+	}
+
+	// the receivers with resource attributes are moved to a pipeline of
+	// their own, even if they were already in config
+	wired := added
+	if len(cnf.ResourceAttributes) > 0 {
+		wired = ids
+	}
+
+	if len(wired) > 0 {
+		serviceData, ok := config[Service].(map[string]interface{})
+		if !ok {
+			return nil, ErrParseService
+		}
+
+		pipelinesData, ok := serviceData[Pipelines].(map[string]interface{})
+		if !ok {
+			return nil, ErrParsePipelines
+		}
+
+		// check every pipeline before changing any
+		for _, id := range wired {
+			if _, err := pipelineComponents(pipelinesData, receiverPipeline(id), Receivers); err != nil {
+				return nil, fmt.Errorf("%s: receiver %s: %w", source, id, err)
+			}
+		}
+		for _, id := range wired {
+			var err error
+			if len(cnf.ResourceAttributes) > 0 {
+				err = addInstancePipeline(config, pipelinesData, id, cnf.ResourceAttributes)
+			} else {
+				err = addPipelineReceiver(pipelinesData, receiverPipeline(id), id)
+			}
+			if err != nil {
+				return nil, err
 			}
 		}
 	}
 
+	for id, receiver := range merged {
+		receiverData[id] = receiver
+	}
+
 	return config, nil
 }
 
-func (c *HostAgent) updateConfigFile(configType string) error {
+// backendDocument identifies an ingestion rules response of the Middleware
+// backend.
+type backendDocument struct {
+	// ETag is the ETag header of the response.
+	ETag string
+	// Hash is the hex encoded SHA-256 hash of the response body, which the
+	// backend can compute from the document it serves, unlike the hash of
+	// the otel config rendered from it.
+	Hash string
+}
+
+// buildOtelConfig fetches the ingestion rules of the given config type
+// (docker or nodocker) from the Middleware backend and applies the agent
+// transforms (integrations, ECS, restrictions, host tags) to them. It
+// returns the resulting otel config as YAML and the response it was built
+// from.
+//
+// If conditional is true, the hash and the ETag of the response the last
+// applied config was built from are sent to the backend, and
+// ErrConfigUnchanged is returned if the backend reports that the config
+// did not change.
+func (c *HostAgent) buildOtelConfig(configType string, conditional bool) ([]byte, backendDocument, error) {
 	// _, apiURLForYAML := checkForConfigURLOverrides()
 
 	hostname := GetHostnameForPlatform(c.InfraPlatform)
@@ -384,10 +647,9 @@ func (c *HostAgent) updateConfigFile(configType string) error {
 	// Call Webhook
 	u, err := url.Parse(c.APIURLForConfigCheck)
 	if err != nil {
-		return err
+		return nil, backendDocument{}, err
 	}
 
-	baseURL := u.JoinPath(apiPathForYAML).JoinPath(c.APIKey)
 	params := url.Values{}
 	params.Add("config", configType)
 	params.Add("platform", runtime.GOOS)
@@ -401,47 +663,70 @@ func (c *HostAgent) updateConfigFile(configType string) error {
 	}
 
 	collectorRunning := 0
-	// Don't need to take lock on the c.collector because it is not deferenced
-	if c.collector == nil {
+	if collector, _ := c.getCollector(); collector == nil {
 		collectorRunning = 1
 	}
 	params.Add("col_running", fmt.Sprintf("%d", collectorRunning))
 
+	applied := c.getAppliedDocument()
+	if conditional && applied.Hash != "" {
+		params.Add("config_hash", applied.Hash)
+	}
+
+	req, err := transport.NewAPIRequest(http.MethodGet, u, apiPathForYAML, nil)
+	if err != nil {
+		return nil, backendDocument{}, fmt.Errorf("failed to create request: %w", err)
+	}
 	// Add Query Parameters to the URL
-	baseURL.RawQuery = params.Encode() // Escape Query Parameters
+	req.URL.RawQuery = params.Encode() // Escape Query Parameters
+
+	// Setting Accept-Encoding disables the transparent decompression of
+	// net/http, readResponseBody takes care of it.
+	req.Header.Set("Accept-Encoding", "gzip")
+	if conditional && applied.ETag != "" {
+		req.Header.Set("If-None-Match", applied.ETag)
+	}
 
-	url := baseURL.String()
-	resp, err := c.httpGetFunc(url)
+	resp, err := c.backendClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to call get configuration api for %s: %w", url, err)
+		return nil, backendDocument{}, fmt.Errorf("failed to call get configuration api for %s: %w",
+			redact.URL(req.URL, c.APIKey), err)
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, backendDocument{}, ErrConfigUnchanged
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("get configuration api returned non-200 status: %d", resp.StatusCode)
+		return nil, backendDocument{}, fmt.Errorf("get configuration api returned non-200 status: %d", resp.StatusCode)
 	}
 
 	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	body, err := readResponseBody(resp)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+		return nil, backendDocument{}, fmt.Errorf("failed to read response body: %w", err)
 	}
 
 	// Unmarshal JSON response into ApiResponse struct
 	var apiResponse apiResponseForYAML
 	if err := json.Unmarshal(body, &apiResponse); err != nil {
-		return fmt.Errorf("failed to unmarshal api response: %w", err)
+		return nil, backendDocument{}, fmt.Errorf("failed to unmarshal api response: %w", err)
 	}
 
 	// Verify API Response
 	if !apiResponse.Status {
-		return fmt.Errorf("failure status from api response for ingestion rules: %t", apiResponse.Status)
+		return nil, backendDocument{}, fmt.Errorf("failure status from api response for ingestion rules: %t", apiResponse.Status)
+	}
+
+	if apiResponse.Unchanged {
+		return nil, backendDocument{}, ErrConfigUnchanged
 	}
 
 	var apiYAMLConfig map[string]interface{}
 	if len(apiResponse.Config.Docker) == 0 && len(apiResponse.Config.NoDocker) == 0 {
-		return fmt.Errorf("failed to get valid response, config docker len: %d, config no docker len: %d",
+		return nil, backendDocument{}, fmt.Errorf("failed to get valid response, config docker len: %d, config no docker len: %d",
 			len(apiResponse.Config.Docker), len(apiResponse.Config.NoDocker))
 	}
 
@@ -450,7 +735,7 @@ func (c *HostAgent) updateConfigFile(configType string) error {
 		apiYAMLConfig = apiResponse.Config.Docker
 	}
 
-	integrationConfigs := map[IntegrationType]integrationConfiguration{
+	integrationConfigs := map[IntegrationType]integrationConfigurations{
 		PostgreSQL:    apiResponse.PgdbConfig,
 		MongoDB:       apiResponse.MongodbConfig,
 		MySQL:         apiResponse.MysqlConfig,
@@ -459,55 +744,128 @@ func (c *HostAgent) updateConfigFile(configType string) error {
 		Elasticsearch: apiResponse.ElasticsearchConfig,
 		Cassandra:     apiResponse.CassandraConfig,
 		Clickhouse:    apiResponse.ClickhouseConfig,
+		OracleDB:      apiResponse.OracleDBConfig,
+		SQLServer:     apiResponse.SQLServerConfig,
+		RabbitMQ:      apiResponse.RabbitMQConfig,
+		Nginx:         apiResponse.NginxConfig,
+		Apache:        apiResponse.ApacheConfig,
+		Zookeeper:     apiResponse.ZookeeperConfig,
+		Kafka:         apiResponse.KafkaConfig,
+		JMX:           apiResponse.JMXConfig,
 	}
 
-	for integrationType, integrationConfig := range integrationConfigs {
-		if c.checkIntConfigValidity(integrationType, integrationConfig) {
-			apiYAMLConfig, err = c.updateConfig(apiYAMLConfig, integrationConfig)
-			if err != nil {
-				return err
-			}
-		}
+	// the integrations which can not be applied are reported rather than
+	// failing the whole config
+	apiYAMLConfig, _ = c.applyIntegrations(apiYAMLConfig, integrationConfigs)
+
+	apiYAMLConfig, err = c.applyLocalOverlay(apiYAMLConfig)
+	if err != nil {
+		return nil, backendDocument{}, err
+	}
+
+	apiYAMLConfig, err = c.applyHostTransforms(apiYAMLConfig)
+	if err != nil {
+		return nil, backendDocument{}, err
 	}
 
+	apiYAMLBytes, err := yaml.Marshal(apiYAMLConfig)
+	if err != nil {
+		return nil, backendDocument{}, fmt.Errorf("failed to marshal api data: %w", err)
+	}
+
+	sum := sha256.Sum256(body)
+	return apiYAMLBytes, backendDocument{
+		ETag: resp.Header.Get("ETag"),
+		Hash: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// applyHostTransforms applies the transforms that depend on the host the
+// agent runs on (ECS, agent feature restrictions, log offsets, exporter
+// proxy, TLS and buffer, host tags) to config.
+func (c *HostAgent) applyHostTransforms(config map[string]interface{}) (map[string]interface{}, error) {
+	var err error
+
 	// Add awsecscontainermetrics receiver dynamically if the agent is running inside ECS + Fargate setup
 	if c.InfraPlatform == InfraPlatformECSFargate || c.InfraPlatform == InfraPlatformECSEC2 {
 
-		apiYAMLConfig, err = c.updateConfigForECS(apiYAMLConfig)
+		config, err = c.updateConfigForECS(config)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 	}
 
 	if !c.AgentFeatures.LogCollection || !c.AgentFeatures.MetricCollection {
-		apiYAMLConfig, err = c.updateConfigWithRestrictions(apiYAMLConfig)
+		config, err = c.updateConfigWithRestrictions(config)
 		if err != nil {
-			return err
+			return nil, err
+		}
+	}
+
+	// Scrape the integrations running on the host and in its containers,
+	// including the ones started later
+	if c.AgentFeatures.IntegrationAutodiscovery && c.AgentFeatures.MetricCollection {
+		config, err = c.updateConfigForAutodiscovery(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the log tailing offsets across collector restarts
+	if c.StateDir != "" {
+		config, err = c.updateConfigForOffsets(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Send the telemetry through the proxy, the otlp exporters become
+	// otlphttp exporters
+	if c.Proxy.IsSet() {
+		if err := c.Proxy.UpdateExportersForProxy(config); err != nil {
+			return nil, err
+		}
+	}
+
+	// Trust the configured CAs and present the client certificate
+	if c.TLS.IsSet() {
+		if err := c.TLS.UpdateExportersForTLS(config); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the exporter queues on disk
+	if c.bufferEnabled() {
+		config, err = c.updateConfigForBuffer(config)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	// Adding host tags as resource attributes
 	if c.HostTags != "" {
-		apiYAMLConfig, err = c.updateConfigForHostTags(apiYAMLConfig)
+		config, err = c.updateConfigForHostTags(config)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	//apiYAMLConfig = c.fixTelemetryConfig(apiYAMLConfig)
+	//config = c.fixTelemetryConfig(config)
 
-	apiYAMLBytes, err := yaml.Marshal(apiYAMLConfig)
-	if err != nil {
-		return fmt.Errorf("failed to marshal api data: %w", err)
-	}
+	return config, nil
+}
 
+// validateOtelConfig checks that data is an otel config the collector can
+// run with the agent's factories. Schema validation failures are returned
+// as ErrInvalidConfig.
+func (c *HostAgent) validateOtelConfig(data []byte) error {
 	// check if the config is valid, otherwise return an error
 	factories, err := c.getFactories()
 	if err != nil {
 		return fmt.Errorf("failed to get factories: %w", err)
 	}
 
-	cfgProviderSettings := c.getConfigProviderSettings("yaml:" + string(apiYAMLBytes))
+	cfgProviderSettings := c.getConfigProviderSettings("yaml:" + string(data))
 
 	configProvider, err := otelcol.NewConfigProvider(cfgProviderSettings)
 	if err != nil {
@@ -521,74 +879,171 @@ func (c *HostAgent) updateConfigFile(configType string) error {
 		return err
 	}
 	if err := cfg.Validate(); err != nil {
-		trackErr := c.UpdateAgentTrackStatus(err)
-		if trackErr != nil {
-			c.logger.Error("failed to update agent track status", zap.Error(trackErr))
-		}
+		c.metrics.recordConfigValidationFailure()
 		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
 	}
+
+	return nil
+}
+
+// reportInvalidConfig reports a config validation failure returned by
+// validateOtelConfig to the Middleware backend.
+func (c *HostAgent) reportInvalidConfig(err error) {
+	if !errors.Is(err, ErrInvalidConfig) {
+		return
+	}
+
+	trackErr := c.UpdateAgentTrackStatus(err)
+	if trackErr != nil {
+		c.logger.Error("failed to update agent track status", zap.Error(trackErr))
+	}
+}
+
+func (c *HostAgent) updateConfigFile(configType string) error {
+	// the backend does not know about the local overlay, fetch the config
+	// unconditionally if the overlay changed since it was last applied.
+	overlayHash := c.localOverlayHash()
+	conditional := overlayHash == c.appliedOverlayHash
+
+	apiYAMLBytes, document, err := c.buildOtelConfig(configType, conditional)
+	if err != nil {
+		return err
+	}
+	c.reportIntegrationErrors()
+
+	// the backend may send a new document that renders to the config the
+	// collector is already running with, e.g. after an unrelated setting
+	// changed. Rewriting it would only cause a needless restart.
+	current, err := os.ReadFile(c.OtelConfigFile)
+	if err == nil && bytes.Equal(current, apiYAMLBytes) {
+		c.setAppliedDocument(document)
+		c.appliedOverlayHash = overlayHash
+		return ErrConfigUnchanged
+	}
+
+	if err := c.validateOtelConfig(apiYAMLBytes); err != nil {
+		c.reportInvalidConfig(err)
+		return err
+	}
+
 	if err := os.WriteFile(c.OtelConfigFile, apiYAMLBytes, 0644); err != nil {
 		return fmt.Errorf("failed to write new configuration data to file %s: %w", c.OtelConfigFile, err)
 	}
 
+	c.logConfigChanges(current, apiYAMLBytes)
+	c.setAppliedDocument(document)
+	c.appliedOverlayHash = overlayHash
+	c.recordAppliedConfig(apiYAMLBytes)
+
 	return nil
 }
 
-// GetUpdatedYAMLPath gets the correct otel configuration file
-func (c *HostAgent) getOtelConfig() (string, error) {
-	configType := "docker"
-	dockerSocketPath := strings.Split(c.DockerEndpoint, "//")
-	if len(dockerSocketPath) != 2 || !isSocketFn(dockerSocketPath[1]) {
-		configType = "nodocker"
-	}
+func (c *HostAgent) getAppliedDocument() backendDocument {
+	c.appliedDocumentMu.Lock()
+	defer c.appliedDocumentMu.Unlock()
+	return c.appliedDocument
+}
 
-	if err := c.updateConfigFile(configType); err != nil {
-		if errors.Is(err, ErrInvalidConfig) {
-			return c.OtelConfigFile, err
-		}
-		return c.OtelConfigFile, fmt.Errorf("%w: %v", ErrConfigFetchFailure, err)
-	}
+func (c *HostAgent) setAppliedDocument(document backendDocument) {
+	c.appliedDocumentMu.Lock()
+	defer c.appliedDocumentMu.Unlock()
+	c.appliedDocument = document
+}
 
-	return c.OtelConfigFile, nil
+// appliedConfigHash returns the hex encoded SHA-256 hash of OtelConfigFile
+// and false if the file can not be read.
+func (c *HostAgent) appliedConfigHash() (string, bool) {
+	data, err := os.ReadFile(c.OtelConfigFile)
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), true
 }
 
-// isIPPortFormat checks if the given endpoint string is in the format of IPv4:PORT.
-// The function also considers localhost as an IP.
-// The function returns true if the endpoint matches the regex pattern, false otherwise.
-func (c *HostAgent) isIPPortFormat(endpoint string) bool {
-	// Regex for IPv4:PORT format, also consider localhost as an IP
-	regexPattern := `(?:localhost|((?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?))):(?:[0-9]|[1-9][0-9]{1,4}|[1-5][0-9]{4}|6[0-5][0-5][0-3][0-5])$`
+// readResponseBody reads the body of resp, decompressing it if the
+// backend sent it gzip encoded.
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return io.ReadAll(resp.Body)
+	}
 
-	// Compile the regular expression
-	regex, err := regexp.Compile(regexPattern)
+	gz, err := gzip.NewReader(resp.Body)
 	if err != nil {
-		c.logger.Error("error invalid regexPattern for IP:Port format", zap.Error(err))
-		return false
+		return nil, err
 	}
+	defer gz.Close()
+	return io.ReadAll(gz)
+}
 
-	// Path variable is IP:PORT for these integrations -> Clickhouse, Redpanda
-	if regex.MatchString(endpoint) {
-		c.logger.Info("found valid endpoint", zap.String("endpoint", endpoint))
-		return true
+// getConfigType returns the ingestion rules config type for this host,
+// docker if the docker socket is available and nodocker otherwise.
+func (c *HostAgent) getConfigType() string {
+	dockerSocketPath := strings.Split(c.DockerEndpoint, "//")
+	if len(dockerSocketPath) != 2 || !isSocketFn(dockerSocketPath[1]) {
+		return "nodocker"
+	}
+	return "docker"
+}
+
+// RenderOtelConfig fetches the ingestion rules of the given config type
+// (docker or nodocker) and applies the agent transforms to them, exactly
+// as the agent does before applying a config, but without validating the
+// result or writing OtelConfigFile.
+func (c *HostAgent) RenderOtelConfig(configType string) ([]byte, error) {
+	data, _, err := c.buildOtelConfig(configType, false)
+	return data, err
+}
+
+// GetUpdatedYAMLPath gets the correct otel configuration file
+func (c *HostAgent) getOtelConfig() (string, error) {
+	start := time.Now()
+	err := c.updateConfigFile(c.getConfigType())
+	if err != nil && !errors.Is(err, ErrInvalidConfig) && !errors.Is(err, ErrConfigUnchanged) {
+		err = newControlPlaneError(fmt.Errorf("%w: %v", ErrConfigFetchFailure, err))
 	}
-	return false
+
+	c.metrics.recordConfigFetch(start, err)
+	return c.OtelConfigFile, err
 }
 
-func (c *HostAgent) checkIntConfigValidity(integrationType IntegrationType, cnf integrationConfiguration) bool {
+// checkIntConfigValidity checks that the name of cnf can name its
+// receivers, and that its integration file exists or that its endpoint is
+// valid, see parseEndpoint, with a password kept out of the rendered config
+// and, for the jmx receiver, the jar it runs.
+func (c *HostAgent) checkIntConfigValidity(integrationType IntegrationType, cnf integrationConfiguration) error {
+	if cnf.Name != "" && !integrationNameRegex.MatchString(cnf.Name) {
+		return fmt.Errorf("%w: %v: invalid name %q, it must not contain spaces, control characters or symbols",
+			ErrInvalidIntegration, integrationType, cnf.Name)
+	}
+
 	if cnf.Path != "" {
 		// Check if the file exists
-		if _, err := os.Stat(cnf.Path); os.IsNotExist(err) {
-			c.logger.Warn(fmt.Sprintf("%v config file not found", integrationType), zap.String("path", cnf.Path))
-			return false
+		if _, err := os.Stat(cnf.Path); err != nil {
+			return fmt.Errorf("%v config file not found: %w", integrationType, err)
 		}
+		return nil
+	}
 
-		return true
-	} else if cnf.Endpoint != "" {
-		if c.isIPPortFormat(cnf.Endpoint) {
-			return true
+	if _, err := parseEndpoint(cnf.Endpoint); err != nil {
+		return fmt.Errorf("%v: %w", integrationType, err)
+	}
+
+	if cnf.Password != "" && !secret.IsReference(cnf.Password) {
+		return fmt.Errorf("%w: %v: the password must be a secret reference, e.g. ${secret:%v-password}",
+			ErrInvalidIntegration, integrationType, integrationType)
+	}
+
+	// the jmx receiver runs the metrics gatherer jar with java
+	if integrationType == JMX || integrationType == Cassandra {
+		if cnf.JarPath == "" {
+			return fmt.Errorf("%w: %v: jar_path is required by the jmx receiver", ErrInvalidIntegration, integrationType)
+		}
+		if _, err := os.Stat(cnf.JarPath); err != nil {
+			return fmt.Errorf("%w: %v: jmx metrics gatherer jar not found: %v", ErrInvalidIntegration, integrationType, err)
 		}
 	}
-	return false
+	return nil
 }
 
 func (c *HostAgent) callRestartStatusAPI() error {
@@ -600,8 +1055,6 @@ func (c *HostAgent) callRestartStatusAPI() error {
 		return err
 	}
 
-	baseURL := u.JoinPath(apiPathForRestart)
-	baseURL = baseURL.JoinPath(c.APIKey)
 	params := url.Values{}
 	params.Add("host_id", hostname)
 	params.Add("platform", runtime.GOOS)
@@ -609,36 +1062,42 @@ func (c *HostAgent) callRestartStatusAPI() error {
 	params.Add("infra_platform", fmt.Sprint(c.InfraPlatform))
 
 	collectorRunning := 0
-	// Don't need to take lock on the c.collector because it is not deferenced
-	if c.collector == nil {
+	if collector, _ := c.getCollector(); collector == nil {
 		collectorRunning = 1
 	}
 	params.Add("col_running", fmt.Sprintf("%d", collectorRunning))
 
+	req, err := transport.NewAPIRequest(http.MethodGet, u, apiPathForRestart, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
 	// Add Query Parameters to the URL
-	baseURL.RawQuery = params.Encode() // Escape Query Parameters
+	req.URL.RawQuery = params.Encode() // Escape Query Parameters
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	url := baseURL.String()
-	resp, err := client.Get(url)
+	resp, err := c.backendClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to call restart api for url %s: %w", url, err)
+		return newControlPlaneError(fmt.Errorf("failed to call restart api for url %s: %w",
+			redact.URL(req.URL, c.APIKey), err))
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("restart api returned non-200 status: %d", resp.StatusCode)
+		return newControlPlaneError(fmt.Errorf("restart api returned non-200 status: %d", resp.StatusCode))
 	}
 
 	var apiResponse apiResponseForRestart
 	if err := json.NewDecoder(resp.Body).Decode(&apiResponse); err != nil {
-		return fmt.Errorf("failed to unmarshal restart api response: %w", err)
+		return newControlPlaneError(fmt.Errorf("failed to unmarshal restart api response: %w", err))
 	}
 
 	if apiResponse.Restart {
 		c.logger.Info("fetching updated configuration from backend")
 		if _, err := c.getOtelConfig(); err != nil {
+			if errors.Is(err, ErrConfigUnchanged) {
+				c.logger.Info("otel config unchanged, skipping restart")
+				return nil
+			}
 			return err
 		}
 
@@ -655,11 +1114,6 @@ func (c *HostAgent) applyConfigClassToHosts() error {
 		return err
 	}
 
-	// Build the URL: /agent/public/setting/config-groups/{groupName}/{token}
-	baseURL := u.JoinPath(apiPathForConfigGroups)
-	baseURL = baseURL.JoinPath(c.APIKey)
-	baseURL = baseURL.JoinPath("default")
-
 	// Prepare request body
 	reqBody := map[string][]string{
 		"hostIds": {hostname},
@@ -669,17 +1123,19 @@ func (c *HostAgent) applyConfigClassToHosts() error {
 		return fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest(http.MethodPut, baseURL.String(), bytes.NewBuffer(jsonData))
+	// Build the URL: /agent/public/setting/config-groups/{groupName}
+	req, err := transport.NewAPIRequest(http.MethodPut, u, apiPathForConfigGroups,
+		bytes.NewBuffer(jsonData), "default")
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := client.Do(req)
+	resp, err := c.backendClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to call config groups api for url %s: %w", baseURL.String(), err)
+		return fmt.Errorf("failed to call config groups api for url %s: %w",
+			redact.URL(req.URL, c.APIKey), err)
 	}
 	defer resp.Body.Close()
 
@@ -712,26 +1168,54 @@ func (c *HostAgent) applyConfigClassToHosts() error {
 // has changed.
 func (c *HostAgent) ListenForConfigChanges(errCh chan<- error,
 	stopCh <-chan struct{}) error {
+	c.setConfigListenerRunning(true)
+	defer c.setConfigListenerRunning(false)
 
 	// First fetch the config
 	_, err := c.getOtelConfig()
-	if err != nil {
+	c.recordConfigFetch(err)
+	if err != nil && !errors.Is(err, ErrConfigUnchanged) {
 		errCh <- err
 	} else {
 		errCh <- nil
 	}
 
-	ticker := time.NewTicker(c.configCheckDuration)
+	// start polling at a random offset so that agents started at the same
+	// time, e.g. after a backend outage, do not poll in lockstep.
+	timer := time.NewTimer(c.backendClient.StartOffset(c.configCheckDuration))
+	defer timer.Stop()
+	// a config check interval of 0 disables the periodic config checks,
+	// the checks requested through refreshCh still run
+	timerC := timer.C
+	if c.configCheckDuration <= 0 {
+		timerC = nil
+	}
 
 	for {
 		c.logger.Debug("checking for config change every",
 			zap.String("config check duration", c.configCheckDuration.String()))
 		select {
 		case <-stopCh:
-			ticker.Stop()
 			return nil
-		case <-ticker.C:
+		case <-c.refreshCh:
+			c.logger.Info("checking for config change on request")
 			err = c.callRestartStatusAPI()
+			c.recordConfigFetch(err)
+			c.metrics.recordRestartStatusPoll(err)
+			errCh <- err
+		case <-timerC:
+			err = c.callRestartStatusAPI()
+			c.recordConfigFetch(err)
+			c.metrics.recordRestartStatusPoll(err)
+
+			delay := c.backendClient.NextDelay(c.configCheckDuration)
+			if state := c.backendClient.State(); state.ConsecutiveFailures > 0 {
+				c.logger.Warn("backend calls failing, backing off",
+					zap.Duration("next_check", delay),
+					zap.Stringer("circuit", state.Circuit),
+					zap.Int("consecutive_failures", state.ConsecutiveFailures))
+			}
+			timer.Reset(delay)
 
 			// Apply config class to hosts only once when the agent starts
 			c.applyConfigOnce.Do(func() {
@@ -744,23 +1228,41 @@ func (c *HostAgent) ListenForConfigChanges(errCh chan<- error,
 	}
 }
 
+// Status values sent to the agent tracking API
+const (
+	trackStatusValidate = "validate"
+	trackStatusRollback = "rollback"
+	trackStatusShutdown = "shutdown"
+	// trackStatusIntegration reports the integrations which could not be
+	// applied, the config itself was applied
+	trackStatusIntegration = "integration"
+)
+
+// UpdateAgentTrackStatus reports a config validation failure to the
+// Middleware backend.
 func (c *HostAgent) UpdateAgentTrackStatus(reason error) error {
-	c.logger.Info("Starting UpdateAgentTrackStatus")
+	return c.updateAgentTrackStatus(trackStatusValidate, reason)
+}
+
+func (c *HostAgent) updateAgentTrackStatus(status string, reason error) error {
+	c.logger.Info("Starting UpdateAgentTrackStatus", zap.String("status", status))
 	hostname := GetHostnameForPlatform(c.InfraPlatform)
 	u, err := url.Parse(c.APIURLForConfigCheck)
 	if err != nil {
 		return err
 	}
-	baseURL := u.JoinPath(apiAgentTrack)
-	baseURL = baseURL.JoinPath(c.APIKey)
+	var reasonText string
+	if reason != nil {
+		reasonText = reason.Error()
+	}
 	payload := TrackingPayload{
-		Status: "validate",
+		Status: status,
 		Metadata: TrackingMetadata{
 			HostID:        hostname,
 			Platform:      runtime.GOOS,
 			AgentVersion:  c.Version,
 			InfraPlatform: fmt.Sprint(c.InfraPlatform),
-			Reason:        reason.Error(),
+			Reason:        reasonText,
 		},
 	}
 	// Marshal payload to JSON
@@ -768,15 +1270,15 @@ func (c *HostAgent) UpdateAgentTrackStatus(reason error) error {
 	if err != nil {
 		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
-	req, err := http.NewRequest(http.MethodPost, baseURL.String(), bytes.NewBuffer(payloadBytes))
+	req, err := transport.NewAPIRequest(http.MethodPost, u, apiAgentTrack, bytes.NewBuffer(payloadBytes))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 	// Add headers
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{Timeout: 10 * time.Second}
-	// Make the request
-	resp, err := client.Do(req)
+	// Make the request, rollbacks and shutdowns are reported while the
+	// circuit breaker of the config checks is open
+	resp, err := c.backendClient.DoWithoutBreaker(req)
 	if err != nil {
 		return fmt.Errorf("Agent Track API request failed: %w", err)
 	}
@@ -790,48 +1292,211 @@ func (c *HostAgent) UpdateAgentTrackStatus(reason error) error {
 }
 
 // StartCollector initializes a new OpenTelemetry collector with the configured
-// settings and starts it. This function blocks until the collector is stopped
+// settings and starts it. This function blocks until the collector pipelines
+// are running and returns ErrCollectorStartFailure if the collector exits
+// while it is starting. If the previous collector did not exit when it was
+// stopped, StartCollector waits at most shutdownTimeout for it to exit and
+// returns ErrCollectorStillRunning otherwise.
 func (c *HostAgent) StartCollector() error {
-	if c.collector != nil {
-		return nil
+	if previous, stopping := c.getCollector(); previous != nil {
+		if !stopping {
+			return nil
+		}
+
+		// the previous collector was stopped but did not drain its
+		// exporter queues in time, it still holds its ports
+		if !c.waitForCollectorExit(c.shutdownTimeout) {
+			return newDataPlaneError(ErrCollectorStillRunning)
+		}
+		c.setCollector(nil, nil)
 	}
 
 	collector, err := otelcol.NewCollector(c.collectorSettings)
 	if err != nil {
-		return err
+		return newDataPlaneError(err)
 	}
 
-	c.collector = collector
+	exited := make(chan struct{})
+	c.setCollector(collector, exited)
 
-	c.collectorWG.Add(1)
+	runErrCh := make(chan error, 1)
+	c.collectorDone = runErrCh
 	go func() {
-		defer c.collectorWG.Done()
-		if err := collector.Run(context.Background()); err != nil {
+		defer close(exited)
+		err := collector.Run(context.Background())
+		c.recordCollectorState(false)
+		if err != nil {
+			c.metrics.recordCollectorCrash()
 			c.logger.Error("collector server run finished with error",
 				zap.Error(err))
-			c.collector = nil
+			c.collectorMu.Lock()
+			if c.collector == collector {
+				c.collector = nil
+				c.collectorExited = nil
+				c.collectorStopping = false
+			}
+			c.collectorMu.Unlock()
 		} else {
 			c.logger.Info("collector server run finished gracefully")
 		}
-
+		runErrCh <- err
 	}()
 
+	if err := c.waitForCollectorStart(collector, runErrCh); err != nil {
+		return newDataPlaneError(err)
+	}
+	c.recordCollectorState(true)
+
+	c.collectorStarts++
+	if c.collectorStarts > 1 {
+		c.metrics.recordCollectorRestart(collectorRestartModeRestart)
+	}
 	return nil
+}
+
+// StartsWithLastConfig reports whether the collector must be started with
+// the config of a previous run in OtelConfigFile after err. This is the case
+// when the Middleware backend can not be reached before the collector was
+// ever started and the control plane error policy is keep-running.
+func (c *HostAgent) StartsWithLastConfig(err error) bool {
+	if !errors.Is(err, ErrControlPlane) ||
+		c.controlPlanePolicy != ControlPlaneErrorKeepRunning ||
+		c.collectorStarts > 0 {
+		return false
+	}
 
+	_, statErr := os.Stat(c.OtelConfigFile)
+	return statErr == nil
 }
 
+// waitForCollectorStart waits until the collector reports that it is
+// running or until its Run function returns.
+func (c *HostAgent) waitForCollectorStart(collector *otelcol.Collector,
+	runErrCh <-chan error) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.NewTimer(collectorStartTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case err := <-runErrCh:
+			if err == nil {
+				err = errors.New("collector exited while starting")
+			}
+			return fmt.Errorf("%w: %v", ErrCollectorStartFailure, err)
+		case <-ticker.C:
+			if collector.GetState() == otelcol.StateRunning {
+				return nil
+			}
+		case <-timeout.C:
+			c.logger.Warn("collector did not report running state in time",
+				zap.Duration("timeout", collectorStartTimeout),
+				zap.Stringer("state", collector.GetState()))
+			return nil
+		}
+	}
+}
+
+// StopCollector stops the running collector because of err. See
+// stopCollector for the shutdown sequence.
 func (c *HostAgent) StopCollector(err error) {
-	if c.collector != nil {
+	if collector, _ := c.getCollector(); collector != nil {
 		c.logger.Error("stopping telemetry collection", zap.Error(err))
-		c.collector.Shutdown()
-		c.collectorWG.Wait()
-		c.logger.Info("stopped telemetry collection at", zap.Time("time", time.Now()))
-		c.collector = nil
+		c.stopCollector()
 		return
 	}
 	c.logger.Error("received error while telemetry collection is not running", zap.Error(err))
 }
 
+// Shutdown stops the collector for good when the agent exits and sends a
+// final tracking event to the Middleware backend. The caller must stop the
+// goroutines that can start the collector before calling Shutdown.
+func (c *HostAgent) Shutdown() {
+	// a collector that did not exit when it was stopped already had
+	// shutdownTimeout to drain its queues
+	if collector, stopping := c.getCollector(); collector != nil && !stopping {
+		c.logger.Info("shutting down telemetry collection")
+		c.stopCollector()
+	}
+
+	if c.OfflineMode {
+		return
+	}
+
+	if err := c.updateAgentTrackStatus(trackStatusShutdown, nil); err != nil {
+		c.logger.Warn("failed to report agent shutdown", zap.Error(err))
+	}
+}
+
+// stopCollector shuts the collector down and waits at most shutdownTimeout
+// for it to exit. The collector stops its receivers first so that no new
+// data is accepted, then its processors, and drains the exporter queues
+// last.
+//
+// If the collector does not exit in time, it is kept as the collector of
+// the agent: StartCollector then waits for it to exit before starting a
+// new one on the same ports.
+func (c *HostAgent) stopCollector() {
+	collector, _ := c.getCollector()
+	// Shutdown blocks until the collector exits
+	go collector.Shutdown()
+
+	if !c.waitForCollectorExit(c.shutdownTimeout) {
+		c.logger.Warn("collector did not drain its exporter queues in time, pending data may be lost",
+			zap.Duration("timeout", c.shutdownTimeout))
+		c.collectorMu.Lock()
+		if c.collector == collector {
+			c.collectorStopping = true
+		}
+		c.collectorMu.Unlock()
+		return
+	}
+
+	c.logger.Info("stopped telemetry collection at", zap.Time("time", time.Now()))
+	c.setCollector(nil, nil)
+	c.recordCollectorState(false)
+}
+
+// getCollector returns the collector of the agent and whether it was
+// stopped without exiting.
+func (c *HostAgent) getCollector() (*otelcol.Collector, bool) {
+	c.collectorMu.Lock()
+	defer c.collectorMu.Unlock()
+	return c.collector, c.collectorStopping
+}
+
+// setCollector sets the collector of the agent and the channel that is
+// closed when its Run function returns.
+func (c *HostAgent) setCollector(collector *otelcol.Collector, exited chan struct{}) {
+	c.collectorMu.Lock()
+	defer c.collectorMu.Unlock()
+	c.collector = collector
+	c.collectorExited = exited
+	c.collectorStopping = false
+}
+
+// waitForCollectorExit waits at most timeout for the Run function of the
+// collector to return. It returns false on timeout.
+func (c *HostAgent) waitForCollectorExit(timeout time.Duration) bool {
+	c.collectorMu.Lock()
+	exited := c.collectorExited
+	c.collectorMu.Unlock()
+	if exited == nil {
+		return true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-exited:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
 func (c *HostAgent) fixTelemetryConfig(config map[string]interface{}) map[string]interface{} {
 	serviceData, ok := config["service"].(map[string]interface{})
 	if !ok {
@@ -858,6 +1523,11 @@ func (c *HostAgent) ReportServices(
 		return nil
 	}
 
+	if c.OfflineMode {
+		c.logger.Info("service discovery reporting is not available in offline mode; skipping")
+		return nil
+	}
+
 	// Parse duration, fallback to 5m if invalid or empty
 	reportInterval, err := time.ParseDuration(c.ServiceReportInterval)
 	if err != nil || reportInterval <= 0 {
@@ -918,10 +1588,21 @@ func (c *HostAgent) ReportAgentStatusAPI() error {
 	}()
 	hostname := getHostname()
 	apikey := c.APIKey
-	err := otelinject.ReportStatusWithLogger(hostname, apikey, c.APIURLForConfigCheck, c.Version, c.InfraPlatform.String(), zapToSlog(c.logger))
+	relayURL, stopRelay, err := c.startServiceReportRelay()
+	if err != nil {
+		err = newControlPlaneError(fmt.Errorf("%w: %v", ErrReportApiFailure, err))
+		c.metrics.recordServiceReport(err)
+		return err
+	}
+	defer stopRelay()
+
+	err = otelinject.ReportStatusWithLogger(hostname, apikey, relayURL, c.Version, c.InfraPlatform.String(), zapToSlog(c.logger))
 	if err != nil {
 		zap.Error(err)
-		return fmt.Errorf("%w: %v", ErrReportApiFailure, err)
+		// otelinject puts the api key in the urls of the relay
+		err = newControlPlaneError(fmt.Errorf("%w: %v", ErrReportApiFailure,
+			redact.String(err.Error(), c.APIKey)))
 	}
-	return nil
+	c.metrics.recordServiceReport(err)
+	return err
 }
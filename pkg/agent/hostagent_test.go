@@ -1,10 +1,19 @@
 package agent
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,10 +21,12 @@ import (
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/exporter"
 	"go.opentelemetry.io/collector/extension"
+	"go.opentelemetry.io/collector/otelcol"
 	"go.opentelemetry.io/collector/processor"
 	"go.opentelemetry.io/collector/receiver"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func TestUpdatepgdbConfig(t *testing.T) {
@@ -29,6 +40,11 @@ func TestUpdatepgdbConfig(t *testing.T) {
 				"password": "mypassword",
 			},
 		},
+		"service": map[string]interface{}{
+			"pipelines": map[string]interface{}{
+				"metrics": map[string]interface{}{"receivers": []interface{}{"postgresql"}},
+			},
+		},
 	}
 
 	pgdbConfig := integrationConfiguration{
@@ -36,9 +52,10 @@ func TestUpdatepgdbConfig(t *testing.T) {
 	}
 
 	zapCore := zapcore.NewNopCore()
-	agent, _ := NewHostAgent(HostConfig{}, zapCore)
+	agent, err := NewHostAgent(HostConfig{BaseConfig: BaseConfig{ConfigCheckInterval: "60s"}}, zapCore)
+	assert.NoError(t, err)
 	// Call the updatepgdbConfig function
-	updatedConfig, err := agent.updateConfig(initialConfig, pgdbConfig)
+	updatedConfig, err := agent.updateConfig(initialConfig, PostgreSQL, pgdbConfig)
 	assert.NoError(t, err)
 
 	// Assert that the updated config contains the expected values
@@ -65,6 +82,11 @@ func TestUpdateMongodbConfig(t *testing.T) {
 				"password": "mypassword",
 			},
 		},
+		"service": map[string]interface{}{
+			"pipelines": map[string]interface{}{
+				"metrics": map[string]interface{}{"receivers": []interface{}{"mongodb"}},
+			},
+		},
 	}
 
 	mongodbConfig := integrationConfiguration{
@@ -72,9 +94,10 @@ func TestUpdateMongodbConfig(t *testing.T) {
 	}
 
 	zapCore := zapcore.NewNopCore()
-	agent, _ := NewHostAgent(HostConfig{}, zapCore)
+	agent, err := NewHostAgent(HostConfig{BaseConfig: BaseConfig{ConfigCheckInterval: "60s"}}, zapCore)
+	assert.NoError(t, err)
 
-	updatedConfig, err := agent.updateConfig(initialConfig, mongodbConfig)
+	updatedConfig, err := agent.updateConfig(initialConfig, MongoDB, mongodbConfig)
 	assert.NoError(t, err)
 
 	// Assert that the updated config contains the expected values
@@ -101,6 +124,11 @@ func TestUpdateMysqlConfig(t *testing.T) {
 				"password": "mypassword",
 			},
 		},
+		"service": map[string]interface{}{
+			"pipelines": map[string]interface{}{
+				"metrics": map[string]interface{}{"receivers": []interface{}{"mysql"}},
+			},
+		},
 	}
 
 	mysqlConfig := integrationConfiguration{
@@ -108,10 +136,12 @@ func TestUpdateMysqlConfig(t *testing.T) {
 	}
 
 	cfg := HostConfig{}
+	cfg.ConfigCheckInterval = "60s"
 	zapCore := zapcore.NewNopCore()
-	agent, _ := NewHostAgent(cfg, zapCore)
+	agent, err := NewHostAgent(cfg, zapCore)
+	assert.NoError(t, err)
 	// Call the updateMysqlConfig function
-	updatedConfig, err := agent.updateConfig(initialConfig, mysqlConfig)
+	updatedConfig, err := agent.updateConfig(initialConfig, MySQL, mysqlConfig)
 	assert.NoError(t, err)
 
 	// Assert that the updated config contains the expected values
@@ -136,6 +166,11 @@ func TestUpdateRedisConfig(t *testing.T) {
 				"password": "mypassword",
 			},
 		},
+		"service": map[string]interface{}{
+			"pipelines": map[string]interface{}{
+				"metrics": map[string]interface{}{"receivers": []interface{}{"redis"}},
+			},
+		},
 	}
 
 	redisConfig := integrationConfiguration{
@@ -143,10 +178,12 @@ func TestUpdateRedisConfig(t *testing.T) {
 	}
 
 	cfg := HostConfig{}
+	cfg.ConfigCheckInterval = "60s"
 	zapCore := zapcore.NewNopCore()
-	agent, _ := NewHostAgent(cfg, zapCore)
+	agent, err := NewHostAgent(cfg, zapCore)
+	assert.NoError(t, err)
 	// Call the updateRedisConfig function
-	updatedConfig, err := agent.updateConfig(initialConfig, redisConfig)
+	updatedConfig, err := agent.updateConfig(initialConfig, Redis, redisConfig)
 	assert.NoError(t, err)
 
 	// Assert that the updated config contains the expected values
@@ -171,10 +208,11 @@ func TestListenForConfigChanges(t *testing.T) {
 
 	zapCore := zapcore.NewNopCore()
 	agent, _ := NewHostAgent(cfg, zapCore)
-	agent.httpGetFunc = func(url string) (resp *http.Response, err error) {
-		return nil, fmt.Errorf("failed to call get configuration api for %s: %w", url,
-			errors.New("test error"))
-	}
+	agent.backendClient = NewBackendClient(zap.NewNop(), WithBackendClientHTTPDoFunc(
+		func(req *http.Request) (resp *http.Response, err error) {
+			return nil, fmt.Errorf("failed to call get configuration api for %s: %w", req.URL,
+				errors.New("test error"))
+		}))
 
 	errCh := make(chan error)
 
@@ -274,10 +312,13 @@ func TestHostAgentGetFactories(t *testing.T) {
 	assert.NotNil(t, factories.Processors)
 
 	// check that the returned factories contain the expected factories
-	assert.Len(t, factories.Extensions, 1)
+	assert.Len(t, factories.Extensions, 4)
 	assertContainsComponent(t, factories.Extensions, "health_check")
+	assertContainsComponent(t, factories.Extensions, "file_storage")
+	assertContainsComponent(t, factories.Extensions, "host_observer")
+	assertContainsComponent(t, factories.Extensions, "docker_observer")
 	// check if factories contains expected receivers
-	assert.Len(t, factories.Receivers, 24)
+	assert.Len(t, factories.Receivers, 25)
 	assertContainsComponent(t, factories.Receivers, "otlp")
 	assertContainsComponent(t, factories.Receivers, "fluentforward")
 	assertContainsComponent(t, factories.Receivers, "filelog")
@@ -300,6 +341,7 @@ func TestHostAgentGetFactories(t *testing.T) {
 	assertContainsComponent(t, factories.Receivers, "sqlserver")
 	assertContainsComponent(t, factories.Receivers, "nginx")
 	assertContainsComponent(t, factories.Receivers, "mongodbatlas")
+	assertContainsComponent(t, factories.Receivers, "receiver_creator")
 	assertContainsComponent(t, factories.Receivers, "zookeeper")
 
 	// check if factories contain expected exporters
@@ -414,8 +456,9 @@ func TestUpdateAgentTrackStatus(t *testing.T) {
 						APIURLForConfigCheck: mockServer.URL,
 					},
 				},
-				logger:  logger,
-				Version: "1.0.0",
+				logger:        logger,
+				backendClient: NewBackendClient(logger),
+				Version:       "1.0.0",
 			}
 
 			err := hostAgent.UpdateAgentTrackStatus(errors.New("test reason"))
@@ -430,3 +473,295 @@ func TestUpdateAgentTrackStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestShutdownReportsTrackStatus(t *testing.T) {
+	var payload TrackingPayload
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	logger := zap.NewNop()
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{
+			BaseConfig: BaseConfig{
+				APIKey:               "testAPIKey",
+				APIURLForConfigCheck: mockServer.URL,
+			},
+		},
+		logger:        logger,
+		backendClient: NewBackendClient(logger),
+		Version:       "1.0.0",
+	}
+
+	// no collector is running, Shutdown only reports the shutdown
+	hostAgent.Shutdown()
+	assert.Equal(t, trackStatusShutdown, payload.Status)
+	assert.Empty(t, payload.Metadata.Reason)
+}
+
+func TestStopCollectorTimeout(t *testing.T) {
+	hostAgent := &HostAgent{
+		logger:          zap.NewNop(),
+		shutdownTimeout: 20 * time.Millisecond,
+		collectorSettings: otelcol.CollectorSettings{
+			DisableGracefulShutdown: true,
+			Factories:               func() (otelcol.Factories, error) { return otelcol.Factories{}, nil },
+			ConfigProviderSettings:  NewConfigProviderSettings("yaml:receivers: {}", nil),
+		},
+	}
+
+	collector, err := otelcol.NewCollector(hostAgent.collectorSettings)
+	assert.NoError(t, err)
+	// the collector does not exit when it is stopped
+	exited := make(chan struct{})
+	hostAgent.setCollector(collector, exited)
+
+	hostAgent.StopCollector(ErrRestartAgent)
+	current, stopping := hostAgent.getCollector()
+	assert.Same(t, collector, current)
+	assert.True(t, stopping)
+
+	// a new collector is not started while the stopped one still runs
+	err = hostAgent.StartCollector()
+	assert.ErrorIs(t, err, ErrCollectorStillRunning)
+	current, _ = hostAgent.getCollector()
+	assert.Same(t, collector, current)
+	assert.ErrorIs(t, hostAgent.ReloadCollector(), ErrCollectorNotRunning)
+
+	// once it exits, a new collector is started
+	close(exited)
+	err = hostAgent.StartCollector()
+	assert.ErrorIs(t, err, ErrCollectorStartFailure)
+	current, _ = hostAgent.getCollector()
+	assert.NotSame(t, collector, current)
+}
+
+func TestListenForConfigChangesZeroInterval(t *testing.T) {
+	cfg := HostConfig{
+		BaseConfig: BaseConfig{
+			APIKey:               "testAPIKey",
+			APIURLForConfigCheck: "http://example.com",
+		},
+	}
+	cfg.ConfigCheckInterval = "0"
+
+	agent, err := NewHostAgent(cfg, zapcore.NewNopCore())
+	assert.NoError(t, err)
+	var calls atomic.Int32
+	agent.backendClient = NewBackendClient(zap.NewNop(), WithBackendClientHTTPDoFunc(
+		func(req *http.Request) (resp *http.Response, err error) {
+			calls.Add(1)
+			return nil, errors.New("test error")
+		}))
+
+	errCh := make(chan error, 1)
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		agent.ListenForConfigChanges(errCh, stopCh)
+		close(done)
+	}()
+
+	// the config is fetched once at start-up only
+	assert.Error(t, <-errCh)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int32(1), calls.Load())
+
+	close(stopCh)
+	<-done
+}
+
+func TestUpdateConfigFileUnchanged(t *testing.T) {
+	config := map[string]interface{}{
+		"receivers": map[string]interface{}{
+			"otlp": map[string]interface{}{},
+		},
+	}
+	rendered, err := yaml.Marshal(config)
+	assert.NoError(t, err)
+
+	otelConfigFile := filepath.Join(t.TempDir(), "otel-config.yaml")
+	assert.NoError(t, os.WriteFile(otelConfigFile, rendered, 0644))
+
+	body, err := json.Marshal(map[string]interface{}{
+		"status": true,
+		"config": map[string]interface{}{
+			"docker":   config,
+			"nodocker": config,
+		},
+	})
+	assert.NoError(t, err)
+	sum := sha256.Sum256(body)
+
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			// the hash is the one of the document served by the backend
+			assert.Equal(t, hex.EncodeToString(sum[:]), r.URL.Query().Get("config_hash"))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		assert.Empty(t, r.URL.Query().Get("config_hash"))
+		assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		_, err := gz.Write(body)
+		assert.NoError(t, err)
+	}))
+	defer mockServer.Close()
+
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{
+			BaseConfig: BaseConfig{
+				APIKey:               "testAPIKey",
+				APIURLForConfigCheck: mockServer.URL,
+				OtelConfigFile:       otelConfigFile,
+				AgentFeatures: AgentFeatures{
+					MetricCollection: true,
+					LogCollection:    true,
+				},
+			},
+		},
+		logger:        zap.NewNop(),
+		backendClient: NewBackendClient(zap.NewNop()),
+	}
+
+	// the rendered config is byte-identical to the running one
+	err = hostAgent.updateConfigFile("nodocker")
+	assert.True(t, errors.Is(err, ErrConfigUnchanged), err)
+	assert.Equal(t, `"v1"`, hostAgent.appliedDocument.ETag)
+
+	// the backend answers 304 to the ETag of the applied config
+	err = hostAgent.updateConfigFile("nodocker")
+	assert.True(t, errors.Is(err, ErrConfigUnchanged))
+	assert.Equal(t, 2, requests)
+}
+
+func TestCallRestartStatusAPIControlPlaneError(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer mockServer.Close()
+
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{
+			BaseConfig: BaseConfig{
+				APIKey:               "testAPIKey",
+				APIURLForConfigCheck: mockServer.URL,
+			},
+		},
+		logger:        zap.NewNop(),
+		backendClient: NewBackendClient(zap.NewNop()),
+	}
+
+	err := hostAgent.callRestartStatusAPI()
+	assert.True(t, errors.Is(err, ErrControlPlane))
+	assert.False(t, errors.Is(err, ErrDataPlane))
+	assert.False(t, errors.Is(err, ErrRestartAgent))
+}
+
+func TestParseControlPlaneErrorPolicy(t *testing.T) {
+	policy, err := ParseControlPlaneErrorPolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, ControlPlaneErrorKeepRunning, policy)
+
+	policy, err = ParseControlPlaneErrorPolicy("stop")
+	assert.NoError(t, err)
+	assert.Equal(t, ControlPlaneErrorStop, policy)
+
+	_, err = ParseControlPlaneErrorPolicy("restart")
+	assert.True(t, errors.Is(err, ErrInvalidControlPlaneErrorPolicy))
+}
+
+func TestStartsWithLastConfig(t *testing.T) {
+	otelConfigFile := filepath.Join(t.TempDir(), "otel-config.yaml")
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{
+			BaseConfig: BaseConfig{
+				OtelConfigFile: otelConfigFile,
+			},
+		},
+		controlPlanePolicy: ControlPlaneErrorKeepRunning,
+	}
+	controlPlaneErr := newControlPlaneError(errors.New("connection refused"))
+
+	// no config was applied in a previous run
+	assert.False(t, hostAgent.StartsWithLastConfig(controlPlaneErr))
+
+	assert.NoError(t, os.WriteFile(otelConfigFile, []byte("receivers: {}"), 0644))
+	assert.True(t, hostAgent.StartsWithLastConfig(controlPlaneErr))
+	assert.False(t, hostAgent.StartsWithLastConfig(ErrRestartAgent))
+
+	hostAgent.controlPlanePolicy = ControlPlaneErrorStop
+	assert.False(t, hostAgent.StartsWithLastConfig(controlPlaneErr))
+
+	// the collector was started and stopped since
+	hostAgent.controlPlanePolicy = ControlPlaneErrorKeepRunning
+	hostAgent.collectorStarts = 1
+	assert.False(t, hostAgent.StartsWithLastConfig(controlPlaneErr))
+}
+
+func TestAPIKeyNotLogged(t *testing.T) {
+	const apiKey = "4f1c2e8a9b7d6f3e5a0c"
+
+	var buf bytes.Buffer
+	zapCore := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.AddSync(&buf), zapcore.DebugLevel)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer "+apiKey, r.Header.Get("Authorization"))
+		assert.NotContains(t, r.URL.String(), apiKey)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	// a backend without support for the header, the key goes in the path
+	var pathCalls atomic.Int32
+	pathServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, apiKey) {
+			pathCalls.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer pathServer.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	for _, apiURL := range []string{server.URL, pathServer.URL, unreachable.URL} {
+		cfg := HostConfig{
+			BaseConfig: BaseConfig{
+				APIKey:               apiKey,
+				APIURLForConfigCheck: apiURL,
+				ConfigCheckInterval:  "1s",
+			},
+		}
+		hostAgent, err := NewHostAgent(cfg, zapCore)
+		assert.NoError(t, err)
+		hostAgent.logger.Info("host agent config", zap.Stringer("config", hostAgent.HostConfig))
+
+		for _, call := range []func() error{
+			hostAgent.callRestartStatusAPI,
+			hostAgent.applyConfigClassToHosts,
+			func() error { return hostAgent.UpdateAgentTrackStatus(nil) },
+			func() error {
+				_, err := hostAgent.getOtelConfig()
+				return err
+			},
+		} {
+			err := call()
+			assert.Error(t, err)
+			hostAgent.logger.Error("backend call failed", zap.Error(err))
+		}
+	}
+
+	assert.NotZero(t, pathCalls.Load())
+	assert.Contains(t, buf.String(), "backend call failed")
+	assert.NotContains(t, buf.String(), apiKey)
+}
@@ -0,0 +1,538 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/confmap"
+	"go.uber.org/zap"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	ErrInvalidIntegration = errors.New("invalid integration config")
+)
+
+// integrationNameRegex matches the valid instance names, the names of the
+// collector components: no spaces, control characters or symbols.
+var integrationNameRegex = regexp.MustCompile(`^[^\pZ\pC\pS]+$`)
+
+// logReceiverTypes are the receivers of the integration files added to the
+// logs pipeline, the others are added to the metrics pipeline.
+var logReceiverTypes = map[string]bool{
+	"filelog":         true,
+	"journald":        true,
+	"fluentforward":   true,
+	"windowseventlog": true,
+	"syslog":          true,
+	"tcplog":          true,
+	"udplog":          true,
+}
+
+// IntegrationError is an integration of the Middleware backend config which
+// could not be applied to the otel config.
+type IntegrationError struct {
+	Type     string `json:"type"`
+	Name     string `json:"name,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// integrationConfigurations are the instances of an integration type. The
+// backend sends either a single instance or a list of them.
+type integrationConfigurations []integrationConfiguration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (cnfs *integrationConfigurations) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		var list []integrationConfiguration
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		*cnfs = list
+		return nil
+	}
+
+	var cnf *integrationConfiguration
+	if err := json.Unmarshal(data, &cnf); err != nil {
+		return err
+	}
+	*cnfs = nil
+	if cnf != nil {
+		*cnfs = integrationConfigurations{*cnf}
+	}
+	return nil
+}
+
+// isSet returns true if the integration is configured.
+func (cnf integrationConfiguration) isSet() bool {
+	return cnf.Path != "" || cnf.Endpoint != ""
+}
+
+// endpointReceiver returns the ID and the config of the receiver scraping
+// the instance cnf of integrationType through its endpoint. The ID is named
+// after the instance, e.g. postgresql/orders or jmx/cassandra_orders.
+func endpointReceiver(integrationType IntegrationType, cnf integrationConfiguration) (string, map[string]interface{}, error) {
+	ep, err := parseEndpoint(cnf.Endpoint)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the receivers scraping an HTTP API take URLs, the mysql and redis
+	// receivers also take unix sockets, the others take host:port
+	isHTTP := ep.Scheme == endpointSchemeHTTP || ep.Scheme == endpointSchemeHTTPS
+	switch integrationType {
+	case Elasticsearch, RabbitMQ, Nginx, Apache, Clickhouse:
+		if ep.IsUnix() {
+			return "", nil, fmt.Errorf("%w: %s: %v does not support unix sockets",
+				ErrInvalidEndpoint, cnf.Endpoint, integrationType)
+		}
+	case MySQL, MariaDB, Redis:
+		if isHTTP {
+			return "", nil, fmt.Errorf("%w: %s: %v does not support http endpoints",
+				ErrInvalidEndpoint, cnf.Endpoint, integrationType)
+		}
+	default:
+		if ep.IsUnix() || isHTTP {
+			return "", nil, fmt.Errorf("%w: %s: %v expects a tcp endpoint",
+				ErrInvalidEndpoint, cnf.Endpoint, integrationType)
+		}
+	}
+
+	receiver := map[string]interface{}{}
+	credentials := func(usernameKey, passwordKey string) {
+		if cnf.Username != "" {
+			receiver[usernameKey] = cnf.Username
+		}
+		if cnf.Password != "" {
+			receiver[passwordKey] = cnf.Password
+		}
+	}
+	// the tls and tcp schemes turn TLS on and off, the receiver defaults
+	// are kept otherwise
+	tlsSetting := func() {
+		switch ep.Scheme {
+		case endpointSchemeTLS:
+			receiver["tls"] = map[string]interface{}{"insecure": false}
+		case endpointSchemeTCP:
+			receiver["tls"] = map[string]interface{}{"insecure": true}
+		}
+	}
+	// socketOrAddress sets the endpoint of the receivers taking either
+	// host:port or the path of a unix socket
+	socketOrAddress := func() {
+		if ep.IsUnix() {
+			receiver["transport"] = endpointSchemeUnix
+			receiver["endpoint"] = ep.Path
+			return
+		}
+		receiver["endpoint"] = ep.Address()
+		tlsSetting()
+	}
+
+	var id string
+	switch integrationType {
+	case PostgreSQL:
+		id = "postgresql"
+		receiver["endpoint"] = ep.Address()
+		tlsSetting()
+		credentials("username", "password")
+		if cnf.Database != "" {
+			receiver["databases"] = []interface{}{cnf.Database}
+		}
+	case MongoDB:
+		id = "mongodb"
+		receiver["hosts"] = []interface{}{map[string]interface{}{"endpoint": ep.Address()}}
+		tlsSetting()
+		credentials("username", "password")
+	case MySQL, MariaDB:
+		id = "mysql"
+		socketOrAddress()
+		credentials("username", "password")
+		if cnf.Database != "" {
+			receiver["database"] = cnf.Database
+		}
+	case Redis:
+		id = "redis"
+		socketOrAddress()
+		credentials("username", "password")
+	case Elasticsearch:
+		id = "elasticsearch"
+		receiver["endpoint"] = ep.URL("")
+		credentials("username", "password")
+	case OracleDB:
+		id = "oracledb"
+		receiver["endpoint"] = ep.Address()
+		credentials("username", "password")
+		if cnf.Database != "" {
+			receiver["service"] = cnf.Database
+		}
+	case SQLServer:
+		id = "sqlserver"
+		receiver["server"] = ep.Host
+		receiver["port"] = ep.Port
+		credentials("username", "password")
+	case RabbitMQ:
+		id = "rabbitmq"
+		receiver["endpoint"] = ep.URL("")
+		credentials("username", "password")
+	case Nginx:
+		id = "nginx"
+		receiver["endpoint"] = ep.URL("/status")
+	case Apache:
+		id = "apache"
+		receiver["endpoint"] = ep.URL("/server-status?auto")
+	case Zookeeper:
+		id = "zookeeper"
+		receiver["endpoint"] = ep.Address()
+	case Kafka:
+		id = "kafkametrics"
+		receiver["brokers"] = []interface{}{ep.Address()}
+		receiver["scrapers"] = []interface{}{"brokers", "topics", "consumers"}
+		tlsSetting()
+		if cnf.Username != "" {
+			receiver["auth"] = map[string]interface{}{
+				"sasl": map[string]interface{}{
+					"username":  cnf.Username,
+					"password":  cnf.Password,
+					"mechanism": "PLAIN",
+				},
+			}
+		}
+	case JMX:
+		id = "jmx"
+		receiver["jar_path"] = cnf.JarPath
+		receiver["endpoint"] = ep.Address()
+		receiver["target_system"] = "jvm"
+		credentials("username", "password")
+	case Cassandra:
+		// the metrics of Cassandra are exposed through JMX
+		id = "jmx/cassandra"
+		receiver["jar_path"] = cnf.JarPath
+		receiver["endpoint"] = ep.Address()
+		receiver["target_system"] = "cassandra,jvm"
+		credentials("username", "password")
+	case Clickhouse:
+		// ClickHouse exposes its metrics in the Prometheus format
+		scrapeConfig := map[string]interface{}{
+			"job_name":       "clickhouse",
+			"static_configs": []interface{}{map[string]interface{}{"targets": []interface{}{ep.Address()}}},
+		}
+		if ep.TLS() {
+			scrapeConfig["scheme"] = endpointSchemeHTTPS
+		}
+		if ep.Path != "" {
+			scrapeConfig["metrics_path"] = ep.Path
+		}
+		if cnf.Username != "" {
+			scrapeConfig["basic_auth"] = map[string]interface{}{
+				"username": cnf.Username,
+				"password": cnf.Password,
+			}
+		}
+		id = "prometheus/clickhouse"
+		receiver["config"] = map[string]interface{}{
+			"scrape_configs": []interface{}{scrapeConfig},
+		}
+	default:
+		return "", nil, fmt.Errorf("%w: %v can not be configured with an endpoint",
+			ErrInvalidIntegration, integrationType)
+	}
+
+	if cnf.Name != "" {
+		if strings.Contains(id, "/") {
+			id += "_" + cnf.Name
+		} else {
+			id += "/" + cnf.Name
+		}
+	}
+	return id, receiver, nil
+}
+
+// applyIntegrations applies the integration instances of
+// integrationConfigs to config. The instances which can not be applied are
+// left out of config and returned, config is not changed by them. The
+// unnamed instances of a list of several are named after their position in
+// it, starting from 1, so that each has its own receivers. Those names
+// follow the order of the list: reordering it in the backend swaps the
+// receivers, and thus the series, of the unnamed instances.
+func (c *HostAgent) applyIntegrations(config map[string]interface{},
+	integrationConfigs map[IntegrationType]integrationConfigurations) (map[string]interface{}, []IntegrationError) {
+	integrationTypes := make([]IntegrationType, 0, len(integrationConfigs))
+	for integrationType := range integrationConfigs {
+		integrationTypes = append(integrationTypes, integrationType)
+	}
+	sort.Slice(integrationTypes, func(i, j int) bool {
+		return integrationTypes[i] < integrationTypes[j]
+	})
+
+	var integrationErrors []IntegrationError
+	for _, integrationType := range integrationTypes {
+		cnfs := integrationConfigs[integrationType]
+		for i, cnf := range cnfs {
+			if !cnf.isSet() {
+				continue
+			}
+			if cnf.Name == "" && len(cnfs) > 1 {
+				cnf.Name = fmt.Sprint(i + 1)
+			}
+
+			err := c.checkIntConfigValidity(integrationType, cnf)
+			if err == nil {
+				var updated map[string]interface{}
+				if updated, err = c.updateConfig(config, integrationType, cnf); err == nil {
+					config = updated
+				}
+			}
+			if err != nil {
+				c.logger.Warn("failed to apply integration",
+					zap.Stringer("integration", integrationType),
+					zap.String("name", cnf.Name),
+					zap.String("path", cnf.Path),
+					zap.String("endpoint", cnf.Endpoint),
+					zap.Error(err))
+				integrationErrors = append(integrationErrors, IntegrationError{
+					Type:     integrationType.String(),
+					Name:     cnf.Name,
+					Path:     cnf.Path,
+					Endpoint: cnf.Endpoint,
+					Reason:   err.Error(),
+				})
+			}
+		}
+	}
+
+	c.recordIntegrationErrors(integrationErrors)
+	return config, integrationErrors
+}
+
+// loadIntegrationFile returns the receivers defined by the integration
+// file path, keyed by receiver ID, e.g. postgresql/orders. The IDs must be
+// valid component IDs of receiver types the collector supports.
+func (c *HostAgent) loadIntegrationFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var receivers map[interface{}]interface{}
+	if err := yaml.Unmarshal(convertTabsToSpaces(data, 2), &receivers); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidIntegration, path, err)
+	}
+
+	// the secrets are resolved by the collector, fail early if it can't
+	if err := c.SecretResolver().CheckReferences(receivers); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	factories, err := c.getFactories()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get factories: %w", err)
+	}
+
+	receiversConfig, _ := normalizeYAML(receivers).(map[string]interface{})
+	for id, receiver := range receiversConfig {
+		var componentID component.ID
+		if err := componentID.UnmarshalText([]byte(id)); err != nil {
+			return nil, fmt.Errorf("%w: %s: invalid receiver id %q: %v", ErrInvalidIntegration, path, id, err)
+		}
+		if _, ok := factories.Receivers[componentID.Type()]; !ok {
+			return nil, fmt.Errorf("%w: %s: unknown receiver type %q", ErrInvalidIntegration, path,
+				componentID.Type())
+		}
+		if _, ok := receiver.(map[string]interface{}); !ok && receiver != nil {
+			return nil, fmt.Errorf("%w: %s: receiver %s is not a map", ErrInvalidIntegration, path, id)
+		}
+	}
+	return receiversConfig, nil
+}
+
+// mergeReceiver deep merges src into the receiver config dst, keeping the
+// types of the values of both, and returns the merged config.
+func mergeReceiver(dst, src interface{}) (map[string]interface{}, error) {
+	dstMap, _ := dst.(map[string]interface{})
+	srcMap, _ := src.(map[string]interface{})
+
+	conf := confmap.NewFromStringMap(dstMap)
+	if err := conf.Merge(confmap.NewFromStringMap(srcMap)); err != nil {
+		return nil, err
+	}
+
+	merged := conf.ToStringMap()
+	if merged == nil {
+		merged = map[string]interface{}{}
+	}
+	return merged, nil
+}
+
+// receiverPipeline returns the pipeline of the receiver id: logs for the
+// log receivers, metrics for the others.
+func receiverPipeline(id string) string {
+	receiverType, _, _ := strings.Cut(id, "/")
+	if logReceiverTypes[receiverType] {
+		return Logs
+	}
+	return Metrics
+}
+
+// pipelineComponents returns the components of kind, e.g. Receivers, of
+// the pipeline name of pipelinesData.
+func pipelineComponents(pipelinesData map[string]interface{}, name, kind string) ([]interface{}, error) {
+	pipelineData, ok := pipelinesData[name].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: no %s pipeline", ErrParsePipelines, name)
+	}
+
+	components := []interface{}{}
+	switch pipelineComponents := pipelineData[kind].(type) {
+	case []interface{}:
+		components = append(components, pipelineComponents...)
+	case []string:
+		for _, component := range pipelineComponents {
+			components = append(components, component)
+		}
+	}
+	return components, nil
+}
+
+// addPipelineReceiver adds the receiver id to the pipeline name of
+// pipelinesData, unless it is already in it.
+func addPipelineReceiver(pipelinesData map[string]interface{}, name, id string) error {
+	receivers, err := pipelineComponents(pipelinesData, name, Receivers)
+	if err != nil {
+		return err
+	}
+
+	for _, receiver := range receivers {
+		if receiver == id {
+			return nil
+		}
+	}
+	pipelinesData[name].(map[string]interface{})[Receivers] = append(receivers, id)
+	return nil
+}
+
+// addInstancePipeline moves the receiver id from its metrics or logs
+// pipeline to a copy of it adding attributes to the resources of its
+// telemetry with a resource processor, e.g. the metrics/postgresql_orders
+// pipeline with the resource/postgresql_orders processor.
+func addInstancePipeline(config, pipelinesData map[string]interface{}, id string,
+	attributes map[string]string) error {
+	processorsData, ok := config[Processors].(map[string]interface{})
+	if !ok {
+		if _, exists := config[Processors]; exists {
+			return ErrParseProcessors
+		}
+		processorsData = map[string]interface{}{}
+		config[Processors] = processorsData
+	}
+
+	base := receiverPipeline(id)
+	receivers, err := pipelineComponents(pipelinesData, base, Receivers)
+	if err != nil {
+		return err
+	}
+	processors, _ := pipelineComponents(pipelinesData, base, Processors)
+	exporters, _ := pipelineComponents(pipelinesData, base, Exporters)
+
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	resourceAttributes := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		resourceAttributes = append(resourceAttributes, map[string]interface{}{
+			"key":    key,
+			"action": "upsert",
+			"value":  attributes[key],
+		})
+	}
+
+	suffix := strings.ReplaceAll(id, "/", "_")
+	processorID := "resource/" + suffix
+	processorsData[processorID] = map[string]interface{}{
+		"attributes": resourceAttributes,
+	}
+
+	// the resource processor follows the memory limiter
+	i := 0
+	for i < len(processors) && strings.HasPrefix(fmt.Sprint(processors[i]), "memory_limiter") {
+		i++
+	}
+	processors = append(processors[:i], append([]interface{}{processorID}, processors[i:]...)...)
+
+	remaining := make([]interface{}, 0, len(receivers))
+	for _, receiver := range receivers {
+		if receiver != id {
+			remaining = append(remaining, receiver)
+		}
+	}
+	pipelinesData[base].(map[string]interface{})[Receivers] = remaining
+
+	pipelinesData[base+"/"+suffix] = map[string]interface{}{
+		Receivers:  []interface{}{id},
+		Processors: processors,
+		Exporters:  exporters,
+	}
+	return nil
+}
+
+// recordIntegrationErrors records the integrations which could not be
+// applied to the last config built, reported by the status API.
+func (c *HostAgent) recordIntegrationErrors(integrationErrors []IntegrationError) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.runtimeStatus.integrationErrors = integrationErrors
+}
+
+// reportIntegrationErrors reports the integrations which could not be
+// applied to the last config built to the Middleware backend, unless the
+// same ones were already reported.
+func (c *HostAgent) reportIntegrationErrors() {
+	c.statusMu.Lock()
+	integrationErrors := c.runtimeStatus.integrationErrors
+	reported := reflect.DeepEqual(integrationErrors, c.runtimeStatus.reportedIntegrationErrors)
+	c.statusMu.Unlock()
+
+	if reported {
+		return
+	}
+
+	if len(integrationErrors) > 0 {
+		errs := make([]error, 0, len(integrationErrors))
+		for _, integrationError := range integrationErrors {
+			errs = append(errs, integrationError.err())
+		}
+
+		err := fmt.Errorf("%w: %w", ErrInvalidIntegration, errors.Join(errs...))
+		if trackErr := c.updateAgentTrackStatus(trackStatusIntegration, err); trackErr != nil {
+			// reported again with the next config
+			c.logger.Error("failed to update agent track status", zap.Error(trackErr))
+			return
+		}
+	}
+
+	c.statusMu.Lock()
+	c.runtimeStatus.reportedIntegrationErrors = integrationErrors
+	c.statusMu.Unlock()
+}
+
+func (e IntegrationError) err() error {
+	instance := e.Type
+	if e.Name != "" {
+		instance += " " + e.Name
+	}
+	return fmt.Errorf("%s: %s", instance, e.Reason)
+}
@@ -0,0 +1,360 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+)
+
+func newIntegrationsTestConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"receivers": map[string]interface{}{
+			"postgresql": map[string]interface{}{
+				"endpoint":            "localhost:5432",
+				"collection_interval": "60s",
+				"tls":                 map[string]interface{}{"insecure": true},
+			},
+		},
+		"service": map[string]interface{}{
+			"pipelines": map[string]interface{}{
+				"metrics": map[string]interface{}{"receivers": []interface{}{"hostmetrics", "postgresql"}},
+			},
+		},
+	}
+}
+
+func TestUpdateConfigNewReceivers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "postgresql.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+postgresql:
+  username: agent
+  tls:
+    insecure_skip_verify: true
+postgresql/orders:
+  endpoint: orders-db:5432
+  databases: [orders]
+  initial_delay: 5
+`), 0600))
+
+	agent, err := NewHostAgent(HostConfig{BaseConfig: BaseConfig{ConfigCheckInterval: "60s"}},
+		zapcore.NewNopCore())
+	assert.NoError(t, err)
+
+	config, err := agent.updateConfig(newIntegrationsTestConfig(), PostgreSQL, integrationConfiguration{Path: path})
+	assert.NoError(t, err)
+
+	receivers := config["receivers"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{
+		"endpoint":            "localhost:5432",
+		"collection_interval": "60s",
+		"username":            "agent",
+		"tls":                 map[string]interface{}{"insecure": true, "insecure_skip_verify": true},
+	}, receivers["postgresql"])
+	assert.Equal(t, map[string]interface{}{
+		"endpoint":      "orders-db:5432",
+		"databases":     []interface{}{"orders"},
+		"initial_delay": 5,
+	}, receivers["postgresql/orders"])
+
+	metrics := config["service"].(map[string]interface{})["pipelines"].(map[string]interface{})["metrics"]
+	assert.Equal(t, []interface{}{"hostmetrics", "postgresql", "postgresql/orders"},
+		metrics.(map[string]interface{})[Receivers])
+}
+
+func TestApplyIntegrations(t *testing.T) {
+	dir := t.TempDir()
+	mysqlPath := filepath.Join(dir, "mysql.yaml")
+	assert.NoError(t, os.WriteFile(mysqlPath, []byte("mysql/replica:\n  endpoint: replica:3306\n"), 0600))
+	redisPath := filepath.Join(dir, "redis.yaml")
+	assert.NoError(t, os.WriteFile(redisPath, []byte("redis:\n  endpoint: localhost:6379\n"+
+		"filelog/redis:\n  include: [/var/log/redis/*.log]\n"), 0600))
+
+	agent, err := NewHostAgent(HostConfig{BaseConfig: BaseConfig{ConfigCheckInterval: "60s"}},
+		zapcore.NewNopCore())
+	assert.NoError(t, err)
+
+	config, integrationErrors := agent.applyIntegrations(newIntegrationsTestConfig(),
+		map[IntegrationType]integrationConfigurations{
+			MySQL:      {{Path: mysqlPath}},
+			Redis:      {{Path: redisPath}},
+			MongoDB:    {{Path: filepath.Join(dir, "missing.yaml")}},
+			Clickhouse: {{Endpoint: "clickhouse"}},
+			Cassandra:  {{}},
+		})
+
+	// the integrations which could not be applied are reported, in order
+	assert.Len(t, integrationErrors, 3)
+	assert.Equal(t, "mongodb", integrationErrors[0].Type)
+	assert.Equal(t, "redis", integrationErrors[1].Type)
+	assert.Contains(t, integrationErrors[1].Reason, "no logs pipeline")
+	assert.Equal(t, "clickhouse", integrationErrors[2].Type)
+	assert.Equal(t, integrationErrors, agent.Status().IntegrationErrors)
+
+	// the others are applied, the failed ones do not change the config
+	receivers := config["receivers"].(map[string]interface{})
+	assert.Contains(t, receivers, "mysql/replica")
+	assert.NotContains(t, receivers, "redis")
+	assert.NotContains(t, receivers, "filelog/redis")
+}
+
+func TestApplyIntegrationsInvalidReceiverIDs(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"invalid.yaml": "postgresql/my orders:\n  endpoint: localhost:5432\n",
+		"unknown.yaml": "postgresqll:\n  endpoint: localhost:5432\n",
+		"valid.yaml":   "redis/cache:\n  endpoint: localhost:6379\n",
+	} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+
+	agent, err := NewHostAgent(HostConfig{BaseConfig: BaseConfig{ConfigCheckInterval: "60s"}},
+		zapcore.NewNopCore())
+	assert.NoError(t, err)
+
+	config, integrationErrors := agent.applyIntegrations(newIntegrationsTestConfig(),
+		map[IntegrationType]integrationConfigurations{
+			PostgreSQL: {
+				{Name: "invalid", Path: filepath.Join(dir, "invalid.yaml")},
+				{Name: "unknown", Path: filepath.Join(dir, "unknown.yaml")},
+			},
+			Redis: {{Path: filepath.Join(dir, "valid.yaml")}},
+		})
+
+	// the files with invalid receivers are reported instead of failing the
+	// whole config
+	assert.Len(t, integrationErrors, 2)
+	assert.Contains(t, integrationErrors[0].Reason, `invalid receiver id "postgresql/my orders"`)
+	assert.Contains(t, integrationErrors[1].Reason, `unknown receiver type "postgresqll"`)
+
+	receivers := config["receivers"].(map[string]interface{})
+	assert.Contains(t, receivers, "redis/cache")
+	assert.NotContains(t, receivers, "postgresqll/unknown")
+}
+
+func TestApplyIntegrationInstances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "postgresql.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("postgresql:\n  username: agent\n"), 0600))
+
+	var response apiResponseForYAML
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"pgdb_config": [
+			{"name": "orders", "path": "`+path+`", "resource_attributes": {"team": "checkout"}},
+			{"endpoint": "127.0.0.1:5433"},
+			{"name": "orders", "endpoint": "127.0.0.1:5434"},
+			{"name": "orders db", "endpoint": "127.0.0.1:5435"}
+		],
+		"redis_config": {"endpoint": "127.0.0.1:6379"},
+		"mongodb_config": null
+	}`), &response))
+	assert.Len(t, response.PgdbConfig, 4)
+	assert.Len(t, response.RedisConfig, 1)
+	assert.Empty(t, response.MongodbConfig)
+
+	agent, err := NewHostAgent(HostConfig{BaseConfig: BaseConfig{ConfigCheckInterval: "60s"}},
+		zapcore.NewNopCore())
+	assert.NoError(t, err)
+
+	config := newIntegrationsTestConfig()
+	pipelines := config["service"].(map[string]interface{})["pipelines"].(map[string]interface{})
+	pipelines["metrics"].(map[string]interface{})["processors"] = []interface{}{"memory_limiter", "batch"}
+	pipelines["metrics"].(map[string]interface{})["exporters"] = []interface{}{"otlp"}
+
+	config, integrationErrors := agent.applyIntegrations(config,
+		map[IntegrationType]integrationConfigurations{
+			PostgreSQL: response.PgdbConfig,
+			Redis:      response.RedisConfig,
+			MongoDB:    response.MongodbConfig,
+		})
+
+	// the names of the instances are unique and valid component names
+	assert.Len(t, integrationErrors, 2)
+	assert.Equal(t, "orders", integrationErrors[0].Name)
+	assert.Contains(t, integrationErrors[0].Reason, "receiver postgresql/orders already exists")
+	assert.Equal(t, "orders db", integrationErrors[1].Name)
+	assert.Contains(t, integrationErrors[1].Reason, `invalid name "orders db"`)
+
+	receivers := config["receivers"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"username": "agent"}, receivers["postgresql/orders"])
+	assert.Equal(t, map[string]interface{}{"endpoint": "127.0.0.1:5433"}, receivers["postgresql/2"])
+	assert.Equal(t, map[string]interface{}{"endpoint": "127.0.0.1:6379"}, receivers["redis"])
+
+	// the instance with resource attributes has a pipeline of its own
+	assert.Equal(t, []interface{}{"hostmetrics", "postgresql", "postgresql/2", "redis"},
+		pipelines["metrics"].(map[string]interface{})["receivers"])
+	assert.Equal(t, map[string]interface{}{
+		"receivers":  []interface{}{"postgresql/orders"},
+		"processors": []interface{}{"memory_limiter", "resource/postgresql_orders", "batch"},
+		"exporters":  []interface{}{"otlp"},
+	}, pipelines["metrics/postgresql_orders"])
+	assert.Equal(t, map[string]interface{}{
+		"attributes": []map[string]interface{}{{"key": "team", "action": "upsert", "value": "checkout"}},
+	}, config["processors"].(map[string]interface{})["resource/postgresql_orders"])
+}
+
+func TestEndpointReceiver(t *testing.T) {
+	tests := []struct {
+		integrationType IntegrationType
+		cnf             integrationConfiguration
+		id              string
+		receiver        map[string]interface{}
+	}{
+		{
+			PostgreSQL,
+			integrationConfiguration{Endpoint: "10.0.0.5:5432", Name: "orders", Username: "agent",
+				Password: "${secret:orders-password}", Database: "orders"},
+			"postgresql/orders",
+			map[string]interface{}{"endpoint": "10.0.0.5:5432", "username": "agent",
+				"password": "${secret:orders-password}", "databases": []interface{}{"orders"}},
+		},
+		{
+			SQLServer,
+			integrationConfiguration{Endpoint: "10.0.0.6:1433", Username: "sa", Password: "${secret:sqlserver-password}"},
+			"sqlserver",
+			map[string]interface{}{"server": "10.0.0.6", "port": 1433, "username": "sa",
+				"password": "${secret:sqlserver-password}"},
+		},
+		{
+			Nginx,
+			integrationConfiguration{Endpoint: "127.0.0.1:8080"},
+			"nginx",
+			map[string]interface{}{"endpoint": "http://127.0.0.1:8080/status"},
+		},
+		{
+			Kafka,
+			integrationConfiguration{Endpoint: "10.0.0.7:9092", Username: "agent", Password: "${secret:kafka-password}"},
+			"kafkametrics",
+			map[string]interface{}{
+				"brokers":  []interface{}{"10.0.0.7:9092"},
+				"scrapers": []interface{}{"brokers", "topics", "consumers"},
+				"auth": map[string]interface{}{"sasl": map[string]interface{}{
+					"username": "agent", "password": "${secret:kafka-password}", "mechanism": "PLAIN"}},
+			},
+		},
+		{
+			Cassandra,
+			integrationConfiguration{Endpoint: "10.0.0.8:7199", Name: "events",
+				JarPath: "/opt/opentelemetry-jmx-metrics.jar"},
+			"jmx/cassandra_events",
+			map[string]interface{}{"jar_path": "/opt/opentelemetry-jmx-metrics.jar",
+				"endpoint": "10.0.0.8:7199", "target_system": "cassandra,jvm"},
+		},
+		{
+			Redis,
+			integrationConfiguration{Endpoint: "unix:///var/run/redis/redis.sock", Name: "cache"},
+			"redis/cache",
+			map[string]interface{}{"transport": "unix", "endpoint": "/var/run/redis/redis.sock"},
+		},
+		{
+			MongoDB,
+			integrationConfiguration{Endpoint: "tls://[fd00::7]:27017"},
+			"mongodb",
+			map[string]interface{}{"hosts": []interface{}{map[string]interface{}{"endpoint": "[fd00::7]:27017"}},
+				"tls": map[string]interface{}{"insecure": false}},
+		},
+		{
+			Elasticsearch,
+			integrationConfiguration{Endpoint: "https://es.internal:9200"},
+			"elasticsearch",
+			map[string]interface{}{"endpoint": "https://es.internal:9200"},
+		},
+		{
+			Clickhouse,
+			integrationConfiguration{Endpoint: "10.0.0.9:9363"},
+			"prometheus/clickhouse",
+			map[string]interface{}{"config": map[string]interface{}{
+				"scrape_configs": []interface{}{map[string]interface{}{
+					"job_name": "clickhouse",
+					"static_configs": []interface{}{
+						map[string]interface{}{"targets": []interface{}{"10.0.0.9:9363"}}},
+				}},
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		id, receiver, err := endpointReceiver(test.integrationType, test.cnf)
+		assert.NoError(t, err, test.integrationType.String())
+		assert.Equal(t, test.id, id)
+		assert.Equal(t, test.receiver, receiver)
+	}
+
+	for _, test := range []struct {
+		integrationType IntegrationType
+		endpoint        string
+	}{
+		{PostgreSQL, "unix:///var/run/postgresql/.s.PGSQL.5432"},
+		{Nginx, "unix:///var/run/nginx.sock"},
+		{Redis, "http://127.0.0.1:6379"},
+	} {
+		_, _, err := endpointReceiver(test.integrationType, integrationConfiguration{Endpoint: test.endpoint})
+		assert.ErrorIs(t, err, ErrInvalidEndpoint, test.endpoint)
+	}
+}
+
+func TestReportIntegrationErrors(t *testing.T) {
+	var payloads []TrackingPayload
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload TrackingPayload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		payloads = append(payloads, payload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	agent, err := NewHostAgent(HostConfig{BaseConfig: BaseConfig{
+		ConfigCheckInterval:  "60s",
+		APIKey:               "testAPIKey",
+		APIURLForConfigCheck: mockServer.URL,
+	}}, zapcore.NewNopCore())
+	assert.NoError(t, err)
+
+	integrationConfigs := map[IntegrationType]integrationConfigurations{
+		Redis: {{Name: "cache", Endpoint: "redis.internal"}},
+	}
+	_, integrationErrors := agent.applyIntegrations(newIntegrationsTestConfig(), integrationConfigs)
+	assert.Len(t, integrationErrors, 1)
+	agent.reportIntegrationErrors()
+
+	assert.Len(t, payloads, 1)
+	assert.Equal(t, trackStatusIntegration, payloads[0].Status)
+	assert.Contains(t, payloads[0].Metadata.Reason, "redis cache: redis: invalid integration endpoint")
+
+	// the same failures are reported once
+	agent.applyIntegrations(newIntegrationsTestConfig(), integrationConfigs)
+	agent.reportIntegrationErrors()
+	assert.Len(t, payloads, 1)
+}
+
+func TestCheckIntConfigValidity(t *testing.T) {
+	jarPath := filepath.Join(t.TempDir(), "opentelemetry-jmx-metrics.jar")
+	assert.NoError(t, os.WriteFile(jarPath, nil, 0644))
+
+	agent := &HostAgent{}
+	for _, test := range []struct {
+		integrationType IntegrationType
+		cnf             integrationConfiguration
+		reason          string
+	}{
+		{PostgreSQL, integrationConfiguration{Endpoint: "127.0.0.1:5432", Password: "${secret:postgresql-password}"}, ""},
+		{PostgreSQL, integrationConfiguration{Endpoint: "127.0.0.1:5432", Password: "s3cret"}, "must be a secret reference"},
+		{PostgreSQL, integrationConfiguration{Endpoint: "127.0.0.1:5432", Password: "${secret:a}${secret:b}"}, "must be a secret reference"},
+		{Cassandra, integrationConfiguration{Endpoint: "127.0.0.1:7199", JarPath: jarPath}, ""},
+		{Cassandra, integrationConfiguration{Endpoint: "127.0.0.1:7199"}, "jar_path is required"},
+		{JMX, integrationConfiguration{Endpoint: "127.0.0.1:9999", JarPath: jarPath + ".missing"}, "jar not found"},
+	} {
+		err := agent.checkIntConfigValidity(test.integrationType, test.cnf)
+		if test.reason == "" {
+			assert.NoError(t, err, test.cnf)
+			continue
+		}
+		assert.ErrorIs(t, err, ErrInvalidIntegration, test.cnf)
+		assert.ErrorContains(t, err, test.reason)
+		assert.NotContains(t, err.Error(), "s3cret")
+	}
+}
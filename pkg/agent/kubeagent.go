@@ -8,12 +8,15 @@ import (
 	"net/http"
 	"net/url"
 
+	"github.com/middleware-labs/mw-agent/pkg/redact"
+	"github.com/middleware-labs/mw-agent/pkg/transport"
 	yaml "gopkg.in/yaml.v2"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/open-telemetry/opentelemetry-collector-contrib/exporter/kafkaexporter"
 	"github.com/open-telemetry/opentelemetry-collector-contrib/extension/healthcheckextension"
 	"github.com/open-telemetry/opentelemetry-collector-contrib/extension/pprofextension"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/extension/storage/filestorage"
 	"github.com/open-telemetry/opentelemetry-collector-contrib/processor/attributesprocessor"
 	"github.com/open-telemetry/opentelemetry-collector-contrib/processor/cumulativetodeltaprocessor"
 	"github.com/open-telemetry/opentelemetry-collector-contrib/processor/deltatorateprocessor"
@@ -83,6 +86,7 @@ type KubeAgentMonitor struct {
 	ClusterName string
 	logger      *zap.Logger
 	Version     string
+	httpClient  *http.Client
 }
 
 type ComponentType int
@@ -166,6 +170,10 @@ func NewKubeAgentMonitor(cfg KubeConfig, opts ...KubeAgentMonitorOptions) *KubeA
 		agent.logger, _ = zap.NewProduction()
 	}
 
+	if agent.httpClient == nil {
+		agent.httpClient = &http.Client{Transport: transport.NewAPIKeyTransport(cfg.APIKey, nil)}
+	}
+
 	return &agent
 }
 
@@ -182,6 +190,7 @@ func (k *KubeAgent) GetFactories(_ context.Context) (otelcol.Factories, error) {
 	exts := []extension.Factory{
 		healthcheckextension.NewFactory(),
 		pprofextension.NewFactory(),
+		filestorage.NewFactory(),
 		// frontend.NewAuthFactory(),
 	}
 
@@ -275,21 +284,23 @@ func (c *KubeAgentMonitor) callRestartStatusAPI(ctx context.Context) error {
 		return err
 	}
 
-	baseURL := u.JoinPath(apiPathForRestart)
-	baseURL = baseURL.JoinPath(c.APIKey)
 	params := url.Values{}
 	params.Add("platform", "k8s")
 	params.Add("host_id", c.ClusterName)
 	params.Add("cluster", c.ClusterName)
 	params.Add("agent_version", c.Version)
 
+	req, err := transport.NewAPIRequest(http.MethodGet, u, apiPathForRestart, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
 	// Add Query Parameters to the URL
-	baseURL.RawQuery = params.Encode() // Escape Query Parameters
-	url := baseURL.String()
-	resp, err := http.Get(url)
+	req.URL.RawQuery = params.Encode() // Escape Query Parameters
+
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to call restart api for url %s: %w",
-			url, err)
+			redact.URL(req.URL, c.APIKey), err)
 	}
 
 	defer resp.Body.Close()
@@ -388,8 +399,6 @@ func (c *KubeAgentMonitor) UpdateConfigMap(ctx context.Context, componentType Co
 		return err
 	}
 
-	baseURL := u.JoinPath(apiPathForYAML)
-	baseURL = baseURL.JoinPath(c.APIKey)
 	params := url.Values{}
 	params.Add("platform", "k8s")
 	params.Add("component_type", componentType.String())
@@ -401,12 +410,16 @@ func (c *KubeAgentMonitor) UpdateConfigMap(ctx context.Context, componentType Co
 		params.Add("enable_datadog_receiver", "true")
 	}
 
+	req, err := transport.NewAPIRequest(http.MethodGet, u, apiPathForYAML, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
 	// Add Query Parameters to the URL
-	baseURL.RawQuery = params.Encode() // Escape Query Parameters
+	req.URL.RawQuery = params.Encode() // Escape Query Parameters
 
-	resp, err := http.Get(baseURL.String())
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		c.logger.Error("failed to call Restart-API", zap.String("url", baseURL.String()), zap.Error(err))
+		c.logger.Error("failed to call Restart-API", zap.String("url", redact.URL(req.URL, c.APIKey)), zap.Error(err))
 		return err
 	}
 	defer resp.Body.Close()
@@ -444,6 +457,18 @@ func (c *KubeAgentMonitor) UpdateConfigMap(ctx context.Context, componentType Co
 		apiYAMLConfig = apiResponse.Config.DaemonSet
 	}
 
+	if c.Proxy.IsSet() {
+		if err := c.Proxy.UpdateExportersForProxy(apiYAMLConfig); err != nil {
+			return err
+		}
+	}
+
+	if c.TLS.IsSet() {
+		if err := c.TLS.UpdateExportersForTLS(apiYAMLConfig); err != nil {
+			return err
+		}
+	}
+
 	yamlData, err := yaml.Marshal(apiYAMLConfig)
 	if err != nil {
 		return fmt.Errorf("failed to marshal api data: %w", err)
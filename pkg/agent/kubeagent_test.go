@@ -33,7 +33,8 @@ func TestKubeAgentGetFactories(t *testing.T) {
 	assert.NotNil(t, factories.Processors)
 
 	// check that the returned factories contain the expected factories
-	assert.Len(t, factories.Extensions, 1)
+	assert.Len(t, factories.Extensions, 3)
+	assertContainsComponent(t, factories.Extensions, "file_storage")
 
 	// check if factories contains expected receivers
 	assert.Len(t, factories.Receivers, 23)
@@ -136,6 +137,7 @@ func TestCallRestartStatusAPI(t *testing.T) {
 		},
 		logger:      logger,
 		ClusterName: "cluster",
+		httpClient:  http.DefaultClient,
 	}
 
 	// Mock the HTTP server
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/collector/confmap"
+	"go.uber.org/zap"
+)
+
+// MWProviderScheme is the URI scheme served by the provider returned by
+// HostAgent.NewMWProviderFactory, e.g.
+// mw:ingestion-rules?config=docker&cache=/var/lib/mw-agent/otel-config.yaml
+const MWProviderScheme = "mw"
+
+const mwIngestionRules = "ingestion-rules"
+
+var ErrUnsupportedMWURI = errors.New("unsupported mw config uri")
+
+// mwProvider is a confmap.Provider that resolves the otel config straight
+// from the Middleware ingestion rules API. The config goes through the same
+// transforms (integrations, ECS, restrictions, host tags) and validation as
+// the config written by updateConfigFile.
+//
+// The URI supports the following query parameters:
+//   - config: ingestion rules config type, docker or nodocker. If it is
+//     not set, it is detected from the docker endpoint of the agent.
+//   - cache: optional file the resolved config is written to. The cached
+//     config is used when the Middleware API can not be reached.
+type mwProvider struct {
+	agent *HostAgent
+}
+
+// NewMWProviderFactory returns a confmap.ProviderFactory for the mw URI
+// scheme. It can be added to the ProviderFactories of an
+// otelcol.CollectorSettings so that a collector embedding the agent
+// resolves its config directly from the Middleware API.
+func (c *HostAgent) NewMWProviderFactory() confmap.ProviderFactory {
+	return confmap.NewProviderFactory(func(confmap.ProviderSettings) confmap.Provider {
+		return &mwProvider{agent: c}
+	})
+}
+
+// Retrieve implements confmap.Provider.
+func (p *mwProvider) Retrieve(_ context.Context, uri string,
+	_ confmap.WatcherFunc) (*confmap.Retrieved, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", ErrUnsupportedMWURI, uri, err)
+	}
+
+	if u.Scheme != MWProviderScheme || u.Opaque != mwIngestionRules {
+		return nil, fmt.Errorf("%w %q, expected %s:%s", ErrUnsupportedMWURI, uri,
+			MWProviderScheme, mwIngestionRules)
+	}
+
+	query := u.Query()
+	configType := query.Get("config")
+	switch configType {
+	case "":
+		configType = p.agent.getConfigType()
+	case "docker", "nodocker":
+	default:
+		return nil, fmt.Errorf("%w %q, config must be docker or nodocker", ErrUnsupportedMWURI, uri)
+	}
+	cacheFile := query.Get("cache")
+
+	content, err := p.fetch(configType)
+	if err != nil {
+		if cacheFile == "" || errors.Is(err, ErrInvalidConfig) {
+			return nil, err
+		}
+
+		cached, cacheErr := os.ReadFile(cacheFile)
+		if cacheErr != nil {
+			return nil, fmt.Errorf("%w, failed to read cached config %s: %v", err, cacheFile, cacheErr)
+		}
+
+		p.agent.logger.Warn("failed to fetch otel config, using cached config",
+			zap.String("cache", cacheFile), zap.Error(err))
+		return confmap.NewRetrievedFromYAML(cached)
+	}
+
+	if cacheFile != "" {
+		if err := writeFileAtomic(cacheFile, content, 0644); err != nil {
+			p.agent.logger.Warn("failed to write otel config cache",
+				zap.String("cache", cacheFile), zap.Error(err))
+		}
+	}
+
+	return confmap.NewRetrievedFromYAML(content)
+}
+
+func (p *mwProvider) fetch(configType string) ([]byte, error) {
+	content, _, err := p.agent.buildOtelConfig(configType, false)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConfigFetchFailure, err)
+	}
+	p.agent.reportIntegrationErrors()
+
+	if err := p.agent.validateOtelConfig(content); err != nil {
+		p.agent.reportInvalidConfig(err)
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// Scheme implements confmap.Provider.
+func (*mwProvider) Scheme() string {
+	return MWProviderScheme
+}
+
+// Shutdown implements confmap.Provider.
+func (*mwProvider) Shutdown(context.Context) error {
+	return nil
+}
@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/confmap"
+	"go.uber.org/zap"
+)
+
+func TestMWProviderRetrieve(t *testing.T) {
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{
+			BaseConfig: BaseConfig{
+				APIKey:               "testAPIKey",
+				APIURLForConfigCheck: "http://example.com",
+			},
+		},
+		logger: zap.NewNop(),
+		backendClient: NewBackendClient(zap.NewNop(), WithBackendClientHTTPDoFunc(
+			func(req *http.Request) (*http.Response, error) {
+				return nil, errors.New("test error")
+			})),
+	}
+
+	provider := hostAgent.NewMWProviderFactory().Create(confmap.ProviderSettings{})
+	assert.Equal(t, MWProviderScheme, provider.Scheme())
+
+	for _, uri := range []string{
+		"mw:unknown",
+		"mw:ingestion-rules?config=other",
+	} {
+		_, err := provider.Retrieve(context.Background(), uri, nil)
+		assert.True(t, errors.Is(err, ErrUnsupportedMWURI), uri)
+	}
+
+	// without a cache, the fetch failure is returned
+	_, err := provider.Retrieve(context.Background(), "mw:ingestion-rules?config=docker", nil)
+	assert.True(t, errors.Is(err, ErrConfigFetchFailure))
+
+	// with a cache, the cached config is used
+	cacheFile := filepath.Join(t.TempDir(), "otel-config.yaml")
+	assert.NoError(t, os.WriteFile(cacheFile, []byte("receivers: {}"), 0644))
+
+	retrieved, err := provider.Retrieve(context.Background(),
+		"mw:ingestion-rules?config=docker&cache="+cacheFile, nil)
+	assert.NoError(t, err)
+
+	conf, err := retrieved.AsConf()
+	assert.NoError(t, err)
+	assert.True(t, conf.IsSet("receivers"))
+}
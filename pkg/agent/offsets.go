@@ -0,0 +1,26 @@
+package agent
+
+import (
+	"path/filepath"
+
+	"github.com/middleware-labs/mw-agent/pkg/otelconfig"
+)
+
+const (
+	// OffsetsStorageID is the id of the file_storage extension the log
+	// receivers keep their read offsets in.
+	OffsetsStorageID = otelconfig.OffsetsStorageID
+	// OffsetsDir is the directory in StateDir the offsets are kept in.
+	OffsetsDir = "offsets"
+)
+
+// updateConfigForOffsets makes every filelog and journald receiver in
+// config keep its offsets in OffsetsDir of StateDir, see
+// otelconfig.UpdateReceiversForOffsets.
+func (c *HostAgent) updateConfigForOffsets(config map[string]interface{}) (map[string]interface{}, error) {
+	err := otelconfig.UpdateReceiversForOffsets(config, filepath.Join(c.StateDir, OffsetsDir))
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
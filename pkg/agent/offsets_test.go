@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateConfigForOffsets(t *testing.T) {
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{
+			StateDir: "/var/lib/mw-agent",
+		},
+	}
+
+	config := map[string]interface{}{
+		"receivers": map[string]interface{}{
+			"filelog":      map[string]interface{}{"include": []interface{}{"/var/log/*.log"}},
+			"journald/app": map[string]interface{}{"units": []interface{}{"app"}},
+			"filelog/own":  map[string]interface{}{"storage": "file_storage/own"},
+			"otlp":         map[string]interface{}{},
+		},
+		"service": map[string]interface{}{},
+	}
+
+	config, err := hostAgent.updateConfigForOffsets(config)
+	assert.NoError(t, err)
+
+	receivers := config["receivers"].(map[string]interface{})
+	assert.Equal(t, OffsetsStorageID, receivers["filelog"].(map[string]interface{})["storage"])
+	assert.Equal(t, OffsetsStorageID, receivers["journald/app"].(map[string]interface{})["storage"])
+	assert.Equal(t, "file_storage/own", receivers["filelog/own"].(map[string]interface{})["storage"])
+	assert.NotContains(t, receivers["otlp"], "storage")
+
+	extensions := config["extensions"].(map[string]interface{})
+	assert.Equal(t, filepath.Join("/var/lib/mw-agent", OffsetsDir),
+		extensions[OffsetsStorageID].(map[string]interface{})["directory"])
+	assert.Equal(t, []interface{}{OffsetsStorageID},
+		config["service"].(map[string]interface{})["extensions"])
+}
+
+func TestUpdateConfigForOffsetsWithoutLogReceivers(t *testing.T) {
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{
+			StateDir: "/var/lib/mw-agent",
+		},
+	}
+
+	config := map[string]interface{}{
+		"receivers": map[string]interface{}{
+			"otlp": map[string]interface{}{},
+		},
+		"service": map[string]interface{}{},
+	}
+
+	config, err := hostAgent.updateConfigForOffsets(config)
+	assert.NoError(t, err)
+	assert.NotContains(t, config, "extensions")
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// overlayAppendSuffix appends the items of a list to the list of the
+	// backend config, e.g. "receivers+: [filelog/extra]".
+	overlayAppendSuffix = "+"
+	// overlayReplaceSuffix replaces the value of the backend config instead
+	// of merging into it, e.g. "otlphttp!: {...}".
+	overlayReplaceSuffix = "!"
+)
+
+// loadLocalOverlay reads the LocalOverlay file. It returns a nil map if no
+// local overlay is configured.
+func (c *HostAgent) loadLocalOverlay() (map[string]interface{}, error) {
+	if c.LocalOverlay == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(c.LocalOverlay)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local overlay %s: %w", c.LocalOverlay, err)
+	}
+
+	var overlay map[interface{}]interface{}
+	if err := yaml.Unmarshal(convertTabsToSpaces(data, 2), &overlay); err != nil {
+		return nil, fmt.Errorf("failed to parse local overlay %s: %w", c.LocalOverlay, err)
+	}
+
+	overlayConfig, _ := normalizeYAML(overlay).(map[string]interface{})
+	return overlayConfig, nil
+}
+
+// localOverlayHash returns the hex encoded SHA-256 hash of the LocalOverlay
+// file, or an empty string if there is none.
+func (c *HostAgent) localOverlayHash() string {
+	if c.LocalOverlay == "" {
+		return ""
+	}
+
+	data, err := os.ReadFile(c.LocalOverlay)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// applyLocalOverlay merges the LocalOverlay file into config and logs the
+// values of config it changed.
+func (c *HostAgent) applyLocalOverlay(config map[string]interface{}) (map[string]interface{}, error) {
+	overlay, err := c.loadLocalOverlay()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	if overlay == nil {
+		return config, nil
+	}
+
+	for _, conflict := range mergeOverlay(config, overlay, "") {
+		c.logger.Warn("local overlay overrides backend config",
+			zap.String("local-overlay", c.LocalOverlay),
+			zap.String("conflict", conflict))
+	}
+	return config, nil
+}
+
+// mergeOverlay merges overlay into dst and returns a description of every
+// value of dst it replaced or deleted:
+//   - maps are merged key by key, so new components are added,
+//   - any other value replaces the value in dst,
+//   - a null value deletes the key from dst,
+//   - a key ending in "+" appends the items of its list to the list in dst,
+//     skipping items that are already present,
+//   - a key ending in "!" replaces the value in dst instead of merging.
+func mergeOverlay(dst, overlay map[string]interface{}, path string) []string {
+	var conflicts []string
+
+	keys := make([]string, 0, len(overlay))
+	for key := range overlay {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		val := overlay[key]
+
+		switch {
+		case strings.HasSuffix(key, overlayAppendSuffix):
+			name := strings.TrimSuffix(key, overlayAppendSuffix)
+			items, ok := val.([]interface{})
+			if !ok {
+				items = []interface{}{val}
+			}
+
+			existing, exists := dst[name]
+			list, ok := existing.([]interface{})
+			if exists && !ok {
+				conflicts = append(conflicts, fmt.Sprintf("%s: can not append to a non-list value, replaced",
+					joinConfPath(path, name)))
+			}
+
+			for _, item := range items {
+				if !containsValue(list, item) {
+					list = append(list, item)
+				}
+			}
+			dst[name] = list
+
+		case strings.HasSuffix(key, overlayReplaceSuffix):
+			name := strings.TrimSuffix(key, overlayReplaceSuffix)
+			if _, exists := dst[name]; exists {
+				conflicts = append(conflicts, fmt.Sprintf("%s: replaced", joinConfPath(path, name)))
+			}
+			if val == nil {
+				delete(dst, name)
+				continue
+			}
+			dst[name] = val
+
+		case val == nil:
+			if _, exists := dst[key]; exists {
+				conflicts = append(conflicts, fmt.Sprintf("%s: deleted", joinConfPath(path, key)))
+				delete(dst, key)
+			}
+
+		default:
+			valMap, valOk := val.(map[string]interface{})
+			existing, exists := dst[key]
+			existingMap, existingOk := existing.(map[string]interface{})
+
+			if valOk && (existingOk || !exists) {
+				if !exists {
+					existingMap = map[string]interface{}{}
+					dst[key] = existingMap
+				}
+				conflicts = append(conflicts, mergeOverlay(existingMap, valMap, joinConfPath(path, key))...)
+				continue
+			}
+
+			if exists && !reflect.DeepEqual(existing, val) {
+				conflicts = append(conflicts, fmt.Sprintf("%s: replaced %v with %v",
+					joinConfPath(path, key), existing, val))
+			}
+			dst[key] = val
+		}
+	}
+
+	return conflicts
+}
+
+func joinConfPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "::" + key
+}
+
+func containsValue(list []interface{}, v interface{}) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestApplyLocalOverlay(t *testing.T) {
+	overlayFile := filepath.Join(t.TempDir(), "overlay.yaml")
+	assert.NoError(t, os.WriteFile(overlayFile, []byte(`
+receivers:
+  filelog/extra:
+    include: [/var/log/app/*.log]
+  docker_stats: null
+exporters:
+  otlp!:
+    endpoint: collector.internal:4317
+processors:
+  batch:
+    timeout: 5s
+service:
+  pipelines:
+    logs:
+      receivers+: [filelog/extra, filelog]
+`), 0644))
+
+	config := map[string]interface{}{
+		"receivers": map[string]interface{}{
+			"filelog":      map[string]interface{}{"include": []interface{}{"/var/log/*.log"}},
+			"docker_stats": map[string]interface{}{},
+		},
+		"exporters": map[string]interface{}{
+			"otlp": map[string]interface{}{
+				"endpoint": "${env:MW_TARGET}",
+				"headers":  map[string]interface{}{"authorization": "${env:MW_API_KEY}"},
+			},
+		},
+		"processors": map[string]interface{}{
+			"batch": map[string]interface{}{"timeout": "10s"},
+		},
+		"service": map[string]interface{}{
+			"pipelines": map[string]interface{}{
+				"logs": map[string]interface{}{
+					"receivers": []interface{}{"filelog"},
+				},
+			},
+		},
+	}
+
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{LocalOverlay: overlayFile},
+		logger:     zap.NewNop(),
+	}
+
+	config, err := hostAgent.applyLocalOverlay(config)
+	assert.NoError(t, err)
+
+	receivers := config["receivers"].(map[string]interface{})
+	assert.Contains(t, receivers, "filelog/extra")
+	assert.NotContains(t, receivers, "docker_stats")
+
+	// the exporter is replaced, not merged
+	assert.Equal(t, map[string]interface{}{"endpoint": "collector.internal:4317"},
+		config["exporters"].(map[string]interface{})["otlp"])
+
+	assert.Equal(t, "5s", config["processors"].(map[string]interface{})["batch"].(map[string]interface{})["timeout"])
+
+	logs := config["service"].(map[string]interface{})["pipelines"].(map[string]interface{})["logs"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"filelog", "filelog/extra"}, logs["receivers"])
+}
+
+func TestMergeOverlayConflicts(t *testing.T) {
+	dst := map[string]interface{}{
+		"a": "1",
+		"b": map[string]interface{}{"c": "2"},
+		"d": "3",
+	}
+
+	conflicts := mergeOverlay(dst, map[string]interface{}{
+		"a":  "1",
+		"b":  map[string]interface{}{"c": "4"},
+		"d":  nil,
+		"e+": "5",
+	}, "")
+
+	assert.Equal(t, []string{
+		"b::c: replaced 2 with 4",
+		"d: deleted",
+	}, conflicts)
+	assert.Equal(t, []interface{}{"5"}, dst["e"])
+}
@@ -0,0 +1,223 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/middleware-labs/mw-agent/pkg/secret"
+	"go.opentelemetry.io/collector/confmap"
+	"go.opentelemetry.io/collector/confmap/provider/envprovider"
+	"go.opentelemetry.io/collector/confmap/provider/yamlprovider"
+	"go.opentelemetry.io/collector/otelcol"
+	"go.uber.org/zap"
+)
+
+// ReloadProviderScheme is the URI scheme served by ReloadProvider, e.g.
+// mwfile:/etc/mw-agent/otel-config.yaml
+const ReloadProviderScheme = "mwfile"
+
+var ErrCollectorNotRunning = errors.New("collector is not running")
+
+// ReloadProvider is a confmap.Provider that reads the otel config from a
+// file, like the file provider, and lets the agent tell the collector that
+// the file changed. The collector then reloads its pipelines in place
+// instead of being stopped and started again.
+//
+// The same ReloadProvider is shared by every collector the agent creates,
+// so its factory always returns this instance.
+type ReloadProvider struct {
+	mu         sync.Mutex
+	watcher    confmap.WatcherFunc
+	generation uint64
+	retrieved  chan struct{}
+	hash       [sha256.Size]byte
+}
+
+// NewReloadProvider returns a new ReloadProvider.
+func NewReloadProvider() *ReloadProvider {
+	return &ReloadProvider{
+		retrieved: make(chan struct{}),
+	}
+}
+
+// NewFactory returns a confmap.ProviderFactory for this provider.
+func (p *ReloadProvider) NewFactory() confmap.ProviderFactory {
+	return confmap.NewProviderFactory(func(confmap.ProviderSettings) confmap.Provider {
+		return p
+	})
+}
+
+// Retrieve implements confmap.Provider.
+func (p *ReloadProvider) Retrieve(_ context.Context, uri string,
+	watcher confmap.WatcherFunc) (*confmap.Retrieved, error) {
+	if !strings.HasPrefix(uri, ReloadProviderScheme+":") {
+		return nil, fmt.Errorf("%q uri is not supported by %q provider", uri, ReloadProviderScheme)
+	}
+
+	content, err := os.ReadFile(filepath.Clean(uri[len(ReloadProviderScheme)+1:]))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the file %v: %w", uri, err)
+	}
+
+	p.mu.Lock()
+	p.generation++
+	generation := p.generation
+	p.watcher = watcher
+	p.hash = sha256.Sum256(content)
+	close(p.retrieved)
+	p.retrieved = make(chan struct{})
+	p.mu.Unlock()
+
+	return confmap.NewRetrievedFromYAML(content,
+		confmap.WithRetrievedClose(func(context.Context) error {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			// only drop the watcher if no newer Retrieve replaced it
+			if p.generation == generation {
+				p.watcher = nil
+			}
+			return nil
+		}))
+}
+
+// Scheme implements confmap.Provider.
+func (*ReloadProvider) Scheme() string {
+	return ReloadProviderScheme
+}
+
+// Shutdown implements confmap.Provider.
+func (p *ReloadProvider) Shutdown(context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.watcher = nil
+	return nil
+}
+
+// Reload notifies the collector watching this provider that its config
+// changed. It returns a channel that is closed once the collector has
+// retrieved the config again, and false if no collector is watching.
+func (p *ReloadProvider) Reload() (<-chan struct{}, bool) {
+	p.mu.Lock()
+	watcher := p.watcher
+	// the watcher fires once per Retrieve, the collector registers a new
+	// one when it retrieves the config again.
+	p.watcher = nil
+	retrieved := p.retrieved
+	p.mu.Unlock()
+
+	if watcher == nil {
+		return nil, false
+	}
+
+	watcher(&confmap.ChangeEvent{})
+	return retrieved, true
+}
+
+// WatchFile reloads the collector whenever the content of path differs
+// from the config the collector retrieved last. It checks the file every
+// interval until ctx is done.
+func (p *ReloadProvider) WatchFile(ctx context.Context, path string,
+	interval time.Duration, logger *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			content, err := os.ReadFile(path)
+			if err != nil {
+				logger.Warn("failed to read otel config file", zap.String("path", path),
+					zap.Error(err))
+				continue
+			}
+
+			p.mu.Lock()
+			changed := p.hash != sha256.Sum256(content)
+			p.mu.Unlock()
+
+			if !changed {
+				continue
+			}
+
+			if _, ok := p.Reload(); ok {
+				logger.Info("otel config file changed, reloading collector config",
+					zap.String("path", path))
+			}
+		}
+	}
+}
+
+// NewConfigProviderSettings returns the config provider settings used by
+// the agents to resolve the otel config at uri. If reloadProvider is not
+// nil, uri may use the ReloadProviderScheme so that the collector can be
+// reloaded in place. Additional provider factories, such as the ones for
+// the mw and secret schemes, are appended to the default ones. The values
+// resolved from files, e.g. ${file:/path/to/password}, are masked in the
+// logs.
+func NewConfigProviderSettings(uri string, reloadProvider *ReloadProvider,
+	factories ...confmap.ProviderFactory) otelcol.ConfigProviderSettings {
+	providerFactories := []confmap.ProviderFactory{
+		secret.NewFileProviderFactory(),
+		yamlprovider.NewFactory(),
+		envprovider.NewFactory(),
+	}
+
+	if reloadProvider != nil {
+		providerFactories = append(providerFactories, reloadProvider.NewFactory())
+	}
+	providerFactories = append(providerFactories, factories...)
+
+	return otelcol.ConfigProviderSettings{
+		ResolverSettings: confmap.ResolverSettings{
+			ProviderFactories: providerFactories,
+			URIs:              []string{uri},
+		},
+	}
+}
+
+// ReloadCollector asks the running collector to reload its config from
+// OtelConfigFile in place. It returns ErrCollectorNotRunning if there is
+// no collector to reload and ErrCollectorStartFailure if the collector
+// exits while applying the new config.
+func (c *HostAgent) ReloadCollector() error {
+	collector, stopping := c.getCollector()
+	if collector == nil || stopping {
+		return ErrCollectorNotRunning
+	}
+
+	retrieved, ok := c.reloadProvider.Reload()
+	if !ok {
+		return ErrCollectorNotRunning
+	}
+
+	timeout := time.NewTimer(collectorStartTimeout)
+	defer timeout.Stop()
+
+	select {
+	case <-retrieved:
+	case err := <-c.collectorDone:
+		if err == nil {
+			err = errors.New("collector exited while reloading")
+		}
+		return newDataPlaneError(fmt.Errorf("%w: %v", ErrCollectorStartFailure, err))
+	case <-timeout.C:
+		c.logger.Warn("collector did not retrieve the new config in time",
+			zap.Duration("timeout", collectorStartTimeout))
+		return nil
+	}
+
+	if err := c.waitForCollectorStart(collector, c.collectorDone); err != nil {
+		return newDataPlaneError(err)
+	}
+	c.metrics.recordCollectorRestart(collectorRestartModeReload)
+	return nil
+}
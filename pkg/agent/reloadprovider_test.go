@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/confmap"
+)
+
+func TestReloadProvider(t *testing.T) {
+	otelConfigFile := filepath.Join(t.TempDir(), "otel-config.yaml")
+	assert.NoError(t, os.WriteFile(otelConfigFile, []byte("receivers: {}"), 0644))
+
+	provider := NewReloadProvider()
+
+	// nothing to reload before the collector retrieved the config
+	_, ok := provider.Reload()
+	assert.False(t, ok)
+
+	_, err := provider.Retrieve(context.Background(), "file:"+otelConfigFile, nil)
+	assert.Error(t, err)
+
+	changes := 0
+	watcher := func(*confmap.ChangeEvent) { changes++ }
+
+	retrieved, err := provider.Retrieve(context.Background(),
+		ReloadProviderScheme+":"+otelConfigFile, watcher)
+	assert.NoError(t, err)
+
+	conf, err := retrieved.AsConf()
+	assert.NoError(t, err)
+	assert.True(t, conf.IsSet("receivers"))
+
+	done, ok := provider.Reload()
+	assert.True(t, ok)
+	assert.Equal(t, 1, changes)
+
+	// the watcher fires once per Retrieve
+	_, ok = provider.Reload()
+	assert.False(t, ok)
+
+	_, err = provider.Retrieve(context.Background(),
+		ReloadProviderScheme+":"+otelConfigFile, watcher)
+	assert.NoError(t, err)
+
+	select {
+	case <-done:
+	default:
+		t.Error("expected the retrieved channel to be closed")
+	}
+
+	// closing an older Retrieved keeps the watcher of the newer one
+	assert.NoError(t, retrieved.Close(context.Background()))
+	_, ok = provider.Reload()
+	assert.True(t, ok)
+	assert.Equal(t, 2, changes)
+}
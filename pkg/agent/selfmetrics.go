@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Values of the outcome attribute of the self metrics.
+const (
+	outcomeOK            = "ok"
+	outcomeUnchanged     = "unchanged"
+	outcomeInvalidConfig = "invalid_config"
+	outcomeControlPlane  = "control_plane"
+	outcomeDataPlane     = "data_plane"
+	outcomeError         = "error"
+)
+
+// Values of the mode attribute of mw_agent.collector.restarts.
+const (
+	collectorRestartModeRestart = "restart"
+	collectorRestartModeReload  = "reload"
+)
+
+// errorOutcome returns the outcome attribute reported for err.
+func errorOutcome(err error) string {
+	switch {
+	case err == nil:
+		return outcomeOK
+	case errors.Is(err, ErrConfigUnchanged):
+		return outcomeUnchanged
+	case errors.Is(err, ErrInvalidConfig):
+		return outcomeInvalidConfig
+	case errors.Is(err, ErrControlPlane):
+		return outcomeControlPlane
+	case errors.Is(err, ErrDataPlane):
+		return outcomeDataPlane
+	}
+	return outcomeError
+}
+
+// hostAgentMetrics are the self metrics of the HostAgent control loop. A
+// nil *hostAgentMetrics records nothing.
+type hostAgentMetrics struct {
+	configFetchDuration      metric.Float64Histogram
+	restartStatusPolls       metric.Int64Counter
+	collectorRestarts        metric.Int64Counter
+	collectorCrashes         metric.Int64Counter
+	configValidationFailures metric.Int64Counter
+	serviceReports           metric.Int64Counter
+}
+
+func newHostAgentMetrics(meter metric.Meter) (*hostAgentMetrics, error) {
+	var m hostAgentMetrics
+	var err error
+
+	m.configFetchDuration, err = meter.Float64Histogram("mw_agent.config.fetch.duration",
+		metric.WithDescription("Duration of the otel config fetches from the Middleware backend by outcome"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	m.restartStatusPolls, err = meter.Int64Counter("mw_agent.config.restart_status_polls",
+		metric.WithDescription("Number of restart status polls of the Middleware backend by outcome"))
+	if err != nil {
+		return nil, err
+	}
+	m.collectorRestarts, err = meter.Int64Counter("mw_agent.collector.restarts",
+		metric.WithDescription("Number of collector restarts and in place config reloads"))
+	if err != nil {
+		return nil, err
+	}
+	m.collectorCrashes, err = meter.Int64Counter("mw_agent.collector.crashes",
+		metric.WithDescription("Number of times the collector exited with an error"))
+	if err != nil {
+		return nil, err
+	}
+	m.configValidationFailures, err = meter.Int64Counter("mw_agent.config.validation_failures",
+		metric.WithDescription("Number of otel configs rejected by validation"))
+	if err != nil {
+		return nil, err
+	}
+	m.serviceReports, err = meter.Int64Counter("mw_agent.service_reports",
+		metric.WithDescription("Number of service discovery reports sent to the Middleware backend by outcome"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func outcomeAttribute(err error) metric.MeasurementOption {
+	return metric.WithAttributes(attribute.String("outcome", errorOutcome(err)))
+}
+
+func (m *hostAgentMetrics) recordConfigFetch(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.configFetchDuration.Record(context.Background(), time.Since(start).Seconds(), outcomeAttribute(err))
+}
+
+func (m *hostAgentMetrics) recordRestartStatusPoll(err error) {
+	if m == nil {
+		return
+	}
+	m.restartStatusPolls.Add(context.Background(), 1, outcomeAttribute(err))
+}
+
+func (m *hostAgentMetrics) recordCollectorRestart(mode string) {
+	if m == nil {
+		return
+	}
+	m.collectorRestarts.Add(context.Background(), 1,
+		metric.WithAttributes(attribute.String("mode", mode)))
+}
+
+func (m *hostAgentMetrics) recordCollectorCrash() {
+	if m == nil {
+		return
+	}
+	m.collectorCrashes.Add(context.Background(), 1)
+}
+
+func (m *hostAgentMetrics) recordConfigValidationFailure() {
+	if m == nil {
+		return
+	}
+	m.configValidationFailures.Add(context.Background(), 1)
+}
+
+func (m *hostAgentMetrics) recordServiceReport(err error) {
+	if m == nil {
+		return
+	}
+	m.serviceReports.Add(context.Background(), 1, outcomeAttribute(err))
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestErrorOutcome(t *testing.T) {
+	assert.Equal(t, "ok", errorOutcome(nil))
+	assert.Equal(t, "unchanged", errorOutcome(ErrConfigUnchanged))
+	assert.Equal(t, "invalid_config", errorOutcome(ErrInvalidConfig))
+	assert.Equal(t, "control_plane", errorOutcome(newControlPlaneError(ErrConfigFetchFailure)))
+	assert.Equal(t, "data_plane", errorOutcome(newDataPlaneError(ErrCollectorStartFailure)))
+	assert.Equal(t, "error", errorOutcome(errors.New("boom")))
+}
+
+func TestHostAgentMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	metrics, err := newHostAgentMetrics(meterProvider.Meter("test"))
+	assert.NoError(t, err)
+
+	metrics.recordConfigFetch(time.Now(), nil)
+	metrics.recordConfigFetch(time.Now(), newControlPlaneError(ErrConfigFetchFailure))
+	metrics.recordRestartStatusPoll(nil)
+	metrics.recordCollectorRestart(collectorRestartModeReload)
+	metrics.recordServiceReport(newControlPlaneError(ErrReportApiFailure))
+
+	var rm metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+
+	points := map[string]map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			points[m.Name] = map[string]int64{}
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, dp := range data.DataPoints {
+					points[m.Name][attributeValues(dp.Attributes)] = dp.Value
+				}
+			case metricdata.Histogram[float64]:
+				for _, dp := range data.DataPoints {
+					points[m.Name][attributeValues(dp.Attributes)] = int64(dp.Count)
+				}
+			}
+		}
+	}
+
+	assert.Equal(t, map[string]map[string]int64{
+		"mw_agent.config.fetch.duration":       {"ok": 1, "control_plane": 1},
+		"mw_agent.config.restart_status_polls": {"ok": 1},
+		"mw_agent.collector.restarts":          {"reload": 1},
+		"mw_agent.service_reports":             {"control_plane": 1},
+	}, points)
+
+	// a nil hostAgentMetrics records nothing
+	var nilMetrics *hostAgentMetrics
+	nilMetrics.recordCollectorCrash()
+}
+
+func attributeValues(set attribute.Set) string {
+	var s string
+	for _, kv := range set.ToSlice() {
+		s += kv.Value.Emit()
+	}
+	return s
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/middleware-labs/mw-agent/pkg/transport"
+)
+
+// serviceReportRelay forwards the service report calls of otelinject to the
+// Middleware backend through the backend client of the agent, so that they
+// use the proxy, TLS and API key settings of the agent. otelinject sends
+// the reports with its own http.Client and puts the API key in the URL
+// path: the relay removes the key from the path and the APIKeyTransport of
+// the backend client sends it in the Authorization header instead.
+type serviceReportRelay struct {
+	base   *url.URL
+	apiKey string
+	client *BackendClient
+}
+
+// ServeHTTP implements http.Handler. Requests without the API key in their
+// path are not forwarded, they don't come from otelinject.
+func (r *serviceReportRelay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	route, elem, ok := r.splitPath(req.URL.Path)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	forward, err := transport.NewAPIRequest(req.Method, r.base, route,
+		bytes.NewReader(body), elem...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	forward.URL.RawQuery = req.URL.RawQuery
+	for _, header := range []string{"Content-Type", "Content-Encoding", "Accept", "User-Agent"} {
+		if value := req.Header.Get(header); value != "" {
+			forward.Header.Set(header, value)
+		}
+	}
+
+	// the reports are sent while the circuit breaker of the config checks
+	// is open, like the tracking calls
+	resp, err := r.client.DoWithoutBreaker(forward)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for header, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// splitPath splits path around the API key segment into the API route and
+// the elements following the key. The route is relative to base.
+func (r *serviceReportRelay) splitPath(path string) (string, []string, bool) {
+	if r.apiKey == "" {
+		return "", nil, false
+	}
+
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, segment := range segments {
+		if segment != r.apiKey {
+			continue
+		}
+		route := strings.Join(segments[:i], "/")
+		route = strings.TrimPrefix(route, strings.Trim(r.base.Path, "/"))
+		return strings.Trim(route, "/"), segments[i+1:], true
+	}
+	return "", nil, false
+}
+
+// startServiceReportRelay starts a serviceReportRelay on a loopback port.
+// It returns the URL to pass to otelinject in place of the backend URL and
+// a function stopping the relay.
+func (c *HostAgent) startServiceReportRelay() (string, func(), error) {
+	base, err := url.Parse(c.APIURLForConfigCheck)
+	if err != nil {
+		return "", nil, err
+	}
+	if base.Host == "" {
+		return "", nil, errors.New("missing host in api url")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+
+	server := &http.Server{
+		Handler: &serviceReportRelay{
+			base:   base,
+			apiKey: c.APIKey,
+			client: c.backendClient,
+		},
+	}
+	go server.Serve(listener)
+
+	relayURL := url.URL{Scheme: "http", Host: listener.Addr().String(), Path: base.Path}
+	return relayURL.String(), func() { server.Close() }, nil
+}
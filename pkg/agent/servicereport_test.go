@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/middleware-labs/mw-agent/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const serviceReportAPIKey = "0123456789abcdef"
+
+func newServiceReportAgent(t *testing.T, apiURL string, cfg transport.Config) *HostAgent {
+	cfg.APIKey = serviceReportAPIKey
+	client, err := transport.NewHTTPClient(cfg)
+	assert.NoError(t, err)
+
+	return &HostAgent{
+		HostConfig: HostConfig{
+			BaseConfig: BaseConfig{
+				APIKey:               serviceReportAPIKey,
+				APIURLForConfigCheck: apiURL,
+			},
+		},
+		logger:        zap.NewNop(),
+		backendClient: NewBackendClient(zap.NewNop(), WithBackendClientHTTPDoFunc(client.Do)),
+	}
+}
+
+func TestServiceReportRelayProxy(t *testing.T) {
+	type proxiedRequest struct {
+		req  *http.Request
+		body string
+	}
+	requests := make(chan proxiedRequest, 2)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		requests <- proxiedRequest{req: r, body: string(body)}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	hostAgent := newServiceReportAgent(t, "http://myaccount.middleware.io/prefix",
+		transport.Config{Proxy: transport.ProxyConfig{URL: proxy.URL}})
+
+	relayURL, stopRelay, err := hostAgent.startServiceReportRelay()
+	assert.NoError(t, err)
+	defer stopRelay()
+
+	// otelinject sends the api key in the path
+	resp, err := http.Post(relayURL+"/api/v1/agent/report/"+serviceReportAPIKey+"/host1?platform=linux",
+		"application/json", strings.NewReader(`{"services":[]}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Len(t, requests, 1)
+	proxied := <-requests
+	req := proxied.req
+	assert.Equal(t, "myaccount.middleware.io", req.Host)
+	assert.Equal(t, "/prefix/api/v1/agent/report/host1", req.URL.Path)
+	assert.Equal(t, "platform=linux", req.URL.RawQuery)
+	assert.Equal(t, "Bearer "+serviceReportAPIKey, req.Header.Get(transport.APIKeyHeader))
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, `{"services":[]}`, proxied.body)
+
+	// requests without the api key are not forwarded
+	resp, err = http.Get(relayURL + "/api/v1/agent/report/host1")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Empty(t, requests)
+}
+
+func TestServiceReportRelayTLS(t *testing.T) {
+	paths := make(chan string, 1)
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: backend.Certificate().Raw,
+	}), 0600))
+
+	hostAgent := newServiceReportAgent(t, backend.URL,
+		transport.Config{TLS: transport.TLSConfig{CAFile: caFile}})
+
+	relayURL, stopRelay, err := hostAgent.startServiceReportRelay()
+	assert.NoError(t, err)
+	defer stopRelay()
+
+	// the backend is only trusted through tls.ca-file
+	resp, err := http.Post(relayURL+"/api/v1/agent/report/"+serviceReportAPIKey,
+		"application/json", strings.NewReader(`{}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "/api/v1/agent/report", <-paths)
+}
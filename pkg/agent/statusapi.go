@@ -0,0 +1,490 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// StatusAPITokenFile is the file in StateDir with the token that
+	// authenticates the control actions of the status API.
+	StatusAPITokenFile = "status-api.token"
+	// StatusAPIUnixPrefix marks a StatusAddress as a unix socket path,
+	// e.g. unix:/var/lib/mw-agent/mw-agent.sock.
+	StatusAPIUnixPrefix = "unix:"
+
+	statusAPIStatusPath   = "/v1/status"
+	statusAPIRefreshPath  = "/v1/refresh"
+	statusAPIRestartPath  = "/v1/restart"
+	statusAPILogLevelPath = "/v1/log-level"
+
+	statusAPIShutdownTimeout = 5 * time.Second
+)
+
+var (
+	ErrStatusAPINotLocal = errors.New("status api address must be a unix socket or a loopback address")
+	// ErrRestartCollector is sent to the agent error channel when a
+	// collector restart is requested through the status API.
+	ErrRestartCollector = errors.New("collector restart requested")
+	// ErrLogLevelNotAdjustable is returned by SetLogLevel if the agent was
+	// not created with WithHostAgentLogLevel.
+	ErrLogLevelNotAdjustable = errors.New("log level can not be changed at runtime")
+	// ErrConfigRefreshUnavailable is returned by RefreshConfig if the agent
+	// does not check the Middleware backend for config changes, e.g. in
+	// offline mode.
+	ErrConfigRefreshUnavailable = errors.New("config is not fetched from the Middleware backend, nothing to refresh")
+)
+
+// CollectorState is the state of the collector reported by the status API.
+type CollectorState string
+
+const (
+	CollectorRunning CollectorState = "running"
+	CollectorStopped CollectorState = "stopped"
+)
+
+// AgentStatus is the status of the host agent reported by the status API.
+type AgentStatus struct {
+	Collector CollectorState `json:"collector"`
+	StartedAt time.Time      `json:"started_at,omitzero"`
+	Uptime    string         `json:"uptime,omitempty"`
+	// LastConfigFetch is the time the agent last checked the Middleware
+	// backend for config changes and LastConfigFetchResult its outcome.
+	LastConfigFetch       time.Time     `json:"last_config_fetch,omitzero"`
+	LastConfigFetchResult string        `json:"last_config_fetch_result,omitempty"`
+	ConfigHash            string        `json:"config_hash,omitempty"`
+	LastError             string        `json:"last_error,omitempty"`
+	LastErrorAt           time.Time     `json:"last_error_at,omitzero"`
+	Version               string        `json:"version"`
+	InfraPlatform         string        `json:"infra_platform"`
+	AgentFeatures         AgentFeatures `json:"agent_features"`
+	// IntegrationErrors are the integrations which could not be applied to
+	// the last config built.
+	IntegrationErrors []IntegrationError `json:"integration_errors,omitempty"`
+}
+
+// runtimeStatus is the part of AgentStatus recorded while the agent runs.
+type runtimeStatus struct {
+	collectorStartedAt    time.Time
+	lastConfigFetch       time.Time
+	lastConfigFetchResult string
+	lastError             string
+	lastErrorAt           time.Time
+	integrationErrors     []IntegrationError
+	// reportedIntegrationErrors are the integrationErrors last reported to
+	// the Middleware backend.
+	reportedIntegrationErrors []IntegrationError
+	// configListenerRunning is set while ListenForConfigChanges runs.
+	configListenerRunning bool
+}
+
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// Status returns the current status of the agent.
+func (c *HostAgent) Status() AgentStatus {
+	c.statusMu.Lock()
+	rs := c.runtimeStatus
+	c.statusMu.Unlock()
+
+	status := AgentStatus{
+		Collector:             CollectorStopped,
+		LastConfigFetch:       rs.lastConfigFetch,
+		LastConfigFetchResult: rs.lastConfigFetchResult,
+		LastError:             rs.lastError,
+		LastErrorAt:           rs.lastErrorAt,
+		Version:               c.Version,
+		InfraPlatform:         c.InfraPlatform.String(),
+		AgentFeatures:         c.AgentFeatures,
+		IntegrationErrors:     rs.integrationErrors,
+	}
+
+	if !rs.collectorStartedAt.IsZero() {
+		status.Collector = CollectorRunning
+		status.StartedAt = rs.collectorStartedAt
+		status.Uptime = time.Since(rs.collectorStartedAt).Truncate(time.Second).String()
+	}
+
+	if hash, ok := c.appliedConfigHash(); ok {
+		status.ConfigHash = hash
+	}
+	return status
+}
+
+// RecordError records err as the last error of the agent reported by the
+// status API. nil errors are ignored.
+func (c *HostAgent) RecordError(err error) {
+	if err == nil {
+		return
+	}
+
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.runtimeStatus.lastError = err.Error()
+	c.runtimeStatus.lastErrorAt = time.Now()
+}
+
+func (c *HostAgent) recordCollectorState(running bool) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	if running {
+		c.runtimeStatus.collectorStartedAt = time.Now()
+		return
+	}
+	c.runtimeStatus.collectorStartedAt = time.Time{}
+}
+
+func (c *HostAgent) recordConfigFetch(err error) {
+	result := "ok"
+	switch {
+	case errors.Is(err, ErrConfigUnchanged):
+		result = "unchanged"
+	case err != nil:
+		result = err.Error()
+	}
+
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.runtimeStatus.lastConfigFetch = time.Now()
+	c.runtimeStatus.lastConfigFetchResult = result
+}
+
+// RefreshConfig makes ListenForConfigChanges check the Middleware backend
+// for config changes now instead of at the next interval. It returns
+// ErrConfigRefreshUnavailable if ListenForConfigChanges is not running.
+func (c *HostAgent) RefreshConfig() error {
+	c.statusMu.Lock()
+	running := c.runtimeStatus.configListenerRunning
+	c.statusMu.Unlock()
+	if !running {
+		return ErrConfigRefreshUnavailable
+	}
+
+	select {
+	case c.refreshCh <- struct{}{}:
+	default:
+		// a refresh is already pending
+	}
+	return nil
+}
+
+// setConfigListenerRunning records whether ListenForConfigChanges runs.
+func (c *HostAgent) setConfigListenerRunning(running bool) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.runtimeStatus.configListenerRunning = running
+}
+
+// SetLogLevel changes the level of the agent logs.
+func (c *HostAgent) SetLogLevel(level string) error {
+	if c.logLevel == nil {
+		return ErrLogLevelNotAdjustable
+	}
+	return c.logLevel.UnmarshalText([]byte(level))
+}
+
+// ServeStatusAPI serves the status API on StatusAddress until stopCh is
+// closed. Collector restarts requested through the API are sent to errCh
+// as ErrRestartCollector.
+func (c *HostAgent) ServeStatusAPI(errCh chan<- error, stopCh <-chan struct{}) error {
+	listener, err := listenStatusAPI(c.StatusAddress)
+	if err != nil {
+		c.logger.Error("failed to listen for status api", zap.String("address", c.StatusAddress),
+			zap.Error(err))
+		return err
+	}
+
+	token, err := c.writeStatusAPIToken()
+	if err != nil {
+		// the status is still served, control actions are rejected
+		c.logger.Error("failed to write status api token, control actions are disabled",
+			zap.Error(err))
+	}
+
+	server := &http.Server{
+		Handler:           c.statusAPIHandler(token, errCh, stopCh),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- server.Serve(listener)
+	}()
+	c.logger.Info("serving status api", zap.String("address", c.StatusAddress))
+
+	select {
+	case <-stopCh:
+	case err := <-serveErrCh:
+		c.logger.Error("status api stopped", zap.Error(err))
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusAPIShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+func (c *HostAgent) statusAPIHandler(token string, errCh chan<- error,
+	stopCh <-chan struct{}) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET "+statusAPIStatusPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(c.Status())
+	})
+
+	mux.Handle("POST "+statusAPIRefreshPath, requireStatusAPIToken(token,
+		func(w http.ResponseWriter, r *http.Request) {
+			c.logger.Info("config refresh requested through status api")
+			if err := c.RefreshConfig(); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		}))
+
+	mux.Handle("POST "+statusAPIRestartPath, requireStatusAPIToken(token,
+		func(w http.ResponseWriter, r *http.Request) {
+			c.logger.Info("collector restart requested through status api")
+			select {
+			case errCh <- ErrRestartCollector:
+				w.WriteHeader(http.StatusAccepted)
+			case <-stopCh:
+				http.Error(w, "agent is stopping", http.StatusServiceUnavailable)
+			case <-r.Context().Done():
+			}
+		}))
+
+	mux.Handle("POST "+statusAPILogLevelPath, requireStatusAPIToken(token,
+		func(w http.ResponseWriter, r *http.Request) {
+			var req logLevelRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if err := c.SetLogLevel(req.Level); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c.logger.Info("log level changed through status api", zap.String("level", req.Level))
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+	return mux
+}
+
+// requireStatusAPIToken rejects requests without the status API token in
+// their Authorization header. All requests are rejected if token is empty.
+func requireStatusAPIToken(token string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok ||
+			subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// writeStatusAPIToken generates a new status API token and writes it to
+// StatusAPITokenFile in StateDir, readable by the agent user only.
+func (c *HostAgent) writeStatusAPIToken() (string, error) {
+	if c.StateDir == "" {
+		return "", errors.New("no state directory configured")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	if err := os.MkdirAll(c.StateDir, 0755); err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(filepath.Join(c.StateDir, StatusAPITokenFile), []byte(token), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// splitStatusAddress returns the network and address to listen on or dial
+// for a StatusAddress, which is either a unix socket or a loopback address.
+func splitStatusAddress(address string) (string, string, error) {
+	if path, ok := strings.CutPrefix(address, StatusAPIUnixPrefix); ok {
+		return "unix", path, nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrStatusAPINotLocal, err)
+	}
+
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return "", "", fmt.Errorf("%w: %s", ErrStatusAPINotLocal, address)
+		}
+	}
+	return "tcp", address, nil
+}
+
+func listenStatusAPI(address string) (net.Listener, error) {
+	network, addr, err := splitStatusAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		// remove the socket left behind by a previous run
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(addr), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		if err := os.Chmod(addr, 0660); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// StatusClient is a client of the status API of a running host agent.
+type StatusClient struct {
+	baseURL   string
+	tokenFile string
+	client    *http.Client
+}
+
+// NewStatusClient returns a client of the status API served on address.
+// tokenFile is the StatusAPITokenFile of the agent, required for control
+// actions.
+func NewStatusClient(address string, tokenFile string) (*StatusClient, error) {
+	network, addr, err := splitStatusAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StatusClient{
+		baseURL:   "http://" + addr,
+		tokenFile: tokenFile,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if network == "unix" {
+		s.baseURL = "http://mw-agent"
+		s.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", addr)
+			},
+		}
+	}
+	return s, nil
+}
+
+// Status returns the status of the agent.
+func (s *StatusClient) Status() (AgentStatus, error) {
+	var status AgentStatus
+
+	resp, err := s.client.Get(s.baseURL + statusAPIStatusPath)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return status, statusAPIError(resp)
+	}
+	return status, json.NewDecoder(resp.Body).Decode(&status)
+}
+
+// RefreshConfig makes the agent check the Middleware backend for config
+// changes now.
+func (s *StatusClient) RefreshConfig() error {
+	return s.post(statusAPIRefreshPath, nil)
+}
+
+// RestartCollector makes the agent restart its collector.
+func (s *StatusClient) RestartCollector() error {
+	return s.post(statusAPIRestartPath, nil)
+}
+
+// SetLogLevel changes the level of the agent logs.
+func (s *StatusClient) SetLogLevel(level string) error {
+	return s.post(statusAPILogLevelPath, logLevelRequest{Level: level})
+}
+
+func (s *StatusClient) post(path string, body interface{}) error {
+	token, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read status api token: %w", err)
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return statusAPIError(resp)
+	}
+	return nil
+}
+
+func statusAPIError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		msg = http.StatusText(resp.StatusCode)
+	}
+	return fmt.Errorf("status api returned %d: %s", resp.StatusCode, msg)
+}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestStatusAPI(t *testing.T) {
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	hostAgent := &HostAgent{
+		HostConfig: HostConfig{
+			BaseConfig: BaseConfig{
+				InfraPlatform:  InfraPlatformEC2,
+				AgentFeatures:  AgentFeatures{MetricCollection: true},
+				OtelConfigFile: filepath.Join(t.TempDir(), "otel-config.yaml"),
+			},
+		},
+		Version:   "1.2.3",
+		logger:    zap.NewNop(),
+		logLevel:  &level,
+		refreshCh: make(chan struct{}, 1),
+	}
+	hostAgent.recordCollectorState(true)
+	hostAgent.RecordError(ErrConfigFetchFailure)
+
+	errCh := make(chan error, 1)
+	server := httptest.NewServer(hostAgent.statusAPIHandler("secret", errCh, make(chan struct{})))
+	defer server.Close()
+
+	client := &StatusClient{
+		baseURL:   server.URL,
+		tokenFile: filepath.Join(t.TempDir(), StatusAPITokenFile),
+		client:    server.Client(),
+	}
+
+	status, err := client.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, CollectorRunning, status.Collector)
+	assert.Equal(t, "1.2.3", status.Version)
+	assert.Equal(t, "ec2", status.InfraPlatform)
+	assert.Equal(t, ErrConfigFetchFailure.Error(), status.LastError)
+	assert.True(t, status.AgentFeatures.MetricCollection)
+
+	// control actions need the token
+	assert.Error(t, client.RefreshConfig())
+	resp, err := http.Post(server.URL+statusAPIRefreshPath, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp.Body.Close()
+
+	assert.NoError(t, os.WriteFile(client.tokenFile, []byte("secret\n"), 0600))
+
+	// nothing reads the refresh requests without a config listener
+	err = client.RefreshConfig()
+	assert.ErrorContains(t, err, "409")
+	assert.Empty(t, hostAgent.refreshCh)
+
+	hostAgent.setConfigListenerRunning(true)
+	assert.NoError(t, client.RefreshConfig())
+	assert.Len(t, hostAgent.refreshCh, 1)
+
+	assert.NoError(t, client.RestartCollector())
+	assert.ErrorIs(t, <-errCh, ErrRestartCollector)
+
+	assert.NoError(t, client.SetLogLevel("debug"))
+	assert.Equal(t, zapcore.DebugLevel, level.Level())
+	err = client.SetLogLevel("verbose")
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "400"))
+}
+
+func TestSplitStatusAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		addr    string
+		err     error
+	}{
+		{address: "unix:/var/lib/mw-agent/mw-agent.sock", network: "unix", addr: "/var/lib/mw-agent/mw-agent.sock"},
+		{address: "127.0.0.1:8008", network: "tcp", addr: "127.0.0.1:8008"},
+		{address: "localhost:8008", network: "tcp", addr: "localhost:8008"},
+		{address: "[::1]:8008", network: "tcp", addr: "[::1]:8008"},
+		{address: "0.0.0.0:8008", err: ErrStatusAPINotLocal},
+		{address: "example.com:8008", err: ErrStatusAPINotLocal},
+		{address: "8008", err: ErrStatusAPINotLocal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			network, addr, err := splitStatusAddress(tt.address)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.network, network)
+			assert.Equal(t, tt.addr, addr)
+		})
+	}
+}
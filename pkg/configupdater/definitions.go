@@ -2,11 +2,16 @@ package configupdater
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/middleware-labs/mw-agent/pkg/redact"
+	"github.com/middleware-labs/mw-agent/pkg/secret"
+	"github.com/middleware-labs/mw-agent/pkg/transport"
+	"go.opentelemetry.io/otel/metric"
 	"go.uber.org/zap"
 	"k8s.io/client-go/kubernetes"
 )
@@ -14,6 +19,8 @@ import (
 // Otel config components
 const (
 	Receivers              = "receivers"
+	Exporters              = "exporters"
+	Extensions             = "extensions"
 	AWSECSContainerMetrics = "awsecscontainermetrics"
 	Service                = "service"
 	Pipelines              = "pipelines"
@@ -104,10 +111,10 @@ type AgentFeatures struct {
 	SyntheticMonitoring bool
 }
 
-// String() implements stringer interface for KubeAgentUpdaterConfig
-func (c KubeAgent) String() string {
+// String() implements stringer interface for BaseConfig
+func (c BaseConfig) String() string {
 	var s string
-	s += fmt.Sprintf("api-key: %s, ", c.APIKey)
+	s += fmt.Sprintf("api-key: %s, ", redact.Secret(c.APIKey))
 	s += fmt.Sprintf("target: %s, ", c.Target)
 	s += fmt.Sprintf("enable-synthetic-monitoring: %t, ", c.EnableSyntheticMonitoring)
 	s += fmt.Sprintf("config-check-interval: %s, ", c.ConfigCheckInterval)
@@ -116,11 +123,19 @@ func (c KubeAgent) String() string {
 	s += fmt.Sprintf("daemonset-configmap-name: %s, ", c.DaemonsetConfigMapName)
 	s += fmt.Sprintf("deployment-name: %s, ", c.DeploymentName)
 	s += fmt.Sprintf("deployment-configmap-name: %s, ", c.DeploymentConfigMapName)
-	return s
+	s += fmt.Sprintf("daemonset-offsets-dir: %s, ", c.OffsetsDir)
+	s += fmt.Sprintf("tls: {%s}, ", c.TLS)
+	s += fmt.Sprintf("proxy: {%s}, ", c.Proxy)
+	s += fmt.Sprintf("api-key-file: %s, ", c.APIKeyFile)
+	s += fmt.Sprintf("secrets-dir: %s, ", c.SecretsDir)
+	s += fmt.Sprintf("secret-key-file: %s, ", c.SecretKeyFile)
+	return redact.String(s)
 }
 
 type BaseConfig struct {
-	APIKey                    string
+	APIKey string
+	// APIKeyFile is a file holding the API key, exclusive with APIKey.
+	APIKeyFile                string
 	Target                    string
 	EnableSyntheticMonitoring bool
 	ConfigCheckInterval       string
@@ -132,6 +147,61 @@ type BaseConfig struct {
 	DeploymentConfigMapName   string
 	ClusterName               string
 	EnableDataDogReceiver     bool
+	// SelfMetricsPort is the port the self metrics of the updater are
+	// served on, on localhost. 0 disables serving them.
+	SelfMetricsPort uint
+	// OffsetsDir is the hostPath directory the daemonset keeps the log
+	// tailing offsets in. Empty disables the offsets storage.
+	OffsetsDir string
+	// TLS applies to the calls to the Middleware backend and to the otlp
+	// and otlphttp exporters of the rendered otel configs.
+	TLS transport.TLSConfig
+	// Proxy applies to the calls to the Middleware backend and to the otlp
+	// and otlphttp exporters of the rendered otel configs.
+	Proxy transport.ProxyConfig
+	// SecretsDir holds the secrets referred to as ${secret:NAME} by the
+	// config of the updater.
+	SecretsDir string
+	// SecretKeyFile holds the key decrypting the encrypted values of the
+	// config of the updater.
+	SecretKeyFile string
+}
+
+// ResolveSecrets reads the API key from APIKeyFile and replaces the secret
+// references of the API key and of the proxy settings with the secrets
+// they refer to. The API key is masked in the logs from then on. logger is
+// warned about the secrets too short to be masked.
+func (c *BaseConfig) ResolveSecrets(logger *zap.Logger) error {
+	resolver := secret.Resolver{
+		Dir:     c.SecretsDir,
+		KeyFile: c.SecretKeyFile,
+		Logger:  logger,
+	}
+
+	if c.APIKeyFile != "" {
+		if c.APIKey != "" {
+			return fmt.Errorf("%w: api-key and api-key-file are mutually exclusive", secret.ErrInvalidSecret)
+		}
+
+		apiKey, err := resolver.File(c.APIKeyFile)
+		if err != nil {
+			return fmt.Errorf("api-key-file: %w", err)
+		}
+		c.APIKey = apiKey
+	}
+
+	err := resolver.ResolveFields(
+		secret.Field{Name: "api-key", Value: &c.APIKey},
+		secret.Field{Name: "proxy.url", Value: &c.Proxy.URL},
+		secret.Field{Name: "proxy.username", Value: &c.Proxy.Username},
+		secret.Field{Name: "proxy.password", Value: &c.Proxy.Password},
+	)
+	if err != nil {
+		return err
+	}
+
+	redact.Add(c.APIKey)
+	return nil
 }
 
 // KubeConfig stores configuration for all the host agent
@@ -142,6 +212,9 @@ type KubeAgent struct {
 	logger              *zap.Logger
 	version             string
 	applyConfigOnce     sync.Once
+	meter               metric.Meter
+	metrics             *kubeAgentMetrics
+	httpClient          *http.Client
 }
 
 func GetAPIURLForConfigCheck(target string) (string, error) {
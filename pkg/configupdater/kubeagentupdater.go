@@ -10,6 +10,9 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/middleware-labs/mw-agent/pkg/redact"
+	"github.com/middleware-labs/mw-agent/pkg/transport"
+	"go.opentelemetry.io/otel/metric"
 	"go.uber.org/zap"
 	yaml "gopkg.in/yaml.v2"
 	v1 "k8s.io/api/core/v1"
@@ -40,8 +43,16 @@ func (d ComponentType) String() string {
 // KubeAgentOptions takes in various options for KubeAgentUpdater
 type KubeAgentOptions func(h *KubeAgent)
 
+// WithKubeAgentMeter records the self metrics of the updater through meter.
+func WithKubeAgentMeter(meter metric.Meter) KubeAgentOptions {
+	return func(h *KubeAgent) {
+		h.meter = meter
+	}
+}
+
 // NewKubeAgent returns new agent monitor for Kubernetes with given options.
-func NewKubeAgent(cfg BaseConfig, agentVersion string, clientset kubernetes.Interface, logger *zap.Logger) (*KubeAgent, error) {
+func NewKubeAgent(cfg BaseConfig, agentVersion string, clientset kubernetes.Interface, logger *zap.Logger,
+	opts ...KubeAgentOptions) (*KubeAgent, error) {
 	var agent KubeAgent
 	agent.BaseConfig = cfg
 	agent.version = agentVersion
@@ -51,12 +62,33 @@ func NewKubeAgent(cfg BaseConfig, agentVersion string, clientset kubernetes.Inte
 		agent.logger = logger
 	}
 
+	for _, apply := range opts {
+		apply(&agent)
+	}
+
+	if agent.meter != nil {
+		metrics, err := newKubeAgentMetrics(agent.meter)
+		if err != nil {
+			return nil, err
+		}
+		agent.metrics = metrics
+	}
+
 	duration, err := time.ParseDuration(cfg.ConfigCheckInterval)
 	if err != nil {
 		return nil, err
 	}
 	agent.configCheckDuration = duration
 
+	agent.httpClient, err = transport.NewHTTPClient(transport.Config{
+		TLS:    cfg.TLS,
+		Proxy:  cfg.Proxy,
+		APIKey: cfg.APIKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	agent.clientset = clientset
 
 	return &agent, nil
@@ -68,7 +100,9 @@ func NewKubeAgent(cfg BaseConfig, agentVersion string, clientset kubernetes.Inte
 func (c *KubeAgent) ListenForConfigChanges(ctx context.Context, errCh chan<- error,
 	stopCh <-chan struct{}) error {
 
-	errCh <- c.callRestartStatusAPI(ctx, true)
+	err := c.callRestartStatusAPI(ctx, true)
+	c.metrics.recordRestartStatusPoll(err)
+	errCh <- err
 	ticker := time.NewTicker(c.configCheckDuration)
 
 	for {
@@ -79,7 +113,8 @@ func (c *KubeAgent) ListenForConfigChanges(ctx context.Context, errCh chan<- err
 			ticker.Stop()
 			return nil
 		case <-ticker.C:
-			err := c.callRestartStatusAPI(ctx, false)
+			err = c.callRestartStatusAPI(ctx, false)
+			c.metrics.recordRestartStatusPoll(err)
 
 			// Apply config class to cluster only once when the agent starts
 			c.applyConfigOnce.Do(func() {
@@ -101,21 +136,23 @@ func (c *KubeAgent) callRestartStatusAPI(ctx context.Context, first bool) error
 		return err
 	}
 
-	baseURL := u.JoinPath(apiPathForRestart)
-	baseURL = baseURL.JoinPath(c.APIKey)
 	params := url.Values{}
 	params.Add("platform", "k8s")
 	params.Add("host_id", c.ClusterName)
 	params.Add("cluster", c.ClusterName)
 	params.Add("agent_version", c.version)
 
+	req, err := transport.NewAPIRequest(http.MethodGet, u, apiPathForRestart, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
 	// Add Query Parameters to the URL
-	baseURL.RawQuery = params.Encode() // Escape Query Parameters
-	url := baseURL.String()
-	resp, err := http.Get(url)
+	req.URL.RawQuery = params.Encode() // Escape Query Parameters
+
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to call restart api for url %s: %w",
-			url, err)
+			redact.URL(req.URL, c.APIKey), err)
 	}
 
 	defer resp.Body.Close()
@@ -132,6 +169,7 @@ func (c *KubeAgent) callRestartStatusAPI(ctx context.Context, first bool) error
 	if apiResponse.Rollout.Daemonset || first {
 		c.logger.Info("redeploying mw-agent daemonset")
 		updateConfigMapErr := c.UpdateConfigMap(ctx, DaemonSet)
+		c.metrics.recordConfigMapUpdate(DaemonSet, updateConfigMapErr)
 		if updateConfigMapErr != nil {
 			return updateConfigMapErr
 		}
@@ -144,6 +182,7 @@ func (c *KubeAgent) callRestartStatusAPI(ctx context.Context, first bool) error
 	if apiResponse.Rollout.Deployment || first {
 		c.logger.Info("redeploying mw-agent deployment")
 		updateConfigMapErr := c.UpdateConfigMap(ctx, Deployment)
+		c.metrics.recordConfigMapUpdate(Deployment, updateConfigMapErr)
 		if updateConfigMapErr != nil {
 			return updateConfigMapErr
 		}
@@ -158,7 +197,9 @@ func (c *KubeAgent) callRestartStatusAPI(ctx context.Context, first bool) error
 
 // restartKubeAgent rollout restarts agent's data scraping components
 func (c *KubeAgent) restartKubeAgent(ctx context.Context, componentType ComponentType) error {
-	return c.rolloutRestart(ctx, componentType)
+	err := c.rolloutRestart(ctx, componentType)
+	c.metrics.recordRolloutRestart(componentType, err)
+	return err
 }
 
 // rolloutRestart reloads the k8s components
@@ -172,6 +213,12 @@ func (c *KubeAgent) rolloutRestart(ctx context.Context, componentType ComponentT
 			return err
 		}
 
+		// the offsets of the log receivers are kept on the node
+		if c.OffsetsDir != "" && addOffsetsVolume(&daemonSet.Spec.Template.Spec, c.OffsetsDir) {
+			c.logger.Info("mounting log offsets directory in daemonset",
+				zap.String("path", c.OffsetsDir))
+		}
+
 		daemonSet.Spec.Template.ObjectMeta.Labels[Timestamp] = fmt.Sprintf("%d", metav1.Now().Unix())
 		_, err = c.clientset.AppsV1().DaemonSets(c.AgentNamespaceName).Update(ctx, daemonSet, metav1.UpdateOptions{})
 		if err != nil {
@@ -196,14 +243,11 @@ func (c *KubeAgent) rolloutRestart(ctx context.Context, componentType ComponentT
 // updateConfigMap gets the latest configmap from Middleware backend and updates the k8s configmap
 // based on component type
 func (c *KubeAgent) UpdateConfigMap(ctx context.Context, componentType ComponentType) error {
-	fmt.Println(c)
 	u, err := url.Parse(c.APIURLForConfigCheck)
 	if err != nil {
 		return err
 	}
 
-	baseURL := u.JoinPath(apiPathForYAML)
-	baseURL = baseURL.JoinPath(c.APIKey)
 	params := url.Values{}
 	params.Add("platform", "k8s")
 	params.Add("component_type", componentType.String())
@@ -215,12 +259,16 @@ func (c *KubeAgent) UpdateConfigMap(ctx context.Context, componentType Component
 		params.Add("enable_datadog_receiver", "true")
 	}
 
+	req, err := transport.NewAPIRequest(http.MethodGet, u, apiPathForYAML, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
 	// Add Query Parameters to the URL
-	baseURL.RawQuery = params.Encode() // Escape Query Parameters
+	req.URL.RawQuery = params.Encode() // Escape Query Parameters
 
-	resp, err := http.Get(baseURL.String())
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		c.logger.Error("failed to call Restart-API", zap.String("url", baseURL.String()), zap.Error(err))
+		c.logger.Error("failed to call Restart-API", zap.String("url", redact.URL(req.URL, c.APIKey)), zap.Error(err))
 		return err
 	}
 	defer resp.Body.Close()
@@ -256,6 +304,25 @@ func (c *KubeAgent) UpdateConfigMap(ctx context.Context, componentType Component
 	apiYAMLConfig = apiResponse.Config.Deployment
 	if componentType == DaemonSet {
 		apiYAMLConfig = apiResponse.Config.DaemonSet
+
+		if c.OffsetsDir != "" {
+			apiYAMLConfig, err = c.updateConfigForOffsets(apiYAMLConfig)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.Proxy.IsSet() {
+		if err := c.Proxy.UpdateExportersForProxy(apiYAMLConfig); err != nil {
+			return err
+		}
+	}
+
+	if c.TLS.IsSet() {
+		if err := c.TLS.UpdateExportersForTLS(apiYAMLConfig); err != nil {
+			return err
+		}
 	}
 
 	yamlData, err := yaml.Marshal(apiYAMLConfig)
@@ -337,11 +404,6 @@ func (c *KubeAgent) applyConfigClassToCluster() error {
 		return err
 	}
 
-	// Build the URL: /agent/public/setting/config-groups/{groupName}/{token}
-	baseURL := u.JoinPath(apiPathForConfigGroups)
-	baseURL = baseURL.JoinPath(c.APIKey)
-	baseURL = baseURL.JoinPath("default")
-
 	// Prepare request body
 	reqBody := map[string][]string{
 		"hostIds": {c.ClusterName},
@@ -351,8 +413,10 @@ func (c *KubeAgent) applyConfigClassToCluster() error {
 		return fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest(http.MethodPut, baseURL.String(), bytes.NewBuffer(jsonData))
+	client := &http.Client{Transport: c.httpClient.Transport, Timeout: 10 * time.Second}
+	// Build the URL: /agent/public/setting/config-groups/{groupName}
+	req, err := transport.NewAPIRequest(http.MethodPut, u, apiPathForConfigGroups,
+		bytes.NewBuffer(jsonData), "default")
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
@@ -361,7 +425,8 @@ func (c *KubeAgent) applyConfigClassToCluster() error {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to call config groups api for url %s: %w", baseURL.String(), err)
+		return fmt.Errorf("failed to call config groups api for url %s: %w",
+			redact.URL(req.URL, c.APIKey), err)
 	}
 	defer resp.Body.Close()
 
@@ -72,7 +72,8 @@ func TestCallRestartStatusAPI(t *testing.T) {
 			ClusterName:          "cluster",
 		},
 
-		logger: logger,
+		logger:     logger,
+		httpClient: http.DefaultClient,
 	}
 
 	// Mock the HTTP server
@@ -216,3 +217,80 @@ func TestRolloutRestart(t *testing.T) {
 	err = kubeAgentMonitor.rolloutRestart(context.Background(), Deployment)
 	assert.NoError(t, err)
 }
+
+func TestRolloutRestartMountsOffsetsDir(t *testing.T) {
+	fakeClientset := fake.NewClientset()
+	ctx := context.Background()
+
+	daemonset := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-daemonset",
+			Namespace: "test-namespace",
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "mw-agent"}},
+				},
+			},
+		},
+	}
+	_, err := fakeClientset.AppsV1().DaemonSets("test-namespace").Create(ctx, daemonset, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	kubeAgent := &KubeAgent{
+		BaseConfig: BaseConfig{
+			AgentNamespaceName: "test-namespace",
+			DaemonsetName:      "test-daemonset",
+			OffsetsDir:         "/var/lib/mw-agent/offsets",
+		},
+		clientset: fakeClientset,
+		logger:    zap.NewNop(),
+	}
+
+	// the volume is only added once
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, kubeAgent.rolloutRestart(ctx, DaemonSet))
+	}
+
+	updated, err := fakeClientset.AppsV1().DaemonSets("test-namespace").Get(ctx, "test-daemonset", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	podSpec := updated.Spec.Template.Spec
+	assert.Len(t, podSpec.Volumes, 1)
+	assert.Equal(t, "/var/lib/mw-agent/offsets", podSpec.Volumes[0].HostPath.Path)
+	assert.Equal(t, []corev1.VolumeMount{{
+		Name:      offsetsVolumeName,
+		MountPath: "/var/lib/mw-agent/offsets",
+	}}, podSpec.Containers[0].VolumeMounts)
+}
+
+func TestUpdateConfigForOffsets(t *testing.T) {
+	kubeAgent := &KubeAgent{
+		BaseConfig: BaseConfig{
+			OffsetsDir: "/var/lib/mw-agent/offsets",
+		},
+	}
+
+	config := map[string]interface{}{
+		"receivers": map[string]interface{}{
+			"filelog":       map[string]interface{}{"start_at": "beginning"},
+			"fluentforward": map[string]interface{}{},
+		},
+		"service": map[string]interface{}{
+			"extensions": []interface{}{"health_check"},
+		},
+	}
+
+	config, err := kubeAgent.updateConfigForOffsets(config)
+	assert.NoError(t, err)
+
+	receivers := config["receivers"].(map[string]interface{})
+	assert.Equal(t, OffsetsStorageID, receivers["filelog"].(map[string]interface{})["storage"])
+	assert.NotContains(t, receivers["fluentforward"], "storage")
+	assert.Equal(t, []interface{}{"health_check", OffsetsStorageID},
+		config["service"].(map[string]interface{})["extensions"])
+}
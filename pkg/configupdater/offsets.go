@@ -0,0 +1,55 @@
+package configupdater
+
+import (
+	"github.com/middleware-labs/mw-agent/pkg/otelconfig"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// OffsetsStorageID is the id of the file_storage extension the log
+	// receivers of the daemonset keep their read offsets in.
+	OffsetsStorageID = otelconfig.OffsetsStorageID
+
+	offsetsVolumeName = "mw-agent-offsets"
+)
+
+// updateConfigForOffsets makes every filelog and journald receiver in the
+// daemonset config keep its offsets in OffsetsDir, see
+// otelconfig.UpdateReceiversForOffsets.
+func (c *KubeAgent) updateConfigForOffsets(config map[string]interface{}) (map[string]interface{}, error) {
+	if err := otelconfig.UpdateReceiversForOffsets(config, c.OffsetsDir); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// addOffsetsVolume mounts the hostPath directory dir at the same path in
+// every container of podSpec unless it is already mounted. It returns
+// false if podSpec is unchanged.
+func addOffsetsVolume(podSpec *v1.PodSpec, dir string) bool {
+	for _, volume := range podSpec.Volumes {
+		if volume.Name == offsetsVolumeName {
+			return false
+		}
+	}
+
+	hostPathType := v1.HostPathDirectoryOrCreate
+	podSpec.Volumes = append(podSpec.Volumes, v1.Volume{
+		Name: offsetsVolumeName,
+		VolumeSource: v1.VolumeSource{
+			HostPath: &v1.HostPathVolumeSource{
+				Path: dir,
+				Type: &hostPathType,
+			},
+		},
+	})
+
+	for i := range podSpec.Containers {
+		podSpec.Containers[i].VolumeMounts = append(podSpec.Containers[i].VolumeMounts,
+			v1.VolumeMount{
+				Name:      offsetsVolumeName,
+				MountPath: dir,
+			})
+	}
+	return true
+}
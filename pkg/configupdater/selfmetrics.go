@@ -0,0 +1,69 @@
+package configupdater
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// kubeAgentMetrics are the self metrics of the KubeAgent config updater. A
+// nil *kubeAgentMetrics records nothing.
+type kubeAgentMetrics struct {
+	restartStatusPolls metric.Int64Counter
+	configMapUpdates   metric.Int64Counter
+	rolloutRestarts    metric.Int64Counter
+}
+
+func newKubeAgentMetrics(meter metric.Meter) (*kubeAgentMetrics, error) {
+	var m kubeAgentMetrics
+	var err error
+
+	m.restartStatusPolls, err = meter.Int64Counter("mw_agent.config.restart_status_polls",
+		metric.WithDescription("Number of restart status polls of the Middleware backend by outcome"))
+	if err != nil {
+		return nil, err
+	}
+	m.configMapUpdates, err = meter.Int64Counter("mw_agent.kube.configmap_updates",
+		metric.WithDescription("Number of otel config configmap updates by component and outcome"))
+	if err != nil {
+		return nil, err
+	}
+	m.rolloutRestarts, err = meter.Int64Counter("mw_agent.kube.rollout_restarts",
+		metric.WithDescription("Number of rollout restarts of the agent components by component and outcome"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func outcome(err error) attribute.KeyValue {
+	if err != nil {
+		return attribute.String("outcome", "error")
+	}
+	return attribute.String("outcome", "ok")
+}
+
+func (m *kubeAgentMetrics) recordRestartStatusPoll(err error) {
+	if m == nil {
+		return
+	}
+	m.restartStatusPolls.Add(context.Background(), 1, metric.WithAttributes(outcome(err)))
+}
+
+func (m *kubeAgentMetrics) recordConfigMapUpdate(componentType ComponentType, err error) {
+	if m == nil {
+		return
+	}
+	m.configMapUpdates.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("component", componentType.String()), outcome(err)))
+}
+
+func (m *kubeAgentMetrics) recordRolloutRestart(componentType ComponentType, err error) {
+	if m == nil {
+		return
+	}
+	m.rolloutRestarts.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("component", componentType.String()), outcome(err)))
+}
@@ -0,0 +1,56 @@
+package otelconfig
+
+import (
+	"strings"
+)
+
+// OffsetsStorageID is the id of the file_storage extension the log
+// receivers keep their read offsets in.
+const OffsetsStorageID = "file_storage/mw_offsets"
+
+// logTailingReceiverTypes are the receiver types whose offsets are kept in
+// OffsetsStorageID.
+var logTailingReceiverTypes = map[string]bool{
+	"filelog":  true,
+	"journald": true,
+}
+
+// UpdateReceiversForOffsets makes every filelog and journald receiver in
+// config keep its offsets in dir, so that collector restarts and agent
+// upgrades neither re-read nor skip logs. Receivers that already have a
+// storage are left as they are.
+func UpdateReceiversForOffsets(config map[string]interface{}, dir string) error {
+	receiversData, ok := config["receivers"].(map[string]interface{})
+	if !ok {
+		return ErrParseReceivers
+	}
+
+	found := false
+	for id, receiver := range receiversData {
+		receiverType, _, _ := strings.Cut(id, "/")
+		if !logTailingReceiverTypes[receiverType] {
+			continue
+		}
+
+		receiverData, ok := receiver.(map[string]interface{})
+		if !ok {
+			receiverData = map[string]interface{}{}
+		}
+		if _, ok := receiverData["storage"]; ok {
+			continue
+		}
+
+		receiverData["storage"] = OffsetsStorageID
+		receiversData[id] = receiverData
+		found = true
+	}
+
+	if !found {
+		return nil
+	}
+
+	return AddExtension(config, OffsetsStorageID, map[string]interface{}{
+		"directory":        dir,
+		"create_directory": true,
+	})
+}
@@ -0,0 +1,43 @@
+// Package otelconfig holds the transforms of the otel configs shared by the
+// host agent and the Kubernetes config updater. The configs are the
+// map[string]interface{} documents the agents build from the Middleware
+// backend response.
+package otelconfig
+
+import (
+	"errors"
+)
+
+var (
+	ErrParseReceivers  = errors.New("failed to parse receivers in otel config file")
+	ErrParseExtensions = errors.New("failed to parse extensions in otel config file")
+	ErrParseService    = errors.New("failed to parse service in otel config file")
+)
+
+// AddExtension adds the extension id configured by extensionConfig to
+// config and enables it in the service.
+func AddExtension(config map[string]interface{}, id string, extensionConfig map[string]interface{}) error {
+	extensionsData, ok := config["extensions"].(map[string]interface{})
+	if !ok {
+		if config["extensions"] != nil {
+			return ErrParseExtensions
+		}
+		extensionsData = map[string]interface{}{}
+		config["extensions"] = extensionsData
+	}
+	extensionsData[id] = extensionConfig
+
+	serviceData, ok := config["service"].(map[string]interface{})
+	if !ok {
+		return ErrParseService
+	}
+
+	serviceExtensions, _ := serviceData["extensions"].([]interface{})
+	for _, serviceExtension := range serviceExtensions {
+		if serviceExtension == id {
+			return nil
+		}
+	}
+	serviceData["extensions"] = append(serviceExtensions, id)
+	return nil
+}
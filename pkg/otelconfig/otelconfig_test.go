@@ -0,0 +1,55 @@
+package otelconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddExtension(t *testing.T) {
+	config := map[string]interface{}{
+		"service": map[string]interface{}{
+			"extensions": []interface{}{"health_check"},
+		},
+	}
+
+	assert.NoError(t, AddExtension(config, OffsetsStorageID, map[string]interface{}{"directory": "/tmp"}))
+	// adding the extension again updates its config only
+	assert.NoError(t, AddExtension(config, OffsetsStorageID, map[string]interface{}{"directory": "/var"}))
+
+	assert.Equal(t, map[string]interface{}{
+		OffsetsStorageID: map[string]interface{}{"directory": "/var"},
+	}, config["extensions"])
+	assert.Equal(t, []interface{}{"health_check", OffsetsStorageID},
+		config["service"].(map[string]interface{})["extensions"])
+
+	assert.ErrorIs(t, AddExtension(map[string]interface{}{"extensions": "none"}, OffsetsStorageID, nil),
+		ErrParseExtensions)
+	assert.ErrorIs(t, AddExtension(map[string]interface{}{}, OffsetsStorageID, nil), ErrParseService)
+}
+
+func TestUpdateReceiversForOffsets(t *testing.T) {
+	config := map[string]interface{}{
+		"receivers": map[string]interface{}{
+			"filelog":      map[string]interface{}{"include": []interface{}{"/var/log/*.log"}},
+			"journald/app": nil,
+			"filelog/own":  map[string]interface{}{"storage": "file_storage/own"},
+			"otlp":         map[string]interface{}{},
+		},
+		"service": map[string]interface{}{},
+	}
+
+	assert.NoError(t, UpdateReceiversForOffsets(config, "/var/lib/mw-agent/offsets"))
+
+	receivers := config["receivers"].(map[string]interface{})
+	assert.Equal(t, OffsetsStorageID, receivers["filelog"].(map[string]interface{})["storage"])
+	assert.Equal(t, OffsetsStorageID, receivers["journald/app"].(map[string]interface{})["storage"])
+	assert.Equal(t, "file_storage/own", receivers["filelog/own"].(map[string]interface{})["storage"])
+	assert.NotContains(t, receivers["otlp"], "storage")
+	assert.Equal(t, map[string]interface{}{
+		"directory":        "/var/lib/mw-agent/offsets",
+		"create_directory": true,
+	}, config["extensions"].(map[string]interface{})[OffsetsStorageID])
+
+	assert.ErrorIs(t, UpdateReceiversForOffsets(map[string]interface{}{}, "/tmp"), ErrParseReceivers)
+}
@@ -0,0 +1,178 @@
+// Package redact masks the secrets of the agents, e.g. the API key, in the
+// URLs, errors and config dumps they log.
+package redact
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// mask replaces the masked part of a secret.
+const mask = "xxxxx"
+
+// visibleSuffixLen is the number of trailing characters of a long secret
+// kept by Secret, enough to tell two API keys apart.
+const visibleSuffixLen = 4
+
+// Secret returns secret masked. Secrets longer than 16 characters keep
+// their last 4 characters.
+func Secret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) <= 4*visibleSuffixLen {
+		return mask
+	}
+	return mask + secret[len(secret)-visibleSuffixLen:]
+}
+
+// MinSecretLen is the length under which Add ignores a secret. Masking
+// shorter secrets would mask ordinary words of the logs, so they are not
+// masked at all.
+const MinSecretLen = 6
+
+// registry holds the secrets masked by String and WriteSyncer.
+var registry struct {
+	sync.RWMutex
+	secrets  []string
+	replacer *strings.Replacer
+}
+
+// Add registers secrets, e.g. the API key or the resolved secret
+// references of the configs, to be masked by String and WriteSyncer. It
+// reports false if one of them is shorter than MinSecretLen and is thus
+// not masked.
+func Add(secrets ...string) bool {
+	registry.Lock()
+	defer registry.Unlock()
+
+	masked := true
+	added := false
+	for _, secret := range secrets {
+		if secret != "" && len(secret) < MinSecretLen {
+			masked = false
+			continue
+		}
+		if secret == "" || slices.Contains(registry.secrets, secret) {
+			continue
+		}
+		registry.secrets = append(registry.secrets, secret)
+		added = true
+	}
+	if !added {
+		return masked
+	}
+
+	// mask the longest secret when secrets overlap
+	sort.Slice(registry.secrets, func(i, j int) bool {
+		return len(registry.secrets[i]) > len(registry.secrets[j])
+	})
+	oldNew := make([]string, 0, 2*len(registry.secrets))
+	for _, secret := range registry.secrets {
+		oldNew = append(oldNew, secret, Secret(secret))
+	}
+	registry.replacer = strings.NewReplacer(oldNew...)
+	return masked
+}
+
+// String returns s with every occurrence of secrets and of the secrets
+// registered with Add masked.
+func String(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		s = strings.ReplaceAll(s, secret, Secret(secret))
+	}
+
+	registry.RLock()
+	defer registry.RUnlock()
+	if registry.replacer != nil {
+		s = registry.replacer.Replace(s)
+	}
+	return s
+}
+
+// URL returns u as a string with its password and every occurrence of
+// secrets masked.
+func URL(u *url.URL, secrets ...string) string {
+	if u == nil {
+		return ""
+	}
+	return String(u.Redacted(), secrets...)
+}
+
+// WriteSyncer returns a zapcore.WriteSyncer masking the secrets registered
+// with Add in the log entries written to ws. It catches the secrets logged
+// by the libraries the agents use, whose log messages can't be redacted at
+// the source.
+func WriteSyncer(ws zapcore.WriteSyncer) zapcore.WriteSyncer {
+	return &writeSyncer{WriteSyncer: ws}
+}
+
+type writeSyncer struct {
+	zapcore.WriteSyncer
+}
+
+func (w *writeSyncer) Write(p []byte) (int, error) {
+	if _, err := w.WriteSyncer.Write([]byte(String(string(p)))); err != nil {
+		return 0, err
+	}
+	// report the length of p, as callers check it against what they wrote
+	return len(p), nil
+}
+
+// Core returns a zapcore.Core masking the secrets registered with Add in
+// the messages and the string, error and stringer fields of the entries
+// logged to core. It masks the logs of the loggers whose writer can't be
+// wrapped with WriteSyncer, e.g. the one the collector builds.
+func Core(core zapcore.Core) zapcore.Core {
+	return &redactCore{Core: core}
+}
+
+type redactCore struct {
+	zapcore.Core
+}
+
+func (c *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactCore{Core: c.Core.With(redactFields(fields))}
+}
+
+func (c *redactCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	// let core decide, e.g. to sample the entry, but write it through c
+	if c.Core.Check(ent, nil) == nil {
+		return ce
+	}
+	return ce.AddCore(ent, c)
+}
+
+func (c *redactCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = String(ent.Message)
+	return c.Core.Write(ent, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		switch field.Type {
+		case zapcore.StringType:
+			field.String = String(field.String)
+		case zapcore.ErrorType:
+			if err, ok := field.Interface.(error); ok && err != nil {
+				field = zapcore.Field{Key: field.Key, Type: zapcore.StringType, String: String(err.Error())}
+			}
+		case zapcore.StringerType:
+			if stringer, ok := field.Interface.(fmt.Stringer); ok && stringer != nil {
+				field = zapcore.Field{Key: field.Key, Type: zapcore.StringType, String: String(stringer.String())}
+			}
+		}
+		redacted[i] = field
+	}
+	return redacted
+}
@@ -0,0 +1,423 @@
+// Package secret resolves the secret references of the agent configs, so
+// that the API key and the credentials of the integrations don't have to
+// be written in clear text in them.
+//
+// The following references are supported in the agent config, the otel
+// config and the integration YAML files:
+//   - ${file:PATH}: the content of the file PATH.
+//   - ${secret:NAME}: the content of the file NAME of the secrets
+//     directory of the agent.
+//   - ${secret:mwenc:...}: a value encrypted with Encrypt, decrypted with
+//     the key file of the agent.
+//
+// Files may also hold a value encrypted with Encrypt. Every resolved
+// secret is registered with redact.Add so that it is masked in the logs.
+// Secrets shorter than redact.MinSecretLen are not masked, a warning is
+// logged when one is resolved.
+package secret
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/middleware-labs/mw-agent/pkg/redact"
+	"go.opentelemetry.io/collector/confmap"
+	"go.opentelemetry.io/collector/confmap/provider/fileprovider"
+	"go.uber.org/zap"
+)
+
+// ProviderScheme is the scheme of the secret references, e.g.
+// ${secret:postgresql-password}.
+const ProviderScheme = "secret"
+
+// fileScheme is the scheme of the file references, e.g.
+// ${file:/etc/mw-agent/api-key}.
+const fileScheme = "file"
+
+// EncryptedPrefix starts the values encrypted with Encrypt.
+const EncryptedPrefix = "mwenc:"
+
+// keySize is the size of the AES-256 keys of the key files.
+const keySize = 32
+
+var (
+	ErrInvalidSecret  = errors.New("invalid secret")
+	ErrInvalidKeyFile = errors.New("invalid secret key file")
+)
+
+var referenceRegex = regexp.MustCompile(`\$\{(` + fileScheme + `|` + ProviderScheme + `):([^}]+)\}`)
+
+// Resolver resolves the secret references of the agent configs.
+type Resolver struct {
+	// Dir is the directory of the named secrets, one file per secret.
+	Dir string
+	// KeyFile holds the key decrypting the encrypted values, as written by
+	// WriteKeyFile.
+	KeyFile string
+	// Logger is warned about the resolved secrets too short to be masked
+	// in the logs. No warning is logged if it is nil.
+	Logger *zap.Logger
+}
+
+// Field is a setting of the agent config which may hold a secret
+// reference.
+type Field struct {
+	Name  string
+	Value *string
+}
+
+// ResolveFields replaces the secret references of fields with the secrets
+// they refer to.
+func (r Resolver) ResolveFields(fields ...Field) error {
+	for _, field := range fields {
+		value, err := r.Resolve(*field.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", field.Name, err)
+		}
+		*field.Value = value
+	}
+	return nil
+}
+
+// Resolve returns value with its secret references replaced with the
+// secrets they refer to. A value starting with EncryptedPrefix is
+// decrypted.
+func (r Resolver) Resolve(value string) (string, error) {
+	if strings.HasPrefix(value, EncryptedPrefix) {
+		return r.decrypt(value)
+	}
+
+	var errs []error
+	resolved := referenceRegex.ReplaceAllStringFunc(value, func(ref string) string {
+		match := referenceRegex.FindStringSubmatch(ref)
+
+		var secret string
+		var err error
+		if match[1] == fileScheme {
+			secret, err = r.File(match[2])
+		} else {
+			secret, err = r.Secret(match[2])
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return secret
+	})
+
+	return resolved, errors.Join(errs...)
+}
+
+// IsReference reports whether value is a single secret reference, e.g.
+// ${secret:postgresql-password}, so that the secret it refers to is not
+// written in the config holding it.
+func IsReference(value string) bool {
+	loc := referenceRegex.FindStringIndex(value)
+	return loc != nil && loc[0] == 0 && loc[1] == len(value)
+}
+
+// CheckReferences checks that the secret references of the strings of
+// config, e.g. an integration YAML file, can be resolved. The config is
+// left unchanged: the references are resolved by the providers of the
+// collector.
+func (r Resolver) CheckReferences(config interface{}) error {
+	switch config := config.(type) {
+	case string:
+		_, err := r.Resolve(config)
+		return err
+	case map[string]interface{}:
+		for key, value := range config {
+			if err := r.CheckReferences(value); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	case map[interface{}]interface{}:
+		for key, value := range config {
+			if err := r.CheckReferences(value); err != nil {
+				return fmt.Errorf("%v: %w", key, err)
+			}
+		}
+	case []interface{}:
+		for _, value := range config {
+			if err := r.CheckReferences(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// File returns the secret held by the file path, without its surrounding
+// white space.
+func (r Resolver) File(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidSecret, err)
+	}
+
+	secret := strings.TrimSpace(string(data))
+	if strings.HasPrefix(secret, EncryptedPrefix) {
+		return r.decrypt(secret)
+	}
+
+	r.register(path, secret)
+	return secret, nil
+}
+
+// Secret returns the secret name of Dir, or decrypts name if it is an
+// encrypted value.
+func (r Resolver) Secret(name string) (string, error) {
+	if strings.HasPrefix(name, EncryptedPrefix) {
+		return r.decrypt(name)
+	}
+
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("%w: invalid secret name %q", ErrInvalidSecret, name)
+	}
+	if r.Dir == "" {
+		return "", fmt.Errorf("%w: no secrets directory to read %q from", ErrInvalidSecret, name)
+	}
+
+	return r.File(filepath.Join(r.Dir, name))
+}
+
+func (r Resolver) decrypt(value string) (string, error) {
+	key, err := ReadKeyFile(r.KeyFile)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := Decrypt(value, key)
+	if err != nil {
+		return "", err
+	}
+
+	r.register("encrypted value", secret)
+	return secret, nil
+}
+
+// register registers secret with redact.Add and warns if it is too short
+// to be masked. ref tells where the secret comes from, e.g. its file.
+func (r Resolver) register(ref string, secret string) {
+	if !redact.Add(secret) {
+		warnUnmasked(r.Logger, ref)
+	}
+}
+
+func warnUnmasked(logger *zap.Logger, ref string) {
+	if logger == nil {
+		return
+	}
+	logger.Warn("secret is too short to be masked in the logs",
+		zap.String("secret", ref), zap.Int("min_length", redact.MinSecretLen))
+}
+
+// NewProviderFactory returns a confmap.ProviderFactory resolving the
+// ${secret:...} references of the otel config with r.
+func (r Resolver) NewProviderFactory() confmap.ProviderFactory {
+	return confmap.NewProviderFactory(func(settings confmap.ProviderSettings) confmap.Provider {
+		if r.Logger == nil {
+			r.Logger = settings.Logger
+		}
+		return &provider{retrieve: r.Secret}
+	})
+}
+
+// NewPlaceholderProviderFactory returns a confmap.ProviderFactory
+// resolving the ${secret:...} references with a placeholder, to check an
+// otel config without access to the secrets.
+func NewPlaceholderProviderFactory() confmap.ProviderFactory {
+	return confmap.NewProviderFactory(func(confmap.ProviderSettings) confmap.Provider {
+		return &provider{retrieve: func(string) (string, error) {
+			return "placeholder", nil
+		}}
+	})
+}
+
+type provider struct {
+	retrieve func(name string) (string, error)
+}
+
+// Retrieve implements confmap.Provider.
+func (p *provider) Retrieve(_ context.Context, uri string, _ confmap.WatcherFunc) (*confmap.Retrieved, error) {
+	name, ok := strings.CutPrefix(uri, ProviderScheme+":")
+	if !ok {
+		return nil, fmt.Errorf("%w: %q is not a %s uri", ErrInvalidSecret, uri, ProviderScheme)
+	}
+
+	secret, err := p.retrieve(name)
+	if err != nil {
+		return nil, err
+	}
+	return confmap.NewRetrieved(secret)
+}
+
+// Scheme implements confmap.Provider.
+func (*provider) Scheme() string {
+	return ProviderScheme
+}
+
+// Shutdown implements confmap.Provider.
+func (*provider) Shutdown(context.Context) error {
+	return nil
+}
+
+// NewFileProviderFactory returns the confmap.ProviderFactory of the
+// collector for the file scheme, registering the scalar values it
+// resolves, e.g. ${file:/etc/mw-agent/postgresql-password}, with
+// redact.Add. The white space surrounding the string values is trimmed,
+// like the one of the files read by the Resolver.
+func NewFileProviderFactory() confmap.ProviderFactory {
+	factory := fileprovider.NewFactory()
+	return confmap.NewProviderFactory(func(settings confmap.ProviderSettings) confmap.Provider {
+		return &fileProvider{Provider: factory.Create(settings), logger: settings.Logger}
+	})
+}
+
+type fileProvider struct {
+	confmap.Provider
+	logger *zap.Logger
+}
+
+// Retrieve implements confmap.Provider.
+func (p *fileProvider) Retrieve(ctx context.Context, uri string, watcher confmap.WatcherFunc) (*confmap.Retrieved, error) {
+	retrieved, err := p.Provider.Retrieve(ctx, uri, watcher)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := retrieved.AsRaw()
+	if err != nil {
+		return nil, err
+	}
+	switch raw := raw.(type) {
+	case map[string]any, []any:
+		// a config file rather than a secret
+	case string:
+		secret := strings.TrimSpace(raw)
+		if !redact.Add(secret) {
+			warnUnmasked(p.logger, uri)
+		}
+		return confmap.NewRetrieved(secret)
+	default:
+		if s, err := retrieved.AsString(); err == nil && !redact.Add(strings.TrimSpace(s)) {
+			warnUnmasked(p.logger, uri)
+		}
+	}
+	return retrieved, nil
+}
+
+// Encrypt returns plaintext encrypted with key using AES-256-GCM, in the
+// format decrypted by the Resolver: EncryptedPrefix followed by the base64
+// encoded nonce and ciphertext.
+func Encrypt(plaintext string, key []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return EncryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the plaintext of value, encrypted by Encrypt with key.
+func Decrypt(value string, key []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, EncryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidSecret, err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("%w: encrypted value is too short", ErrInvalidSecret)
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		// do not tell a wrong key from a corrupted value
+		return "", fmt.Errorf("%w: failed to decrypt value", ErrInvalidSecret)
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeyFile, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// GenerateKey returns a random key for Encrypt.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WriteKeyFile writes key to the new file path, readable only by its
+// owner.
+func WriteKeyFile(path string, key []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadKeyFile returns the key of the key file path. The file must not be
+// accessible to the group and other users of the host, except on Windows
+// where the access is controlled by ACLs.
+func ReadKeyFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("%w: no key file to decrypt the secrets with", ErrInvalidKeyFile)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeyFile, err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("%w: %s is accessible to other users, expected mode 0600",
+			ErrInvalidKeyFile, path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeyFile, err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeyFile, err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("%w: expected a %d bytes key, got %d", ErrInvalidKeyFile, keySize, len(key))
+	}
+	return key, nil
+}
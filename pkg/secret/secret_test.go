@@ -0,0 +1,167 @@
+package secret
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/middleware-labs/mw-agent/pkg/redact"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/confmap"
+	"go.opentelemetry.io/collector/confmap/provider/yamlprovider"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func newResolver(t *testing.T) (Resolver, []byte) {
+	dir := t.TempDir()
+	r := Resolver{
+		Dir:     filepath.Join(dir, "secrets"),
+		KeyFile: filepath.Join(dir, "secret.key"),
+	}
+	assert.NoError(t, os.Mkdir(r.Dir, 0700))
+
+	key, err := GenerateKey()
+	assert.NoError(t, err)
+	assert.NoError(t, WriteKeyFile(r.KeyFile, key))
+	return r, key
+}
+
+func TestResolve(t *testing.T) {
+	r, key := newResolver(t)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(r.Dir, "db-password"), []byte("pg-s3cret\n"), 0600))
+	apiKeyFile := filepath.Join(t.TempDir(), "api-key")
+	assert.NoError(t, os.WriteFile(apiKeyFile, []byte("4f1c2e8a9b7d6f3e5a0c"), 0600))
+	encrypted, err := Encrypt("proxy-s3cret", key)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"plain", "plain"},
+		{"${secret:db-password}", "pg-s3cret"},
+		{"postgres://agent:${secret:db-password}@db:5432", "postgres://agent:pg-s3cret@db:5432"},
+		{"${file:" + apiKeyFile + "}", "4f1c2e8a9b7d6f3e5a0c"},
+		{encrypted, "proxy-s3cret"},
+		{"${secret:" + encrypted + "}", "proxy-s3cret"},
+	}
+	for _, test := range tests {
+		value, err := r.Resolve(test.value)
+		assert.NoError(t, err, test.value)
+		assert.Equal(t, test.expected, value)
+	}
+
+	// the resolved secrets are masked in the logs
+	assert.Equal(t, "password: xxxxx", redact.String("password: proxy-s3cret"))
+}
+
+func TestResolveErrors(t *testing.T) {
+	r, _ := newResolver(t)
+
+	for _, value := range []string{
+		"${secret:missing}",
+		"${secret:../secret.key}",
+		"${file:/does/not/exist}",
+		"mwenc:not-base64!",
+	} {
+		_, err := r.Resolve(value)
+		assert.ErrorIs(t, err, ErrInvalidSecret, value)
+	}
+
+	// a value encrypted with another key
+	otherKey, err := GenerateKey()
+	assert.NoError(t, err)
+	encrypted, err := Encrypt("s3cret", otherKey)
+	assert.NoError(t, err)
+	_, err = r.Resolve(encrypted)
+	assert.ErrorIs(t, err, ErrInvalidSecret)
+}
+
+func TestReadKeyFile(t *testing.T) {
+	r, key := newResolver(t)
+
+	read, err := ReadKeyFile(r.KeyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, key, read)
+
+	// the key file already exists
+	assert.Error(t, WriteKeyFile(r.KeyFile, key))
+
+	assert.NoError(t, os.Chmod(r.KeyFile, 0644))
+	_, err = ReadKeyFile(r.KeyFile)
+	assert.ErrorIs(t, err, ErrInvalidKeyFile)
+
+	_, err = ReadKeyFile("")
+	assert.ErrorIs(t, err, ErrInvalidKeyFile)
+}
+
+func TestProviders(t *testing.T) {
+	r, _ := newResolver(t)
+	assert.NoError(t, os.WriteFile(filepath.Join(r.Dir, "rabbitmq-password"), []byte("rmq-s3cret"), 0600))
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	assert.NoError(t, os.WriteFile(passwordFile, []byte("file-s3cret\n"), 0600))
+
+	resolver, err := confmap.NewResolver(confmap.ResolverSettings{
+		URIs: []string{"yaml:receivers: {rabbitmq: {password: '${secret:rabbitmq-password}', " +
+			"username: '${file:" + passwordFile + "}'}}"},
+		ProviderFactories: []confmap.ProviderFactory{
+			r.NewProviderFactory(),
+			NewFileProviderFactory(),
+			yamlprovider.NewFactory(),
+		},
+	})
+	assert.NoError(t, err)
+
+	conf, err := resolver.Resolve(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "rmq-s3cret", conf.Get("receivers::rabbitmq::password"))
+	assert.Equal(t, "file-s3cret", conf.Get("receivers::rabbitmq::username"))
+	assert.Equal(t, "xxxxx, xxxxx", redact.String("rmq-s3cret, file-s3cret"))
+}
+
+func TestCheckReferences(t *testing.T) {
+	r, _ := newResolver(t)
+	assert.NoError(t, os.WriteFile(filepath.Join(r.Dir, "mongodb-password"), []byte("mongo-s3cret"), 0600))
+
+	config := map[string]interface{}{
+		"mongodb": map[interface{}]interface{}{
+			"endpoint": "localhost:27017",
+			"password": "${secret:mongodb-password}",
+			"hosts":    []interface{}{"${env:MONGODB_HOST}"},
+		},
+	}
+	assert.NoError(t, r.CheckReferences(config))
+
+	config["mongodb"].(map[interface{}]interface{})["username"] = "${secret:mongodb-username}"
+	err := r.CheckReferences(config)
+	assert.ErrorIs(t, err, ErrInvalidSecret)
+	assert.Contains(t, err.Error(), "mongodb: username")
+}
+
+func TestIsReference(t *testing.T) {
+	assert.True(t, IsReference("${secret:postgresql-password}"))
+	assert.True(t, IsReference("${file:/etc/mw-agent/postgresql-password}"))
+	assert.False(t, IsReference("s3cret"))
+	assert.False(t, IsReference("pre-${secret:postgresql-password}"))
+	assert.False(t, IsReference("${env:POSTGRESQL_PASSWORD}"))
+}
+
+func TestResolveShortSecret(t *testing.T) {
+	r, _ := newResolver(t)
+	assert.NoError(t, os.WriteFile(filepath.Join(r.Dir, "pin"), []byte("1234"), 0600))
+
+	var buf bytes.Buffer
+	r.Logger = zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.AddSync(&buf), zapcore.WarnLevel))
+
+	secret, err := r.Resolve("${secret:pin}")
+	assert.NoError(t, err)
+	assert.Equal(t, "1234", secret)
+	assert.Contains(t, buf.String(), "secret is too short to be masked in the logs")
+	assert.Contains(t, buf.String(), filepath.Join(r.Dir, "pin"))
+	assert.NotContains(t, buf.String(), `"1234"`)
+}
@@ -0,0 +1,202 @@
+// Package selftelemetry exports the metrics the agents record about
+// themselves, as opposed to the telemetry they collect. The metrics are
+// served in the Prometheus format and pushed to Middleware over OTLP.
+package selftelemetry
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// MetricsPath is the path the metrics are served on.
+	MetricsPath = "/metrics"
+
+	defaultPushInterval = time.Minute
+	shutdownTimeout     = 5 * time.Second
+)
+
+// Config configures the self telemetry of an agent.
+type Config struct {
+	// ServiceName identifies the agent, e.g. mw-host-agent.
+	ServiceName string
+	Version     string
+	HostID      string
+	// Target is the Middleware endpoint the metrics are pushed to. Metrics
+	// are not pushed if it is empty.
+	Target string
+	// APIKey authenticates the push to Target. It is only sent as a
+	// header, never as an attribute served with the metrics.
+	APIKey string
+	// TLS is the client TLS config used to push to Target, the system
+	// defaults are used if it is nil.
+	TLS *tls.Config
+	// Proxy returns the proxy to push to Target through, as returned by
+	// transport.ProxyConfig.ProxyFunc. The metrics are pushed over
+	// OTLP/HTTP when it is set since OTLP/gRPC has no proxy support.
+	Proxy func(*url.URL) (*url.URL, error)
+	// PushInterval defaults to one minute.
+	PushInterval time.Duration
+}
+
+// Telemetry holds the meter provider of the agent self metrics.
+type Telemetry struct {
+	meterProvider *sdkmetric.MeterProvider
+	handler       http.Handler
+	logger        *zap.Logger
+}
+
+// New returns a Telemetry exporting the metrics recorded through its
+// meters as configured by cfg.
+func New(ctx context.Context, cfg Config, logger *zap.Logger) (*Telemetry, error) {
+	registry := prometheus.NewRegistry()
+	// the resource attributes are pushed with the metrics, but not served
+	// as the target_info metric
+	promExporter, err := otelprom.New(otelprom.WithRegisterer(registry),
+		otelprom.WithoutTargetInfo())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create prometheus exporter: %w", err)
+	}
+
+	res := resource.NewSchemaless(
+		attribute.String("service.name", cfg.ServiceName),
+		attribute.String("service.version", cfg.Version),
+		attribute.String("host.id", cfg.HostID),
+	)
+
+	opts := []sdkmetric.Option{
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(promExporter),
+	}
+
+	if cfg.Target != "" {
+		otlpExporter, err := newOTLPExporter(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		interval := cfg.PushInterval
+		if interval <= 0 {
+			interval = defaultPushInterval
+		}
+		opts = append(opts, sdkmetric.WithReader(
+			sdkmetric.NewPeriodicReader(otlpExporter, sdkmetric.WithInterval(interval))))
+	}
+
+	return &Telemetry{
+		meterProvider: sdkmetric.NewMeterProvider(opts...),
+		handler:       promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		logger:        logger,
+	}, nil
+}
+
+// newOTLPExporter returns an OTLP exporter sending to cfg.Target, e.g.
+// https://myaccount.middleware.io, authenticated with cfg.APIKey. It uses
+// OTLP/HTTP through cfg.Proxy if set, and OTLP/gRPC otherwise.
+func newOTLPExporter(ctx context.Context, cfg Config) (sdkmetric.Exporter, error) {
+	u, err := url.Parse(cfg.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %s: %w", cfg.Target, err)
+	}
+
+	endpoint := u.Host
+	if u.Port() == "" {
+		endpoint = net.JoinHostPort(u.Hostname(), "443")
+	}
+	headers := map[string]string{"authorization": cfg.APIKey}
+
+	if cfg.Proxy != nil {
+		opts := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(endpoint),
+			otlpmetrichttp.WithHeaders(headers),
+			otlpmetrichttp.WithProxy(func(req *http.Request) (*url.URL, error) {
+				return cfg.Proxy(req.URL)
+			}),
+		}
+		switch {
+		case u.Scheme == "http":
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		case cfg.TLS != nil:
+			opts = append(opts, otlpmetrichttp.WithTLSClientConfig(cfg.TLS))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+
+	opts := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithEndpoint(endpoint),
+		otlpmetricgrpc.WithHeaders(headers),
+	}
+	switch {
+	case u.Scheme == "http":
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	case cfg.TLS != nil:
+		opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(cfg.TLS)))
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+// Meter returns the meter the agent records its self metrics with.
+func (t *Telemetry) Meter(name string) metric.Meter {
+	return t.meterProvider.Meter(name)
+}
+
+// Handler returns the handler serving the metrics in the Prometheus format.
+func (t *Telemetry) Handler() http.Handler {
+	return t.handler
+}
+
+// Serve serves the metrics on MetricsPath at address until stopCh is
+// closed.
+func (t *Telemetry) Serve(address string, stopCh <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, t.handler)
+
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- server.ListenAndServe()
+	}()
+	t.logger.Info("serving self metrics", zap.String("address", address))
+
+	select {
+	case <-stopCh:
+	case err := <-serveErrCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.logger.Error("failed to serve self metrics", zap.String("address", address),
+				zap.Error(err))
+		}
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+// Shutdown pushes the pending metrics and stops the exporters.
+func (t *Telemetry) Shutdown(ctx context.Context) error {
+	return t.meterProvider.Shutdown(ctx)
+}
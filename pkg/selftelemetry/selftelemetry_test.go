@@ -0,0 +1,79 @@
+package selftelemetry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestHandlerDoesNotServeAPIKey(t *testing.T) {
+	telemetry, err := New(context.Background(), Config{
+		ServiceName: "mw-host-agent",
+		Version:     "1.2.3",
+		HostID:      "test-host",
+		APIKey:      "0123456789abcdef",
+	}, zap.NewNop())
+	assert.NoError(t, err)
+	defer telemetry.Shutdown(context.Background())
+
+	counter, err := telemetry.Meter("test").Int64Counter("mw_agent.test.calls")
+	assert.NoError(t, err)
+	counter.Add(context.Background(), 1)
+
+	server := httptest.NewServer(telemetry.Handler())
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + MetricsPath)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	assert.Contains(t, string(body), "mw_agent_test_calls")
+	assert.NotContains(t, string(body), "0123456789abcdef")
+	assert.NotContains(t, string(body), "target_info")
+}
+
+func TestPushThroughProxy(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- r:
+		default:
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.NoError(t, err)
+
+	telemetry, err := New(context.Background(), Config{
+		ServiceName: "mw-host-agent",
+		Target:      "http://myaccount.middleware.io:4318",
+		APIKey:      "0123456789abcdef",
+		Proxy: func(*url.URL) (*url.URL, error) {
+			return proxyURL, nil
+		},
+	}, zap.NewNop())
+	assert.NoError(t, err)
+
+	counter, err := telemetry.Meter("test").Int64Counter("mw_agent.test.calls")
+	assert.NoError(t, err)
+	counter.Add(context.Background(), 1)
+	assert.NoError(t, telemetry.Shutdown(context.Background()))
+
+	select {
+	case req := <-requests:
+		assert.Equal(t, "myaccount.middleware.io:4318", req.Host)
+		assert.Equal(t, "/v1/metrics", req.URL.Path)
+		assert.Equal(t, "0123456789abcdef", req.Header.Get("authorization"))
+	default:
+		t.Fatal("metrics were not pushed through the proxy")
+	}
+}
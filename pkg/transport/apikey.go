@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// APIKeyHeader is the header carrying the API key in the calls to the
+// Middleware backend.
+const APIKeyHeader = "Authorization"
+
+// apiKeyScheme is the authorization scheme of APIKeyHeader.
+const apiKeyScheme = "Bearer "
+
+// apiKeyMode is how an APIKeyTransport sends the API key.
+type apiKeyMode int32
+
+const (
+	// apiKeyModeUnknown tries the header and falls back to the path.
+	apiKeyModeUnknown apiKeyMode = iota
+	// apiKeyModeHeader sends the key in APIKeyHeader.
+	apiKeyModeHeader
+	// apiKeyModePath sends the key in the URL path, for the backends
+	// without support for APIKeyHeader.
+	apiKeyModePath
+)
+
+type apiRouteKey struct{}
+
+// NewAPIRequest returns a request to the route of the Middleware API below
+// base, e.g. api/v1/agent/restart-status, followed by elem. The request
+// does not carry the API key, the APIKeyTransport of the client adds it.
+func NewAPIRequest(method string, base *url.URL, route string, body io.Reader,
+	elem ...string) (*http.Request, error) {
+	routeURL := base.JoinPath(route)
+	req, err := http.NewRequest(method, routeURL.JoinPath(elem...).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	// JoinPath leaves out the leading slash if base has no path
+	routePath := "/" + strings.TrimPrefix(routeURL.Path, "/")
+	return req.WithContext(context.WithValue(req.Context(), apiRouteKey{}, routePath)), nil
+}
+
+// APIKeyTransport is an http.RoundTripper authenticating the requests
+// created by NewAPIRequest with the API key. The key is sent in
+// APIKeyHeader. Backends which don't support the header answer 404 to the
+// URLs without the key. The transport then retries with the URLs of those
+// backends, with the key in the path after the route. It keeps the way
+// which first got a 2xx or 304 response for the next requests, errors
+// don't decide it.
+type APIKeyTransport struct {
+	apiKey string
+	base   http.RoundTripper
+	mode   atomic.Int32
+}
+
+// NewAPIKeyTransport returns an APIKeyTransport sending the requests with
+// base, or http.DefaultTransport if base is nil.
+func NewAPIKeyTransport(apiKey string, base http.RoundTripper) *APIKeyTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &APIKeyTransport{apiKey: apiKey, base: base}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *APIKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	route, ok := req.Context().Value(apiRouteKey{}).(string)
+	if !ok || t.apiKey == "" {
+		return t.base.RoundTrip(req)
+	}
+
+	mode := apiKeyMode(t.mode.Load())
+	if mode != apiKeyModePath {
+		headerReq := req.Clone(req.Context())
+		headerReq.Header.Set(APIKeyHeader, apiKeyScheme+t.apiKey)
+
+		resp, err := t.base.RoundTrip(headerReq)
+		if err != nil || mode == apiKeyModeHeader {
+			return resp, err
+		}
+		if isSuccess(resp) {
+			t.mode.CompareAndSwap(int32(apiKeyModeUnknown), int32(apiKeyModeHeader))
+			return resp, nil
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			return resp, nil
+		}
+		if req.Body != nil && req.GetBody == nil {
+			// the body was consumed and can't be sent again
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+
+	pathReq := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		pathReq.Body = body
+	}
+	pathReq.URL.Path = route + "/" + t.apiKey + strings.TrimPrefix(req.URL.Path, route)
+	pathReq.URL.RawPath = ""
+
+	resp, err := t.base.RoundTrip(pathReq)
+	if err == nil && mode == apiKeyModeUnknown && isSuccess(resp) {
+		t.mode.CompareAndSwap(int32(apiKeyModeUnknown), int32(apiKeyModePath))
+	}
+	return resp, err
+}
+
+// isSuccess reports whether resp shows the backend accepted the way the
+// API key was sent.
+func isSuccess(resp *http.Response) bool {
+	return resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusNotModified
+}
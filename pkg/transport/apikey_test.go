@@ -0,0 +1,125 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeyTransportHeader(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.Header.Get(APIKeyHeader) != "Bearer apikey" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	base, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: NewAPIKeyTransport("apikey", nil)}
+
+	for i := 0; i < 2; i++ {
+		req, err := NewAPIRequest(http.MethodGet, base, "api/v1/agent/restart-status", nil)
+		assert.NoError(t, err)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, []string{"/api/v1/agent/restart-status", "/api/v1/agent/restart-status"}, paths)
+}
+
+func TestAPIKeyTransportPathFallback(t *testing.T) {
+	var paths, bodies []string
+	// a backend only serving the urls with the key in the path
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if !strings.Contains(r.URL.Path, "/apikey") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	base, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: NewAPIKeyTransport("apikey", nil)}
+
+	for i := 0; i < 2; i++ {
+		req, err := NewAPIRequest(http.MethodPut, base, "api/v1/agent/public/setting/config-groups",
+			strings.NewReader(`{"hostIds":["h1"]}`), "default")
+		assert.NoError(t, err)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		// the key is not in the url of the request
+		assert.NotContains(t, req.URL.String(), "apikey")
+	}
+
+	// the second call goes straight to the url with the key
+	assert.Equal(t, []string{
+		"/api/v1/agent/public/setting/config-groups/default",
+		"/api/v1/agent/public/setting/config-groups/apikey/default",
+		"/api/v1/agent/public/setting/config-groups/apikey/default",
+	}, paths)
+	assert.Equal(t, []string{`{"hostIds":["h1"]}`, `{"hostIds":["h1"]}`, `{"hostIds":["h1"]}`}, bodies)
+}
+
+func TestAPIKeyTransportOtherRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get(APIKeyHeader))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewAPIKeyTransport("apikey", nil)}
+	resp, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestAPIKeyTransportUndecidedOnErrors(t *testing.T) {
+	var paths []string
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch {
+		case strings.Contains(r.URL.Path, "/apikey"):
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(status)
+		}
+	}))
+	defer server.Close()
+
+	base, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: NewAPIKeyTransport("apikey", nil)}
+	call := func() int {
+		req, err := NewAPIRequest(http.MethodGet, base, "api/v1/agent/restart-status", nil)
+		assert.NoError(t, err)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// a server error does not settle on the header
+	assert.Equal(t, http.StatusInternalServerError, call())
+	// the next 404 still falls back to the path
+	status = http.StatusNotFound
+	assert.Equal(t, http.StatusOK, call())
+	assert.Equal(t, http.StatusOK, call())
+
+	assert.Equal(t, []string{
+		"/api/v1/agent/restart-status",
+		"/api/v1/agent/restart-status",
+		"/api/v1/agent/restart-status/apikey",
+		"/api/v1/agent/restart-status/apikey",
+	}, paths)
+}
@@ -0,0 +1,269 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/middleware-labs/mw-agent/pkg/redact"
+	"golang.org/x/net/http/httpproxy"
+)
+
+var (
+	ErrInvalidProxyConfig = errors.New("invalid proxy config")
+	ErrParseOtelConfig    = errors.New("failed to parse otel config")
+)
+
+// grpcExporterTypes are the OTLP gRPC exporter types, including the name
+// deprecated by the collector, and the type they are switched to when a
+// proxy is configured.
+var grpcExporterTypes = map[string]string{
+	"otlp":      "otlphttp",
+	"otlp_grpc": "otlp_http",
+}
+
+// httpExporterTypes are the OTLP HTTP exporter types.
+var httpExporterTypes = map[string]bool{
+	"otlphttp":  true,
+	"otlp_http": true,
+}
+
+// grpcOnlySettings are the settings of the otlp exporter which the
+// otlphttp exporter does not accept.
+var grpcOnlySettings = []string{
+	"authority",
+	"balancer_name",
+	"keepalive",
+	"wait_for_ready",
+}
+
+// ProxyUserInfoEnv is the environment variable holding the escaped
+// credentials of the proxy. The proxy_url of the exporters references it,
+// so that the credentials are not written in the otel config.
+const ProxyUserInfoEnv = "MW_PROXY_USERINFO"
+
+var envReferenceRegex = regexp.MustCompile(`\$\{env:([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ProxyConfig is the proxy section of the agent config.
+type ProxyConfig struct {
+	// URL is the proxy used for the calls to Middleware, e.g.
+	// http://proxy.internal:3128.
+	URL string
+	// NoProxy lists the hosts reached without the proxy, in the format of
+	// the NO_PROXY environment variable.
+	NoProxy string
+	// Username and Password authenticate with the proxy.
+	Username string
+	Password string
+}
+
+// IsSet reports whether a proxy is configured.
+func (c ProxyConfig) IsSet() bool {
+	return c.URL != ""
+}
+
+// String implements the stringer interface for ProxyConfig. The password
+// is masked.
+func (c ProxyConfig) String() string {
+	proxyURL := redact.String(c.URL, c.Password)
+	if u, err := url.Parse(c.URL); err == nil {
+		proxyURL = redact.URL(u, c.Password)
+	}
+
+	return fmt.Sprintf("url: %s, no-proxy: %s, username: %s, password: %s",
+		proxyURL, c.NoProxy, c.Username, redact.Secret(c.Password))
+}
+
+// ProxyURL returns the URL of the proxy including the credentials.
+func (c ProxyConfig) ProxyURL() (*url.URL, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxyConfig, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("%w: unsupported url scheme %q", ErrInvalidProxyConfig, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%w: url %s has no host", ErrInvalidProxyConfig, u.Redacted())
+	}
+
+	if (c.Username == "") != (c.Password == "") {
+		return nil, fmt.Errorf("%w: username and password must be set together", ErrInvalidProxyConfig)
+	}
+	if c.Username != "" {
+		u.User = url.UserPassword(c.Username, c.Password)
+	}
+
+	return u, nil
+}
+
+// UserInfo returns the escaped credentials of the proxy, e.g.
+// mw-agent:p%40ss, or an empty string if none are configured. It is the
+// value of ProxyUserInfoEnv for the collectors.
+func (c ProxyConfig) UserInfo() string {
+	if c.Username == "" {
+		return ""
+	}
+	return url.UserPassword(c.Username, c.Password).String()
+}
+
+// exporterProxyURL returns the proxy_url of the exporters, with a
+// reference to ProxyUserInfoEnv in place of the credentials.
+func (c ProxyConfig) exporterProxyURL() (string, error) {
+	u, err := c.ProxyURL()
+	if err != nil {
+		return "", err
+	}
+	if u.User == nil {
+		return u.String(), nil
+	}
+
+	u.User = nil
+	return strings.Replace(u.String(), "://", "://${env:"+ProxyUserInfoEnv+"}@", 1), nil
+}
+
+// ProxyFunc returns a function returning the proxy to use for a request
+// URL, or nil if the URL is listed in NoProxy.
+func (c ProxyConfig) ProxyFunc() (func(*url.URL) (*url.URL, error), error) {
+	u, err := c.ProxyURL()
+	if err != nil {
+		return nil, err
+	}
+
+	proxyConfig := &httpproxy.Config{
+		HTTPProxy:  u.String(),
+		HTTPSProxy: u.String(),
+		NoProxy:    c.NoProxy,
+	}
+	return proxyConfig.ProxyFunc(), nil
+}
+
+// UpdateExportersForProxy routes the OTLP exporters of config through
+// the proxy. The otlp exporters are switched to otlphttp since the gRPC
+// exporter has no proxy setting, and the pipelines are updated with the
+// new exporter ids. Exporters whose endpoint is listed in NoProxy are left
+// unchanged. The credentials of the proxy are resolved from
+// ProxyUserInfoEnv when the collector loads the config.
+func (c ProxyConfig) UpdateExportersForProxy(config map[string]interface{}) error {
+	proxyURL, err := c.exporterProxyURL()
+	if err != nil {
+		return err
+	}
+	proxyFunc, err := c.ProxyFunc()
+	if err != nil {
+		return err
+	}
+
+	exportersData, ok := config["exporters"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: exporters", ErrParseOtelConfig)
+	}
+
+	renamed := map[string]string{}
+	for id, exporter := range exportersData {
+		exporterType, name, hasName := strings.Cut(id, "/")
+		httpType, isGRPC := grpcExporterTypes[exporterType]
+		if !isGRPC && !httpExporterTypes[exporterType] {
+			continue
+		}
+
+		exporterData, ok := exporter.(map[string]interface{})
+		if !ok {
+			exporterData = map[string]interface{}{}
+		}
+
+		endpoint, _ := exporterData["endpoint"].(string)
+		if isGRPC {
+			endpoint = httpEndpoint(endpoint, exporterData)
+		}
+		if !usesProxy(proxyFunc, endpoint) {
+			continue
+		}
+		exporterData["proxy_url"] = proxyURL
+
+		if isGRPC {
+			exporterData["endpoint"] = endpoint
+			for _, setting := range grpcOnlySettings {
+				delete(exporterData, setting)
+			}
+
+			newID := httpType
+			if hasName {
+				newID += "/" + name
+			}
+			if _, exists := exportersData[newID]; exists {
+				newID = httpType + "/" + strings.ReplaceAll(id, "/", "_")
+			}
+
+			delete(exportersData, id)
+			renamed[id] = newID
+			id = newID
+		}
+		exportersData[id] = exporterData
+	}
+
+	if len(renamed) == 0 {
+		return nil
+	}
+
+	serviceData, ok := config["service"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: service", ErrParseOtelConfig)
+	}
+	pipelinesData, _ := serviceData["pipelines"].(map[string]interface{})
+	for _, pipeline := range pipelinesData {
+		pipelineData, ok := pipeline.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		exporters, _ := pipelineData["exporters"].([]interface{})
+		for i, exporter := range exporters {
+			if id, ok := exporter.(string); ok && renamed[id] != "" {
+				exporters[i] = renamed[id]
+			}
+		}
+	}
+
+	return nil
+}
+
+// httpEndpoint returns the endpoint of an otlp exporter as an URL, which
+// the otlphttp exporter requires.
+func httpEndpoint(endpoint string, exporterData map[string]interface{}) string {
+	if endpoint == "" || strings.Contains(endpoint, "://") ||
+		strings.Contains(expandEnv(endpoint), "://") {
+		return endpoint
+	}
+
+	tlsData, _ := exporterData["tls"].(map[string]interface{})
+	if insecure, _ := tlsData["insecure"].(bool); insecure {
+		return "http://" + endpoint
+	}
+	return "https://" + endpoint
+}
+
+// usesProxy reports whether the requests to endpoint go through the
+// proxy. Endpoints which can't be resolved are proxied.
+func usesProxy(proxyFunc func(*url.URL) (*url.URL, error), endpoint string) bool {
+	u, err := url.Parse(expandEnv(endpoint))
+	if err != nil || u.Host == "" {
+		return true
+	}
+
+	proxy, err := proxyFunc(u)
+	return err != nil || proxy != nil
+}
+
+// expandEnv replaces the ${env:NAME} references of the collector config
+// in s with the environment of the agent.
+func expandEnv(s string) string {
+	return envReferenceRegex.ReplaceAllStringFunc(s, func(ref string) string {
+		return os.Getenv(envReferenceRegex.FindStringSubmatch(ref)[1])
+	})
+}
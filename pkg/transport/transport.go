@@ -0,0 +1,198 @@
+// Package transport builds the TLS and proxy settings and HTTP transports
+// the agents use to reach Middleware, for the control-plane calls as well as
+// for the exporters in the otel configs they render.
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var ErrInvalidTLSConfig = errors.New("invalid tls config")
+
+// tlsVersions maps the values of TLSConfig.MinVersion to TLS versions. The
+// values are the ones accepted by the min_version setting of the
+// collector.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig is the tls section of the agent config.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of the certificate authorities trusted in
+	// addition to the system ones, e.g. the one of a TLS inspecting proxy.
+	CAFile string
+	// CertFile and KeyFile are the client certificate and key used for
+	// mutual TLS.
+	CertFile string
+	KeyFile  string
+	// MinVersion is the minimum TLS version, 1.0 to 1.3.
+	MinVersion string
+}
+
+// IsSet reports whether any of the settings is set.
+func (c TLSConfig) IsSet() bool {
+	return c != TLSConfig{}
+}
+
+// String implements the stringer interface for TLSConfig.
+func (c TLSConfig) String() string {
+	return fmt.Sprintf("ca-file: %s, cert-file: %s, key-file: %s, min-version: %s",
+		c.CAFile, c.CertFile, c.KeyFile, c.MinVersion)
+}
+
+// ClientConfig returns the tls.Config of the clients calling Middleware.
+func (c TLSConfig) ClientConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("%w: unsupported min-version %q", ErrInvalidTLSConfig, c.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if c.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTLSConfig, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: no certificates found in %s", ErrInvalidTLSConfig, c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("%w: cert-file and key-file must be set together", ErrInvalidTLSConfig)
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTLSConfig, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// ExporterSettings returns the settings to merge into the tls section of
+// an otlp or otlphttp exporter. The system roots stay trusted next to
+// CAFile, as they are in ClientConfig.
+func (c TLSConfig) ExporterSettings() map[string]interface{} {
+	settings := map[string]interface{}{}
+	if c.CAFile != "" {
+		settings["ca_file"] = c.CAFile
+		settings["include_system_ca_certs_pool"] = true
+	}
+	if c.CertFile != "" {
+		settings["cert_file"] = c.CertFile
+	}
+	if c.KeyFile != "" {
+		settings["key_file"] = c.KeyFile
+	}
+	if c.MinVersion != "" {
+		settings["min_version"] = c.MinVersion
+	}
+	return settings
+}
+
+// UpdateExportersForTLS merges ExporterSettings into the tls section of
+// every OTLP exporter of config.
+func (c TLSConfig) UpdateExportersForTLS(config map[string]interface{}) error {
+	exportersData, ok := config["exporters"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: exporters", ErrParseOtelConfig)
+	}
+
+	for id, exporter := range exportersData {
+		exporterType, _, _ := strings.Cut(id, "/")
+		if _, isGRPC := grpcExporterTypes[exporterType]; !isGRPC && !httpExporterTypes[exporterType] {
+			continue
+		}
+
+		exporterData, ok := exporter.(map[string]interface{})
+		if !ok {
+			exporterData = map[string]interface{}{}
+		}
+
+		tlsData, ok := exporterData["tls"].(map[string]interface{})
+		if !ok {
+			tlsData = map[string]interface{}{}
+		}
+		for key, value := range c.ExporterSettings() {
+			tlsData[key] = value
+		}
+
+		exporterData["tls"] = tlsData
+		exportersData[id] = exporterData
+	}
+
+	return nil
+}
+
+// Config configures the transports returned by NewHTTPTransport.
+type Config struct {
+	TLS   TLSConfig
+	Proxy ProxyConfig
+	// APIKey authenticates the requests created by NewAPIRequest with the
+	// clients returned by NewHTTPClient.
+	APIKey string
+}
+
+// NewHTTPTransport returns a copy of http.DefaultTransport using the
+// settings of cfg.
+func NewHTTPTransport(cfg Config) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.TLS.IsSet() {
+		tlsConfig, err := cfg.TLS.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = tlsConfig
+	}
+
+	// Without a configured proxy the HTTP_PROXY environment variables of
+	// http.DefaultTransport still apply
+	if cfg.Proxy.IsSet() {
+		proxyFunc, err := cfg.Proxy.ProxyFunc()
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+
+	return t, nil
+}
+
+// NewHTTPClient returns an http.Client using NewHTTPTransport, wrapped in
+// an APIKeyTransport if cfg.APIKey is set.
+func NewHTTPClient(cfg Config) (*http.Client, error) {
+	t, err := NewHTTPTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.APIKey != "" {
+		return &http.Client{Transport: NewAPIKeyTransport(cfg.APIKey, t)}, nil
+	}
+	return &http.Client{Transport: t}, nil
+}
@@ -0,0 +1,113 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCertificate writes a self-signed certificate and its key to dir
+// and returns their paths.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mw-agent-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestTLSConfigClientConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+	notPEMFile := filepath.Join(dir, "ca.txt")
+	assert.NoError(t, os.WriteFile(notPEMFile, []byte("not a certificate"), 0600))
+
+	tlsConfig, err := TLSConfig{
+		CAFile:     certFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		MinVersion: "1.3",
+	}.ClientConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.Len(t, tlsConfig.Certificates, 1)
+
+	for name, cfg := range map[string]TLSConfig{
+		"unknown min version": {MinVersion: "1.4"},
+		"missing ca file":     {CAFile: filepath.Join(dir, "missing.pem")},
+		"ca file without pem": {CAFile: notPEMFile},
+		"cert without key":    {CertFile: certFile},
+	} {
+		_, err := cfg.ClientConfig()
+		assert.ErrorIs(t, err, ErrInvalidTLSConfig, name)
+	}
+}
+
+func TestTLSConfigExporterSettings(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{
+		"ca_file":                      "/etc/mw-agent/ca.pem",
+		"include_system_ca_certs_pool": true,
+		"min_version":                  "1.2",
+	}, TLSConfig{CAFile: "/etc/mw-agent/ca.pem", MinVersion: "1.2"}.ExporterSettings())
+}
+
+func TestTLSConfigUpdateExportersForTLS(t *testing.T) {
+	config := map[string]interface{}{
+		"exporters": map[string]interface{}{
+			"otlp": map[string]interface{}{
+				"endpoint": "${env:MW_TARGET}",
+				"tls":      map[string]interface{}{"server_name_override": "middleware.io"},
+			},
+			"otlphttp/mw": map[string]interface{}{},
+			"debug":       map[string]interface{}{},
+		},
+	}
+
+	err := TLSConfig{CAFile: "/etc/mw-agent/ca.pem", MinVersion: "1.2"}.UpdateExportersForTLS(config)
+	assert.NoError(t, err)
+
+	exporters := config["exporters"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{
+		"server_name_override":         "middleware.io",
+		"ca_file":                      "/etc/mw-agent/ca.pem",
+		"include_system_ca_certs_pool": true,
+		"min_version":                  "1.2",
+	}, exporters["otlp"].(map[string]interface{})["tls"])
+	assert.Equal(t, "/etc/mw-agent/ca.pem",
+		exporters["otlphttp/mw"].(map[string]interface{})["tls"].(map[string]interface{})["ca_file"])
+	assert.NotContains(t, exporters["debug"], "tls")
+
+	err = TLSConfig{CAFile: "/etc/mw-agent/ca.pem"}.UpdateExportersForTLS(map[string]interface{}{})
+	assert.ErrorIs(t, err, ErrParseOtelConfig)
+}